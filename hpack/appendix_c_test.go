@@ -0,0 +1,301 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The examples from RFC 7541 Appendix C. Each step lists the header block,
+// the headers it carries and the dynamic table afterwards, newest first.
+type appendixCStep struct {
+	wire      string
+	headers   []Header
+	table     []Header
+	tableSize int
+}
+
+type appendixCExample struct {
+	name      string
+	huffman   bool
+	tableSize int
+	steps     []appendixCStep
+}
+
+var (
+	authority    = Header{Name: ":authority", Value: "www.example.com"}
+	cacheControl = Header{Name: "cache-control", Value: "no-cache"}
+	customKey    = Header{Name: "custom-key", Value: "custom-value"}
+
+	status302       = Header{Name: ":status", Value: "302"}
+	status307       = Header{Name: ":status", Value: "307"}
+	private         = Header{Name: "cache-control", Value: "private"}
+	date21          = Header{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"}
+	date22          = Header{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"}
+	location        = Header{Name: "location", Value: "https://www.example.com"}
+	contentEncoding = Header{Name: "content-encoding", Value: "gzip"}
+	setCookie       = Header{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"}
+)
+
+var (
+	requestHeaders1 = []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		authority,
+	}
+	requestHeaders2 = append(requestHeaders1[:4:4], cacheControl)
+	requestHeaders3 = []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		authority,
+		customKey,
+	}
+
+	responseHeaders1 = []Header{status302, private, date21, location}
+	responseHeaders2 = []Header{status307, private, date21, location}
+	responseHeaders3 = []Header{
+		{Name: ":status", Value: "200"},
+		private,
+		date22,
+		location,
+		contentEncoding,
+		setCookie,
+	}
+)
+
+var appendixCExamples = []appendixCExample{
+	{
+		name:      "C.3 requests without huffman",
+		tableSize: 4096,
+		steps: []appendixCStep{
+			{
+				wire:      "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+				headers:   requestHeaders1,
+				table:     []Header{authority},
+				tableSize: 57,
+			},
+			{
+				wire:      "8286 84be 5808 6e6f 2d63 6163 6865",
+				headers:   requestHeaders2,
+				table:     []Header{cacheControl, authority},
+				tableSize: 110,
+			},
+			{
+				wire:      "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+				headers:   requestHeaders3,
+				table:     []Header{customKey, cacheControl, authority},
+				tableSize: 164,
+			},
+		},
+	},
+	{
+		name:      "C.4 requests with huffman",
+		huffman:   true,
+		tableSize: 4096,
+		steps: []appendixCStep{
+			{
+				wire:      "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+				headers:   requestHeaders1,
+				table:     []Header{authority},
+				tableSize: 57,
+			},
+			{
+				wire:      "8286 84be 5886 a8eb 1064 9cbf",
+				headers:   requestHeaders2,
+				table:     []Header{cacheControl, authority},
+				tableSize: 110,
+			},
+			{
+				wire:      "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+				headers:   requestHeaders3,
+				table:     []Header{customKey, cacheControl, authority},
+				tableSize: 164,
+			},
+		},
+	},
+	{
+		name:      "C.5 responses without huffman",
+		tableSize: 256,
+		steps: []appendixCStep{
+			{
+				wire: "4803 3330 3258 0770 7269 7661 7465 611d" +
+					"4d6f 6e2c 2032 3120 4f63 7420 3230 3133" +
+					"2032 303a 3133 3a32 3120 474d 546e 1768" +
+					"7474 7073 3a2f 2f77 7777 2e65 7861 6d70" +
+					"6c65 2e63 6f6d",
+				headers:   responseHeaders1,
+				table:     []Header{location, date21, private, status302},
+				tableSize: 222,
+			},
+			{
+				wire:      "4803 3330 37c1 c0bf",
+				headers:   responseHeaders2,
+				table:     []Header{status307, location, date21, private},
+				tableSize: 222,
+			},
+			{
+				wire: "88c1 611d 4d6f 6e2c 2032 3120 4f63 7420" +
+					"3230 3133 2032 303a 3133 3a32 3220 474d" +
+					"54c0 5a04 677a 6970 7738 666f 6f3d 4153" +
+					"444a 4b48 514b 425a 584f 5157 454f 5049" +
+					"5541 5851 5745 4f49 553b 206d 6178 2d61" +
+					"6765 3d33 3630 303b 2076 6572 7369 6f6e" +
+					"3d31",
+				headers:   responseHeaders3,
+				table:     []Header{setCookie, contentEncoding, date22},
+				tableSize: 215,
+			},
+		},
+	},
+	{
+		name:      "C.6 responses with huffman",
+		huffman:   true,
+		tableSize: 256,
+		steps: []appendixCStep{
+			{
+				wire: "4882 6402 5885 aec3 771a 4b61 96d0 7abe" +
+					"9410 54d4 44a8 2005 9504 0b81 66e0 82a6" +
+					"2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8" +
+					"e9ae 82ae 43d3",
+				headers:   responseHeaders1,
+				table:     []Header{location, date21, private, status302},
+				tableSize: 222,
+			},
+			{
+				wire:      "4883 640e ffc1 c0bf",
+				headers:   responseHeaders2,
+				table:     []Header{status307, location, date21, private},
+				tableSize: 222,
+			},
+			{
+				wire: "88c1 6196 d07a be94 1054 d444 a820 0595" +
+					"040b 8166 e084 a62d 1bff c05a 839b d9ab" +
+					"77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b" +
+					"3960 d5af 2708 7f36 72c1 ab27 0fb5 291f" +
+					"9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+				headers:   responseHeaders3,
+				table:     []Header{setCookie, contentEncoding, date22},
+				tableSize: 215,
+			},
+		},
+	},
+}
+
+func dehex(t *testing.T, s string) []byte {
+	t.Helper()
+	bs, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	require.NoError(t, err)
+	return bs
+}
+
+// dynamicTable lists the dynamic table entries, newest first.
+func dynamicTable(table *indexTable) []Header {
+	var headers []Header
+	for index := len(staticTable); ; index++ {
+		header, err := table.Get(index)
+		if err != nil {
+			return headers
+		}
+		headers = append(headers, header)
+	}
+}
+
+// newAppendixCEncoder starts with the table size the examples assume has
+// already been agreed on, so no size update is emitted.
+func newAppendixCEncoder(tableSize int, huffman bool) *HPackEncoder {
+	encoder := &HPackEncoder{DisableHuffman: !huffman}
+	encoder.table().UpdateMaxSize(tableSize)
+	encoder.tableSize = tableSize
+	return encoder
+}
+
+func TestAppendixCDecoder(t *testing.T) {
+	for _, example := range appendixCExamples {
+		t.Run(example.name, func(t *testing.T) {
+			decoder := Decoder()
+			decoder.SetMaxDynamicTableSize(example.tableSize)
+			for i, step := range example.steps {
+				headers, err := decoder.Decode(dehex(t, step.wire))
+				require.NoError(t, err, "step %d", i+1)
+				assert.Equal(t, step.headers, headers, "step %d", i+1)
+				assert.Equal(t, step.table, dynamicTable(decoder.indexTable), "step %d", i+1)
+				assert.Equal(t, step.tableSize, decoder.indexTable.currentSize, "step %d", i+1)
+			}
+		})
+	}
+}
+
+func TestAppendixCEncoder(t *testing.T) {
+	for _, example := range appendixCExamples {
+		t.Run(example.name, func(t *testing.T) {
+			encoder := newAppendixCEncoder(example.tableSize, example.huffman)
+			for i, step := range example.steps {
+				block, err := encoder.Encode(step.headers)
+				require.NoError(t, err, "step %d", i+1)
+				assert.Equal(t, dehex(t, step.wire), block, "step %d", i+1)
+				assert.Equal(t, step.table, dynamicTable(encoder.indexTable), "step %d", i+1)
+				assert.Equal(t, step.tableSize, encoder.indexTable.currentSize, "step %d", i+1)
+			}
+		})
+	}
+}
+
+// C.2 covers single representations, each against an empty table.
+func TestAppendixCRepresentations(t *testing.T) {
+	tests := []struct {
+		name    string
+		wire    string
+		header  Header
+		table   []Header
+		encoded bool
+	}{
+		{
+			name:    "C.2.1 literal with indexing",
+			wire:    "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			header:  Header{Name: "custom-key", Value: "custom-header"},
+			table:   []Header{{Name: "custom-key", Value: "custom-header"}},
+			encoded: true,
+		},
+		{
+			// the encoder would index this one
+			name:   "C.2.2 literal without indexing",
+			wire:   "040c 2f73 616d 706c 652f 7061 7468",
+			header: Header{Name: ":path", Value: "/sample/path"},
+		},
+		{
+			name:    "C.2.3 literal never indexed",
+			wire:    "1008 7061 7373 776f 7264 0673 6563 7265 74",
+			header:  Header{Name: "password", Value: "secret", neverIndexed: true},
+			encoded: true,
+		},
+		{
+			name:    "C.2.4 indexed",
+			wire:    "82",
+			header:  Header{Name: ":method", Value: "GET"},
+			encoded: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := Decoder()
+			headers, err := decoder.Decode(dehex(t, tt.wire))
+			require.NoError(t, err)
+			assert.Equal(t, []Header{tt.header}, headers)
+			assert.Equal(t, tt.table, dynamicTable(decoder.indexTable))
+
+			if tt.encoded {
+				encoder := &HPackEncoder{DisableHuffman: true}
+				block, err := encoder.Encode([]Header{tt.header})
+				require.NoError(t, err)
+				assert.Equal(t, dehex(t, tt.wire), block)
+				assert.Equal(t, tt.table, dynamicTable(encoder.indexTable))
+			}
+		})
+	}
+}
@@ -2,30 +2,122 @@ package hpack
 
 import "errors"
 
+// EmitFunc receives each header field as soon as it has been decoded.
+type EmitFunc func(Header)
+
 type HPackDecoder struct {
 	indexTable *indexTable
+
+	// maxTableSize is the largest dynamic table size the encoder may pick
+	// with a size update, i.e. our SETTINGS_HEADER_TABLE_SIZE.
+	maxTableSize int
+
+	// maxHeaderListSize bounds the total Size of the headers emitted for
+	// a single header block, 0 meaning unlimited.
+	maxHeaderListSize int
+
+	emit        EmitFunc
+	internNames bool
+
+	// state of the header block being written
+	buf        []byte // start of a field split across writes
+	blockStart bool
+	listSize   int
+	tooLarge   bool
+
+	// scratch space for Huffman decoded names and values
+	nameBuf, valueBuf []byte
 }
 
 var ErrCompressionError = errors.New("COMPRESSION_ERROR")
 
+// ErrHeaderListTooLarge is returned when the decoded headers exceed the
+// limit set with SetMaxHeaderListSize. Unlike ErrCompressionError the
+// decoder remains usable: the whole block is still processed so the
+// dynamic table stays in sync with the encoder.
+var ErrHeaderListTooLarge = errors.New("header list exceeds maximum size")
+
+// ErrTruncated means the input ends in the middle of an integer or string
+// literal.
+var ErrTruncated = errors.New("truncated input")
+
+// maxIntBytes bounds the continuation bytes of an encoded integer. Four
+// bytes carry 28 bits, which is far beyond any legitimate index or length.
+const maxIntBytes = 4
+
 func Decoder() *HPackDecoder {
 	return &HPackDecoder{
-		indexTable: NewIndexTable(),
+		indexTable:   NewIndexTable(),
+		maxTableSize: 4096,
+		blockStart:   true,
 	}
 }
 
-func decInt(bs *[]byte, prefix int) int {
+// SetMaxDynamicTableSize sets the upper bound for dynamic table size
+// updates, which should match the SETTINGS_HEADER_TABLE_SIZE we advertise.
+func (h *HPackDecoder) SetMaxDynamicTableSize(size int) {
+	h.maxTableSize = size
+	if h.indexTable.maxSize > size {
+		h.indexTable.UpdateMaxSize(size)
+	}
+}
+
+// DynamicTableSize returns the size of the entries in the dynamic table and
+// the size the encoder last set for it, as counted by RFC 7541 §4.1.
+func (h *HPackDecoder) DynamicTableSize() (size, maxSize int) {
+	return h.indexTable.currentSize, h.indexTable.maxSize
+}
+
+// SetMaxHeaderListSize limits the uncompressed size of a decoded header
+// list, as advertised with SETTINGS_MAX_HEADER_LIST_SIZE. 0 means unlimited.
+func (h *HPackDecoder) SetMaxHeaderListSize(size int) {
+	h.maxHeaderListSize = size
+}
+
+// SetEmitFunc sets the callback Write hands decoded header fields to.
+func (h *HPackDecoder) SetEmitFunc(emit EmitFunc) {
+	h.emit = emit
+}
+
+// SetNameInterning makes literal header names share the string of a
+// matching static or dynamic table entry instead of allocating a new one.
+func (h *HPackDecoder) SetNameInterning(enabled bool) {
+	h.internNames = enabled
+}
+
+func decInt(bs *[]byte, prefix int) (int, error) {
+	i, rest, err := ReadInt(*bs, prefix)
+	if err != nil {
+		return 0, err
+	}
+	*bs = rest
+	return i, nil
+}
+
+// ReadInt reads a prefix integer (RFC 7541 §5.1) from the low prefix bits
+// of bs[0] onwards and returns the rest of bs. Integers needing more than
+// maxIntBytes continuation bytes result in ErrCompressionError.
+func ReadInt(bs []byte, prefix int) (int, []byte, error) {
+	if len(bs) == 0 {
+		return 0, nil, ErrTruncated
+	}
 	mask := (1 << prefix) - 1
-	i := int((*bs)[0]) & mask
-	*bs = (*bs)[1:]
+	i := int(bs[0]) & mask
+	bs = bs[1:]
 	if i < mask {
-		return i
+		return i, bs, nil
 	}
 
 	m := 0
-	for {
-		oct := (*bs)[0]
-		*bs = (*bs)[1:]
+	for n := 0; ; n++ {
+		if n == maxIntBytes {
+			return 0, nil, ErrCompressionError
+		}
+		if len(bs) == 0 {
+			return 0, nil, ErrTruncated
+		}
+		oct := bs[0]
+		bs = bs[1:]
 		i += int(oct&127) << m
 		m += 7
 		if oct&128 != 128 {
@@ -33,102 +125,258 @@ func decInt(bs *[]byte, prefix int) int {
 		}
 	}
 
-	return i
+	return i, bs, nil
 }
 
-func readStringLiteral(bs *[]byte) (string, error) {
+// ReadString reads a string literal (RFC 7541 §5.2) whose length is a
+// prefix integer with the Huffman flag in the bit above the prefix, and
+// returns the rest of bs.
+func ReadString(bs []byte, prefix int) (string, []byte, error) {
+	if len(bs) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := bs[0]&(1<<prefix) != 0
+	n, bs, err := ReadInt(bs, prefix)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(bs) < n {
+		return "", nil, ErrTruncated
+	}
+	if !huffman {
+		return string(bs[:n]), bs[n:], nil
+	}
+	str, err := HuffmanDecoder(bs[:n])
+	if err != nil {
+		return "", nil, ErrCompressionError
+	}
+	return str, bs[n:], nil
+}
+
+// readString reads a string literal. Huffman coded strings are decoded into
+// scratch, which is grown as needed, plain ones are returned in place.
+func readString(bs *[]byte, scratch *[]byte) ([]byte, error) {
 	if len(*bs) == 0 {
-		return "", ErrCompressionError
+		return nil, ErrTruncated
 	}
 	huffman := (*bs)[0]&0x80 != 0 // huffman
-	n := decInt(bs, 7)
+	n, err := decInt(bs, 7)
+	if err != nil {
+		return nil, err
+	}
 	if len(*bs) < n {
-		return "", ErrCompressionError
+		return nil, ErrTruncated
+	}
+	str := (*bs)[:n]
+	*bs = (*bs)[n:]
+	if !huffman {
+		return str, nil
+	}
+	str, err = huffmanDecode((*scratch)[:0], str)
+	if err != nil {
+		return nil, ErrCompressionError
+	}
+	*scratch = str
+	return str, nil
+}
+
+// readHeaderField reads a literal representation after its first byte's
+// flags, with the name index in the low prefix bits. Unless keep is set
+// the strings are only allocated if the header is going to be emitted.
+func (h *HPackDecoder) readHeaderField(bs *[]byte, prefix int, keep bool) (Header, error) {
+	idx, err := decInt(bs, prefix)
+	if err != nil {
+		return Header{}, err
 	}
-	dec := (*bs)[:n]
-	var str string
-	var err error
-	if huffman {
-		str, err = HuffmanDecoder(dec)
+
+	var header Header
+	var name []byte
+	if idx > 0 {
+		header, err = h.indexTable.Get(idx)
 		if err != nil {
-			return "", err
+			return Header{}, ErrCompressionError
 		}
 	} else {
-		str = string(dec)
+		name, err = readString(bs, &h.nameBuf)
+		if err != nil {
+			return Header{}, err
+		}
+	}
+	value, err := readString(bs, &h.valueBuf)
+	if err != nil {
+		return Header{}, err
 	}
 
-	*bs = (*bs)[n:]
-	return str, nil
+	if !keep && h.exceedsListSize(len(header.Name)+len(name)+len(value)+32) {
+		// only the size counts from here on
+		h.tooLarge = true
+		return Header{}, nil
+	}
+	if idx == 0 {
+		header.Name = h.internName(name)
+	}
+	return Header{
+		Name:  header.Name,
+		Value: string(value),
+	}, nil
 }
 
-func (h *HPackDecoder) readHeaderFieldInternal(bs *[]byte, idx int) (Header, error) {
-	if idx > 0 {
+func (h *HPackDecoder) internName(name []byte) string {
+	if h.internNames {
+		// these lookups don't allocate for the []byte conversion
+		if i, ok := staticNameIndex[string(name)]; ok {
+			return staticTable[i].Name
+		}
+		if seq, ok := h.indexTable.nameIndex[string(name)]; ok {
+			if header, err := h.indexTable.Get(h.indexTable.seqIndex(seq)); err == nil {
+				return header.Name
+			}
+		}
+	}
+	return string(name)
+}
+
+func (h *HPackDecoder) exceedsListSize(size int) bool {
+	return h.tooLarge || h.maxHeaderListSize > 0 && h.listSize+size > h.maxHeaderListSize
+}
+
+func (h *HPackDecoder) emitHeader(header Header) {
+	if h.tooLarge {
+		return
+	}
+	if h.exceedsListSize(header.Size()) {
+		h.tooLarge = true
+		return
+	}
+	h.listSize += header.Size()
+	if h.emit != nil {
+		h.emit(header)
+	}
+}
+
+// Write decodes a fragment of a header block, handing every complete
+// header field to the EmitFunc. A field split across fragments is kept
+// until the rest of it arrives. Every malformed input results in
+// ErrCompressionError, after which the decoder's dynamic table can no
+// longer be trusted and the connection must be torn down.
+//
+// Once the header list grows past the maximum header list size, fields are
+// no longer emitted but the rest of the block is still processed; Close
+// then reports ErrHeaderListTooLarge.
+func (h *HPackDecoder) Write(p []byte) (int, error) {
+	bs := p
+	if len(h.buf) > 0 {
+		h.buf = append(h.buf, p...)
+		bs = h.buf
+	}
+
+	for len(bs) > 0 {
+		rest := bs
+		err := h.decodeField(&rest)
+		if err == ErrTruncated {
+			break
+		}
+		if err != nil {
+			h.resetBlock()
+			return 0, err
+		}
+		bs = rest
+	}
+
+	// keep the incomplete field, which is either the tail of h.buf or
+	// part of p, which belongs to the caller
+	if len(h.buf) > 0 {
+		h.buf = h.buf[:copy(h.buf, bs)]
+	} else {
+		h.buf = append(h.buf, bs...)
+	}
+	return len(p), nil
+}
+
+// Close ends the header block, readying the decoder for the next one.
+func (h *HPackDecoder) Close() error {
+	defer h.resetBlock()
+	if len(h.buf) > 0 {
+		return ErrCompressionError
+	}
+	if h.tooLarge {
+		return ErrHeaderListTooLarge
+	}
+	return nil
+}
+
+func (h *HPackDecoder) resetBlock() {
+	h.buf = h.buf[:0]
+	h.blockStart = true
+	h.listSize = 0
+	h.tooLarge = false
+}
+
+// decodeField decodes a single representation. Nothing changes unless the
+// whole representation is in bs.
+func (h *HPackDecoder) decodeField(bs *[]byte) error {
+	field := (*bs)[0]
+
+	switch {
+	case field&0x80 != 0: // indexed header field
+		idx, err := decInt(bs, 7)
+		if err != nil {
+			return err
+		}
 		header, err := h.indexTable.Get(idx)
 		if err != nil {
-			return Header{}, err
+			return ErrCompressionError
 		}
-		val, err := readStringLiteral(bs)
+		h.emitHeader(header)
+	case field&0xc0 == 0x40: // literal with incremental indexing
+		header, err := h.readHeaderField(bs, 6, true)
 		if err != nil {
-			return Header{}, err
+			return err
 		}
-		return Header{
-			Name:  header.Name,
-			Value: val,
-		}, nil
-	} else {
-		name, err := readStringLiteral(bs)
+		h.indexTable.Add(header)
+		h.emitHeader(header)
+	case field&0xe0 == 0x20: // dynamic table size update
+		if !h.blockStart {
+			return ErrCompressionError
+		}
+		size, err := decInt(bs, 5)
 		if err != nil {
-			return Header{}, err
+			return err
+		}
+		if size > h.maxTableSize {
+			return ErrCompressionError
 		}
-		val, err := readStringLiteral(bs)
+		h.indexTable.UpdateMaxSize(size)
+		return nil
+	default: // literal without indexing (0000) or never indexed (0001)
+		neverIndexing := field&0xf0 == 0x10
+		header, err := h.readHeaderField(bs, 4, false)
 		if err != nil {
-			return Header{}, err
+			return err
+		}
+		if !h.tooLarge {
+			header.neverIndexed = neverIndexing
+			h.emitHeader(header)
 		}
-		return Header{
-			Name:  name,
-			Value: val,
-		}, nil
 	}
+	h.blockStart = false
+	return nil
 }
 
+// Decode decodes a complete header block, see Write.
 func (h *HPackDecoder) Decode(bs []byte) ([]Header, error) {
 	headers := []Header{}
-	for len(bs) > 0 {
-		field := bs[0]
-
-		indexedHeader := (field & 0x80) != 0
-		incrementedIndexed := (field & 0xc0) == 0x40
-
-		woIndexing := (field & 0xf0) == 0
-		neverIndexing := (field & 0xf0) == 0x10
-		sizeUpdate := (field & 0xe0) == 0x20
+	emit := h.emit
+	defer func() { h.emit = emit }()
+	h.emit = func(header Header) {
+		headers = append(headers, header)
+	}
 
-		if indexedHeader {
-			idx := decInt(&bs, 7)
-			header, err := h.indexTable.Get(idx)
-			if err != nil {
-				return nil, err
-			}
-			headers = append(headers, header)
-		} else if incrementedIndexed {
-			header, err := h.readHeaderFieldInternal(&bs, decInt(&bs, 6))
-			if err != nil {
-				return nil, err
-			}
-			h.indexTable.Add(header)
-			headers = append(headers, header)
-		} else if woIndexing || neverIndexing {
-			header, err := h.readHeaderFieldInternal(&bs, decInt(&bs, 4))
-			if err != nil {
-				return nil, err
-			}
-			header.neverIndexed = neverIndexing
-			headers = append(headers, header)
-		} else if sizeUpdate {
-			// TODO: update dynamic table size
-			i := decInt(&bs, 5)
-			h.indexTable.UpdateMaxSize(i)
-		}
+	if _, err := h.Write(bs); err != nil {
+		return nil, err
+	}
+	if err := h.Close(); err != nil {
+		return nil, err
 	}
 	return headers, nil
 }
@@ -2,9 +2,11 @@ package hpack
 
 import (
 	"encoding/hex"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type decodeTest struct {
@@ -46,6 +48,40 @@ func TestDecoder(t *testing.T) {
 				{Name: "content-type", Value: "application/x-www-form-urlencoded"},
 			},
 		},
+		{
+			// dynamic table size update followed by an indexed field
+			inhex: "3fe11f82",
+			out: []Header{
+				{Name: ":method", Value: "GET"},
+			},
+		},
+		// indexed field with index 0
+		{inhex: "80", expectErr: true},
+		// index beyond the static and (empty) dynamic table
+		{inhex: "be", expectErr: true},
+		// truncated multi-byte integer
+		{inhex: "ff", expectErr: true},
+		{inhex: "ff80", expectErr: true},
+		// integer with too many continuation bytes
+		{inhex: "ff8080808000", expectErr: true},
+		// integer large enough to overflow
+		{inhex: "ffffffffffffffffffff7f", expectErr: true},
+		// literal name with a length longer than the input
+		{inhex: "400a6162", expectErr: true},
+		// literal with a missing value
+		{inhex: "0001610a", expectErr: true},
+		// literal with nothing after the representation byte
+		{inhex: "00", expectErr: true},
+		// huffman string padded with a zero bit
+		{inhex: "0081180161", expectErr: true},
+		// huffman string padded with more than 7 bits
+		{inhex: "00821fff0161", expectErr: true},
+		// huffman string containing EOS
+		{inhex: "0084fffffffc0161", expectErr: true},
+		// size update after a header field
+		{inhex: "8220", expectErr: true},
+		// size update above SETTINGS_HEADER_TABLE_SIZE
+		{inhex: "3fe21f", expectErr: true},
 	}
 
 	for _, tt := range tests {
@@ -57,10 +93,222 @@ func TestDecoder(t *testing.T) {
 		decoder := Decoder()
 		headers, err := decoder.Decode(bs)
 		if tt.expectErr {
-			assert.NotNil(t, err)
+			assert.ErrorIs(t, err, ErrCompressionError, tt.inhex)
 		} else {
 			assert.NoError(t, err)
 			assert.Equal(t, tt.out, headers)
 		}
 	}
 }
+
+func TestDecoderSizeUpdateLimit(t *testing.T) {
+	decoder := Decoder()
+	decoder.SetMaxDynamicTableSize(256)
+
+	// size update to 256 is allowed, 257 is not
+	_, err := decoder.Decode([]byte{0x3f, 0xe1, 0x01})
+	assert.NoError(t, err)
+	_, err = decoder.Decode([]byte{0x3f, 0xe2, 0x01})
+	assert.ErrorIs(t, err, ErrCompressionError)
+
+	// several size updates may appear at the start of a block
+	_, err = decoder.Decode([]byte{0x20, 0x3f, 0xe1, 0x01, 0x82})
+	assert.NoError(t, err)
+}
+
+func FuzzDecoder(f *testing.F) {
+	seeds := []string{
+		"8286418aa0e41d139d09b8f01e07847a8825b650c3cbbab87f53032a2f2a",
+		"0f0d8469f0b2ef",
+		"828684410f7777772e6578616d706c652e636f6d",
+		"400a637573746f6d2d6b65790d637573746f6d2d686561646572",
+		"3fe11f82",
+		"ff8080808000",
+	}
+	for _, seed := range seeds {
+		bs, err := hex.DecodeString(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(bs)
+	}
+
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		decoder := Decoder()
+		headers, err := decoder.Decode(bs)
+
+		// feeding the block a byte at a time makes no difference
+		streamed, streamErr := writeAll(Decoder(), bs, 1)
+		assert.Equal(t, err, streamErr)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrCompressionError)
+			return
+		}
+		assert.Equal(t, headers, streamed)
+
+		// the dynamic table must stay usable after any successful block
+		_, err = decoder.Decode([]byte{0x82})
+		assert.NoError(t, err)
+	})
+}
+
+// writeAll feeds bs to decoder in fragments of at most n bytes.
+func writeAll(decoder *HPackDecoder, bs []byte, n int) ([]Header, error) {
+	headers := []Header{}
+	decoder.SetEmitFunc(func(header Header) {
+		headers = append(headers, header)
+	})
+	for len(bs) > 0 {
+		fragment := bs
+		if len(fragment) > n {
+			fragment = fragment[:n]
+		}
+		bs = bs[len(fragment):]
+		if _, err := decoder.Write(fragment); err != nil {
+			return nil, err
+		}
+	}
+	if err := decoder.Close(); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+func TestDecoderWriteFragments(t *testing.T) {
+	for _, example := range appendixCExamples {
+		var longest int
+		for _, step := range example.steps {
+			if n := len(dehex(t, step.wire)); n > longest {
+				longest = n
+			}
+		}
+
+		for n := 1; n <= longest; n++ {
+			decoder := Decoder()
+			decoder.SetMaxDynamicTableSize(example.tableSize)
+			for i, step := range example.steps {
+				headers, err := writeAll(decoder, dehex(t, step.wire), n)
+				require.NoError(t, err, "%s step %d in %d byte fragments", example.name, i+1, n)
+				assert.Equal(t, step.headers, headers, "%s step %d in %d byte fragments", example.name, i+1, n)
+			}
+		}
+	}
+}
+
+func TestDecoderWriteOwnership(t *testing.T) {
+	decoder := Decoder()
+	var headers []Header
+	decoder.SetEmitFunc(func(header Header) {
+		headers = append(headers, header)
+	})
+
+	// the split field must not keep referencing the caller's buffer
+	bs := dehex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572")
+	_, err := decoder.Write(bs[:5])
+	require.NoError(t, err)
+	for i := range bs[:5] {
+		bs[i] = 0
+	}
+	_, err = decoder.Write(bs[5:])
+	require.NoError(t, err)
+	require.NoError(t, decoder.Close())
+	assert.Equal(t, []Header{{Name: "custom-key", Value: "custom-header"}}, headers)
+}
+
+func TestDecoderCloseTruncated(t *testing.T) {
+	decoder := Decoder()
+	_, err := decoder.Write(dehex(t, "8286 4488"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, decoder.Close(), ErrCompressionError)
+
+	// the next block starts afresh
+	headers, err := decoder.Decode([]byte{0x82})
+	require.NoError(t, err)
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}}, headers)
+}
+
+func TestDecoderWriteHeaderListTooLarge(t *testing.T) {
+	decoder := Decoder()
+	decoder.SetMaxHeaderListSize(100)
+	var headers []Header
+	decoder.SetEmitFunc(func(header Header) {
+		headers = append(headers, header)
+	})
+
+	encoder := &HPackEncoder{}
+	block, err := encoder.Encode([]Header{
+		{Name: ":method", Value: "GET"},
+		{Name: "x-big", Value: strings.Repeat("a", 100)},
+		{Name: ":path", Value: "/"},
+		{Name: "x-sync", Value: "yes"},
+	})
+	require.NoError(t, err)
+
+	_, err = decoder.Write(block)
+	require.NoError(t, err)
+	// nothing is emitted once the limit is hit
+	assert.Equal(t, []Header{{Name: ":method", Value: "GET"}}, headers)
+	assert.ErrorIs(t, decoder.Close(), ErrHeaderListTooLarge)
+
+	// the rest of the block was still indexed
+	headers = nil
+	block, err = encoder.Encode([]Header{{Name: "x-sync", Value: "yes"}})
+	require.NoError(t, err)
+	_, err = decoder.Write(block)
+	require.NoError(t, err)
+	require.NoError(t, decoder.Close())
+	assert.Equal(t, []Header{{Name: "x-sync", Value: "yes"}}, headers)
+}
+
+func TestDecoderNameInterning(t *testing.T) {
+	// literal without indexing, with literal names
+	block := append(dehex(t, "000c 636f 6e74 656e 742d 7479 7065 0474 6578 74"),
+		dehex(t, "4006 782d 7379 6e63 0179 0006 782d 7379 6e63 016e")...)
+
+	allocs := func(intern bool) float64 {
+		decoder := Decoder()
+		decoder.SetNameInterning(intern)
+		decoder.SetEmitFunc(func(Header) {})
+		return testing.AllocsPerRun(100, func() {
+			decoder.Write(block)
+			decoder.Close()
+		})
+	}
+	// content-type from the static table and x-sync, found in the dynamic
+	// table after the first run, don't need their own strings
+	assert.Equal(t, allocs(false)-3, allocs(true))
+
+	decoder := Decoder()
+	decoder.SetNameInterning(true)
+	headers, err := decoder.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []Header{
+		{Name: "content-type", Value: "text"},
+		{Name: "x-sync", Value: "y"},
+		{Name: "x-sync", Value: "n"},
+	}, headers)
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	encoder := &HPackEncoder{}
+	block, err := encoder.Encode([]Header{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "user-agent", Value: "curl/8.7.1"},
+		{Name: "accept", Value: "*/*"},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	decoder := Decoder()
+	decoder.SetNameInterning(true)
+	decoder.SetEmitFunc(func(Header) {})
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		decoder.Write(block)
+		decoder.Close()
+	}
+}
@@ -2,49 +2,131 @@ package hpack
 
 import "bytes"
 
-type HPackEncoder struct{}
+// HPackEncoder compresses header lists for a single connection. The zero
+// value is ready to use with the default 4096 byte dynamic table.
+type HPackEncoder struct {
+	// DisableHuffman sends every string literal as-is instead of Huffman
+	// coding the ones that get shorter.
+	DisableHuffman bool
+
+	indexTable *indexTable
+
+	// minTableSize is the smallest table size set since the last header
+	// block, or -1 if no size update is pending.
+	minTableSize int
+	tableSize    int
+}
+
+func (h *HPackEncoder) table() *indexTable {
+	if h.indexTable == nil {
+		h.indexTable = NewIndexTable()
+		h.minTableSize = -1
+		h.tableSize = h.indexTable.maxSize
+	}
+	return h.indexTable
+}
+
+// SetMaxDynamicTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// table is never grown past the 4096 byte default. The change is signalled
+// to the decoder at the start of the next header block.
+func (h *HPackEncoder) SetMaxDynamicTableSize(size int) {
+	h.table()
+	if size > 4096 {
+		size = 4096
+	}
+	if size == h.tableSize && h.minTableSize < 0 {
+		return
+	}
+	if h.minTableSize < 0 || size < h.minTableSize {
+		h.minTableSize = size
+	}
+	h.tableSize = size
+	h.indexTable.UpdateMaxSize(size)
+}
+
+// DynamicTableSize returns the size of the entries in the dynamic table and
+// the size it may grow to, as counted by RFC 7541 §4.1.
+func (h *HPackEncoder) DynamicTableSize() (size, maxSize int) {
+	table := h.table()
+	return table.currentSize, table.maxSize
+}
 
 func encodeInt(headerByte byte, prefix, num int) []byte {
-	var buf bytes.Buffer
+	return AppendInt(nil, headerByte, prefix, num)
+}
 
-	curByte := headerByte
+// AppendInt appends num as a prefix integer (RFC 7541 §5.1). The first
+// byte carries flags in the bits above the low prefix bits.
+func AppendInt(dst []byte, flags byte, prefix, num int) []byte {
 	mask := (1 << prefix) - 1
 	if num < mask {
-		curByte |= byte(num)
-		buf.WriteByte(curByte)
-	} else {
-		curByte |= byte(mask)
-		num -= mask
-		buf.WriteByte(curByte)
-		var done bool
-		for !done {
-			curByte = byte(num & 0x7f)
-			num >>= 7
-			done = num == 0
-			if !done {
-				curByte |= 0x80
-			}
-			buf.WriteByte(curByte)
-		}
+		return append(dst, flags|byte(num))
+	}
+
+	dst = append(dst, flags|byte(mask))
+	num -= mask
+	for num >= 0x80 {
+		dst = append(dst, byte(num&0x7f)|0x80)
+		num >>= 7
 	}
-	return buf.Bytes()
+	return append(dst, byte(num))
 }
 
-func encodeStringLiteral(str string) []byte {
-	var buf bytes.Buffer
-	buf.Write(encodeInt(0, 7, len(str)))
-	buf.WriteString(str)
-	return buf.Bytes()
+// AppendString appends a string literal (RFC 7541 §5.2) with its length as
+// a prefix integer and the Huffman flag in the bit above the prefix. With
+// huffman set, Huffman coding is used unless it makes str longer.
+func AppendString(dst []byte, flags byte, prefix int, str string, huffman bool) []byte {
+	if huffman {
+		if n := HuffmanEncodeLength(str); n > 0 && n <= len(str) {
+			return HuffmanEncode(AppendInt(dst, flags|1<<prefix, prefix, n), str)
+		}
+	}
+	dst = AppendInt(dst, flags, prefix, len(str))
+	return append(dst, str...)
 }
 
 func (h *HPackEncoder) Encode(headers []Header) ([]byte, error) {
 	var buf bytes.Buffer
+	table := h.table()
+
+	if h.minTableSize >= 0 {
+		// the decoder must see the smallest size we went through so it
+		// evicts the same entries we did
+		if h.minTableSize < h.tableSize {
+			buf.Write(encodeInt(0x20, 5, h.minTableSize))
+		}
+		buf.Write(encodeInt(0x20, 5, h.tableSize))
+		h.minTableSize = -1
+	}
 
 	for _, header := range headers {
-		buf.WriteByte(0)
-		buf.Write(encodeStringLiteral(header.Name))
-		buf.Write(encodeStringLiteral(header.Value))
+		index, valueMatch := table.Search(header)
+		switch {
+		case header.neverIndexed:
+			h.encodeLiteral(&buf, 0x10, 4, index, header)
+		case valueMatch:
+			buf.Write(encodeInt(0x80, 7, index))
+		case header.Size() > table.maxSize:
+			h.encodeLiteral(&buf, 0, 4, index, header)
+		default:
+			h.encodeLiteral(&buf, 0x40, 6, index, header)
+			table.Add(header)
+		}
 	}
 
 	return buf.Bytes(), nil
 }
+
+// encodeLiteral writes a literal representation, referencing the name by
+// index when there is one.
+func (h *HPackEncoder) encodeLiteral(buf *bytes.Buffer, headerByte byte, prefix, nameIndex int, header Header) {
+	buf.Write(encodeInt(headerByte, prefix, nameIndex))
+	if nameIndex == 0 {
+		h.encodeString(buf, header.Name)
+	}
+	h.encodeString(buf, header.Value)
+}
+
+func (h *HPackEncoder) encodeString(buf *bytes.Buffer, str string) {
+	buf.Write(AppendString(nil, 0, 7, str, !h.DisableHuffman))
+}
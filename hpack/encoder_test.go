@@ -0,0 +1,151 @@
+package hpack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendStringHuffman(t *testing.T) {
+	// "www.example.com" is shorter Huffman coded, RFC 7541 C.4.1
+	assert.Equal(t, append([]byte{0x8c}, HuffmanEncode(nil, "www.example.com")...), AppendString(nil, 0, 7, "www.example.com", true))
+	// "{}" is not, as both are 15 bit codes
+	assert.Equal(t, []byte{0x02, '{', '}'}, AppendString(nil, 0, 7, "{}", true))
+	assert.Equal(t, []byte{0x00}, AppendString(nil, 0, 7, "", true))
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	headers := []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/search?q={}"},
+		{Name: "user-agent", Value: "curl/8.7.1"},
+		{Name: "x-binary", Value: "\x00\xff\x7f"},
+	}
+
+	block, err := (&HPackEncoder{}).Encode(headers)
+	require.NoError(t, err)
+	decoded, err := Decoder().Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, headers, decoded)
+}
+
+func TestEncoderIndexing(t *testing.T) {
+	encoder := &HPackEncoder{}
+	decoder := Decoder()
+	headers := []Header{
+		{Name: ":method", Value: "GET"},
+		{Name: "x-custom", Value: "value"},
+	}
+
+	first, err := encoder.Encode(headers)
+	require.NoError(t, err)
+	// :method GET is static, x-custom is added to the dynamic table
+	assert.Equal(t, byte(0x82), first[0])
+	assert.Equal(t, byte(0x40), first[1])
+
+	second, err := encoder.Encode(headers)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x82, 0x80 | 62}, second)
+
+	for _, block := range [][]byte{first, second} {
+		decoded, err := decoder.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, headers, decoded)
+	}
+}
+
+func TestEncoderNeverIndexed(t *testing.T) {
+	encoder := &HPackEncoder{}
+	header := Header{Name: "authorization", Value: "secret", neverIndexed: true}
+
+	for n := 0; n < 2; n++ {
+		block, err := encoder.Encode([]Header{header})
+		require.NoError(t, err)
+		// never indexed with the static name index 23
+		assert.Equal(t, byte(0x1f), block[0])
+		assert.Equal(t, byte(23-15), block[1])
+
+		decoded, err := Decoder().Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, []Header{header}, decoded)
+	}
+	assert.Equal(t, 0, encoder.indexTable.len)
+}
+
+func TestEncoderTableSizeUpdate(t *testing.T) {
+	encoder := &HPackEncoder{}
+	decoder := Decoder()
+	headers := []Header{{Name: "x-custom", Value: "value"}}
+
+	_, err := decoder.Decode(mustEncode(t, encoder, headers))
+	require.NoError(t, err)
+
+	// shrinking to 0 and back must be signalled with both sizes so the
+	// decoder evicts the entry too
+	encoder.SetMaxDynamicTableSize(0)
+	encoder.SetMaxDynamicTableSize(1024)
+	block := mustEncode(t, encoder, headers)
+	assert.Equal(t, []byte{0x20, 0x3f, 0xe1, 0x07, 0x40}, block[:5])
+	decoded, err := decoder.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Equal(t, 1024, decoder.indexTable.maxSize)
+	assert.Equal(t, 1, decoder.indexTable.len)
+	size, maxSize := decoder.DynamicTableSize()
+	assert.Equal(t, []int{headers[0].Size(), 1024}, []int{size, maxSize})
+	size, maxSize = encoder.DynamicTableSize()
+	assert.Equal(t, []int{headers[0].Size(), 1024}, []int{size, maxSize})
+
+	// no update once it has been sent
+	assert.Equal(t, []byte{0x80 | 62}, mustEncode(t, encoder, headers))
+
+	// larger than the default is capped, as the peer's decoder starts there
+	encoder.SetMaxDynamicTableSize(1 << 20)
+	block = mustEncode(t, encoder, headers)
+	assert.Equal(t, []byte{0x3f, 0xe1, 0x1f, 0x80 | 62}, block)
+}
+
+func mustEncode(t *testing.T, encoder *HPackEncoder, headers []Header) []byte {
+	t.Helper()
+	block, err := encoder.Encode(headers)
+	require.NoError(t, err)
+	return block
+}
+
+func TestIntRoundTrip(t *testing.T) {
+	for prefix := 1; prefix <= 8; prefix++ {
+		// flags go in the bits above the prefix
+		flags := byte(0xff << prefix)
+		for _, num := range []int{0, 1, 30, 31, 127, 128, 255, 1337, 1 << 20} {
+			bs := AppendInt([]byte{0xaa}, flags, prefix, num)
+			assert.Equal(t, byte(0xaa), bs[0])
+			assert.Equal(t, flags, bs[1]&flags)
+			n, rest, err := ReadInt(append(bs[1:], 0xff), prefix)
+			require.NoError(t, err)
+			assert.Equal(t, num, n, "prefix %d", prefix)
+			assert.Equal(t, []byte{0xff}, rest)
+		}
+	}
+
+	// RFC 7541 C.1.2
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, AppendInt(nil, 0, 5, 1337))
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for _, str := range []string{"", "custom-key", "{}", "www.example.com"} {
+		for _, huffman := range []bool{false, true} {
+			bs := AppendString(nil, 0x20, 3, str, huffman)
+			assert.Equal(t, byte(0x20), bs[0]&0xf0)
+			decoded, rest, err := ReadString(bs, 3)
+			require.NoError(t, err)
+			assert.Equal(t, str, decoded)
+			assert.Empty(t, rest)
+
+			if len(bs) > 1 {
+				_, _, err = ReadString(bs[:len(bs)-1], 3)
+				assert.ErrorIs(t, err, ErrTruncated)
+			}
+		}
+	}
+}
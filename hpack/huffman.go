@@ -1,97 +1,162 @@
 package hpack
 
 import (
-	"bytes"
 	"fmt"
 )
 
-var huffmanTree *HuffmanTreeNode
+// The Huffman decoder walks a state machine a nibble at a time, in the
+// style of nghttp2. Each state is an internal node of the Huffman tree,
+// identified by its index; the root is state 0. Since the shortest code is
+// 5 bits long, a nibble emits at most one symbol.
+const (
+	huffmanEmit   = 1 << iota // the transition completes sym
+	huffmanFail               // the transition decodes EOS
+	huffmanAccept             // the target state may end the string
+)
+
+type huffmanTransition struct {
+	next  uint8
+	sym   byte
+	flags uint8
+}
+
+var huffmanDecodeTable [256][16]huffmanTransition
 
 func init() {
-	huffmanTree = genHuffmanTree()
+	genHuffmanDecodeTable()
 }
 
 func HuffmanDecoder(bs []byte) (string, error) {
-	var buf bytes.Buffer
-
-	offset := 0
-	curDepth := 0
-	node := huffmanTree
-	for offset < len(bs) {
-		char := bs[offset]
-		for curBit := 7; curBit >= 0; curBit-- {
-			right := ((char >> curBit) & 1) == 1
-			if right {
-				node = node.right
-			} else {
-				node = node.left
-			}
-			curDepth++
-
-			if node.value != nil {
-				if *node.value == eosByte {
-					return "", fmt.Errorf("7 bit padding exceeded, found EOS")
-				}
-				buf.WriteByte(byte(*node.value))
-				node = huffmanTree
-				curDepth = 0
-			}
-		}
-		offset++
+	// small strings are decoded on the stack, only the result is allocated
+	buf, err := huffmanDecode(make([]byte, 0, 64), bs)
+	if err != nil {
+		return "", err
 	}
+	return string(buf), nil
+}
 
-	if node != huffmanTree {
-		if curDepth > 7 {
-			return "", fmt.Errorf("incomplete encoding")
+// huffmanDecode appends the decoding of bs to dst.
+func huffmanDecode(dst, bs []byte) ([]byte, error) {
+	state := uint8(0)
+	flags := uint8(huffmanAccept)
+	for _, b := range bs {
+		t := huffmanDecodeTable[state][b>>4]
+		if t.flags&huffmanFail != 0 {
+			return nil, fmt.Errorf("7 bit padding exceeded, found EOS")
 		}
-
-		for node.right != nil {
-			node = node.right
+		if t.flags&huffmanEmit != 0 {
+			dst = append(dst, t.sym)
 		}
 
-		if node.value == nil || *node.value != 256 {
-			return "", fmt.Errorf("incomplete encoding")
+		t = huffmanDecodeTable[t.next][b&0xf]
+		if t.flags&huffmanFail != 0 {
+			return nil, fmt.Errorf("7 bit padding exceeded, found EOS")
 		}
+		if t.flags&huffmanEmit != 0 {
+			dst = append(dst, t.sym)
+		}
+		state, flags = t.next, t.flags
+	}
+
+	// anything left over must be at most 7 bits of padding, taken from
+	// the most significant bits of EOS (all ones)
+	if flags&huffmanAccept == 0 {
+		return nil, fmt.Errorf("incomplete encoding")
 	}
 
-	return buf.String(), nil
+	return dst, nil
 }
 
-type HuffmanTreeNode struct {
-	left  *HuffmanTreeNode
-	right *HuffmanTreeNode
-	value *int
+// HuffmanEncodeLength returns the number of bytes HuffmanEncode produces
+// for s, letting callers pick between Huffman and plain string literals.
+func HuffmanEncodeLength(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		n += huffmanCodings[s[i]].n
+	}
+	return (n + 7) / 8
 }
 
-func intptr(i int) *int {
-	return &i
+// HuffmanEncode appends the Huffman encoding of s to dst, padding the last
+// byte with the most significant bits of EOS, and returns the result.
+func HuffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	var nbits int
+	for i := 0; i < len(s); i++ {
+		code := huffmanCodings[s[i]]
+		acc = acc<<code.n | uint64(code.bits)
+		nbits += code.n
+		for nbits >= 8 {
+			nbits -= 8
+			dst = append(dst, byte(acc>>nbits))
+		}
+	}
+	if nbits > 0 {
+		pad := 8 - nbits
+		dst = append(dst, byte(acc<<pad)|byte(1<<pad-1))
+	}
+	return dst
 }
 
-func genHuffmanTree() *HuffmanTreeNode {
-	root := &HuffmanTreeNode{}
+// huffmanNode is an internal node of the Huffman tree while generating the
+// decode table. A child is either another internal node or a leaf symbol.
+type huffmanNode struct {
+	children [2]int // index of an internal node, or -1 - symbol for leaves
+	// padding is set if the node can end a string: it is at most 7 bits
+	// deep along the all-ones path from the root.
+	padding bool
+}
 
-	for char, enc := range huffmanCodings {
-		bits := enc.bits
+func genHuffmanDecodeTable() {
+	nodes := []huffmanNode{{children: [2]int{0, 0}, padding: true}}
 
-		current := root
-		for i := 0; i < enc.n; i++ {
-			right := ((bits >> (enc.n - i - 1)) & 1) == 1
+	for sym, enc := range huffmanCodings {
+		current := 0
+		for i := enc.n - 1; i >= 0; i-- {
+			bit := (enc.bits >> i) & 1
+			if i == 0 {
+				nodes[current].children[bit] = -1 - sym
+				break
+			}
+			if nodes[current].children[bit] == 0 {
+				depth := enc.n - i
+				nodes = append(nodes, huffmanNode{
+					padding: nodes[current].padding && bit == 1 && depth <= 7,
+				})
+				nodes[current].children[bit] = len(nodes) - 1
+			}
+			current = nodes[current].children[bit]
+		}
+	}
+
+	if len(nodes) != len(huffmanDecodeTable) {
+		panic("hpack: huffman code does not form a complete tree")
+	}
 
-			if right {
-				if current.right == nil {
-					current.right = &HuffmanTreeNode{}
+	for state := range nodes {
+		for nibble := 0; nibble < 16; nibble++ {
+			var t huffmanTransition
+			current := state
+			for i := 3; i >= 0; i-- {
+				child := nodes[current].children[(nibble>>i)&1]
+				if child >= 0 {
+					current = child
+					continue
 				}
-				current = current.right
-			} else {
-				if current.left == nil {
-					current.left = &HuffmanTreeNode{}
+				sym := -1 - child
+				if sym == eosByte {
+					t.flags |= huffmanFail
+					break
 				}
-				current = current.left
+				t.flags |= huffmanEmit
+				t.sym = byte(sym)
+				current = 0
+			}
+			t.next = uint8(current)
+			if nodes[current].padding {
+				t.flags |= huffmanAccept
 			}
+			huffmanDecodeTable[state][nibble] = t
 		}
-		// avoid go for-loop weirdness
-		current.value = intptr(char)
 	}
-
-	return root
 }
@@ -0,0 +1,235 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Huffman encoded strings taken from RFC 7541 Appendix C.4 and C.6 and from
+// requests made by curl.
+var huffmanStrings = []struct {
+	inhex string
+	out   string
+}{
+	{"f1e3c2e5f23a6ba0ab90f4ff", "www.example.com"},
+	{"a8eb10649cbf", "no-cache"},
+	{"25a849e95ba97d7f", "custom-key"},
+	{"25a849e95bb8e8b4bf", "custom-value"},
+	{"6402", "302"},
+	{"aec3771a4b", "private"},
+	{"d07abe941054d444a8200595040b8166e082a62d1bff", "Mon, 21 Oct 2013 20:13:21 GMT"},
+	{"9d29ad171863c78f0b97c8e9ae82ae43d3", "https://www.example.com"},
+	{"640eff", "307"},
+	{"9bd9ab", "gzip"},
+	{"94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	{"a0e41d139d09b8f01e07", "localhost:8080"},
+	{"25b650c3cbbab87f", "curl/8.7.1"},
+	{"1d75d0620d263d4c795bc78f0b4a7b295adb282d443c8593", "application/x-www-form-urlencoded"},
+}
+
+func TestHuffmanDecoder(t *testing.T) {
+	for _, tt := range huffmanStrings {
+		bs, err := hex.DecodeString(tt.inhex)
+		require.NoError(t, err)
+		str, err := HuffmanDecoder(bs)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.out, str)
+	}
+}
+
+func TestHuffmanDecoderPadding(t *testing.T) {
+	tests := []struct {
+		inhex     string
+		expectErr bool
+	}{
+		{"", false},
+		// "a" (00011) padded with 3 ones
+		{"1f", false},
+		// "a" padded with zeros
+		{"18", true},
+		// "a" padded with 11 ones
+		{"1fff", true},
+		// "00a" followed by 8 bits of padding
+		{"0007ff", true},
+		// "0a" padded with 6 ones
+		{"00ff", false},
+		// EOS
+		{"fffffffc", true},
+		// EOS after a symbol
+		{"1ffffffff0", true},
+	}
+
+	for _, tt := range tests {
+		bs, err := hex.DecodeString(tt.inhex)
+		require.NoError(t, err)
+		_, err = HuffmanDecoder(bs)
+		if tt.expectErr {
+			assert.Error(t, err, tt.inhex)
+		} else {
+			assert.NoError(t, err, tt.inhex)
+		}
+	}
+}
+
+func TestHuffmanDecoderMatchesTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		bs := make([]byte, rnd.Intn(16))
+		rnd.Read(bs)
+		if rnd.Intn(2) == 0 {
+			// make valid-looking padding more likely
+			bs = append(bs, 0xff)
+		}
+
+		want, wantErr := treeHuffmanDecode(bs)
+		got, gotErr := HuffmanDecoder(bs)
+		assert.Equal(t, wantErr != nil, gotErr != nil, "%x", bs)
+		assert.Equal(t, want, got, "%x", bs)
+	}
+}
+
+func TestHuffmanEncode(t *testing.T) {
+	for _, tt := range huffmanStrings {
+		assert.Equal(t, tt.inhex, hex.EncodeToString(HuffmanEncode(nil, tt.out)))
+		assert.Equal(t, len(tt.inhex)/2, HuffmanEncodeLength(tt.out))
+	}
+
+	// appends to dst
+	assert.Equal(t, []byte{0x82}, HuffmanEncode([]byte{0x82}, ""))
+	assert.Equal(t, []byte{0x82, 0x64, 0x02}, HuffmanEncode([]byte{0x82}, "302"))
+}
+
+func TestHuffmanRoundTrip(t *testing.T) {
+	roundTrip := func(s string) bool {
+		enc := HuffmanEncode(nil, s)
+		if len(enc) != HuffmanEncodeLength(s) {
+			return false
+		}
+		dec, err := HuffmanDecoder(enc)
+		return err == nil && dec == s
+	}
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	assert.True(t, roundTrip(string(all)))
+
+	assert.NoError(t, quick.Check(roundTrip, nil))
+
+	// arbitrary bytes rather than the valid UTF-8 quick generates
+	assert.NoError(t, quick.Check(func(bs []byte) bool {
+		return roundTrip(string(bs))
+	}, nil))
+}
+
+func BenchmarkHuffmanDecoder(b *testing.B) {
+	benchmarkHuffman(b, HuffmanDecoder)
+}
+
+func BenchmarkHuffmanDecoderTree(b *testing.B) {
+	benchmarkHuffman(b, treeHuffmanDecode)
+}
+
+func benchmarkHuffman(b *testing.B, decode func([]byte) (string, error)) {
+	var inputs [][]byte
+	size := 0
+	for _, tt := range huffmanStrings {
+		bs, err := hex.DecodeString(tt.inhex)
+		if err != nil {
+			b.Fatal(err)
+		}
+		inputs = append(inputs, bs)
+		size += len(bs)
+	}
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, bs := range inputs {
+			if _, err := decode(bs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// treeHuffmanDecode is the original bit-at-a-time tree walking decoder,
+// kept as a reference for the table driven one.
+func treeHuffmanDecode(bs []byte) (string, error) {
+	var buf []byte
+
+	curDepth := 0
+	node := huffmanTree
+	for _, char := range bs {
+		for curBit := 7; curBit >= 0; curBit-- {
+			if ((char >> curBit) & 1) == 1 {
+				node = node.right
+			} else {
+				node = node.left
+			}
+			curDepth++
+
+			if node.value >= 0 {
+				if node.value == eosByte {
+					return "", fmt.Errorf("7 bit padding exceeded, found EOS")
+				}
+				buf = append(buf, byte(node.value))
+				node = huffmanTree
+				curDepth = 0
+			}
+		}
+	}
+
+	if node != huffmanTree {
+		if curDepth > 7 {
+			return "", fmt.Errorf("incomplete encoding")
+		}
+
+		for node.right != nil {
+			node = node.right
+		}
+
+		if node.value != eosByte {
+			return "", fmt.Errorf("incomplete encoding")
+		}
+	}
+
+	return string(buf), nil
+}
+
+type huffmanTreeNode struct {
+	left  *huffmanTreeNode
+	right *huffmanTreeNode
+	value int
+}
+
+var huffmanTree = genHuffmanTree()
+
+func genHuffmanTree() *huffmanTreeNode {
+	root := &huffmanTreeNode{value: -1}
+
+	for char, enc := range huffmanCodings {
+		current := root
+		for i := enc.n - 1; i >= 0; i-- {
+			next := &current.left
+			if (enc.bits>>i)&1 == 1 {
+				next = &current.right
+			}
+			if *next == nil {
+				*next = &huffmanTreeNode{value: -1}
+			}
+			current = *next
+		}
+		current.value = char
+	}
+
+	return root
+}
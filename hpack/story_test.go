@@ -0,0 +1,99 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Stories use the hpack-test-case format
+// (https://github.com/http2jp/hpack-test-case): a sequence of header blocks
+// from one connection, each with its wire encoding. Vectors from other
+// implementations can be dropped into testdata/stories/<name>/*.json.
+type story struct {
+	Description string      `json:"description"`
+	Cases       []storyCase `json:"cases"`
+}
+
+type storyCase struct {
+	Seqno           int                 `json:"seqno"`
+	HeaderTableSize int                 `json:"header_table_size"`
+	Wire            string              `json:"wire"`
+	Headers         []map[string]string `json:"headers"`
+}
+
+func loadStory(path string) (*story, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s story
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// headers converts the story's single-entry objects to a header list.
+func (c storyCase) headers() ([]Header, error) {
+	headers := make([]Header, 0, len(c.Headers))
+	for _, field := range c.Headers {
+		if len(field) != 1 {
+			return nil, fmt.Errorf("seqno %d: header object with %d fields", c.Seqno, len(field))
+		}
+		for name, value := range field {
+			headers = append(headers, Header{Name: name, Value: value})
+		}
+	}
+	return headers, nil
+}
+
+func TestStories(t *testing.T) {
+	paths, err := filepath.Glob("testdata/stories/*/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		s, err := loadStory(path)
+		require.NoError(t, err)
+
+		t.Run(path, func(t *testing.T) {
+			decoder := Decoder()
+			encoder := &HPackEncoder{}
+			roundTrip := Decoder()
+			tableSize := 4096
+
+			for _, c := range s.Cases {
+				want, err := c.headers()
+				require.NoError(t, err)
+
+				if c.HeaderTableSize != 0 && c.HeaderTableSize != tableSize {
+					tableSize = c.HeaderTableSize
+					decoder.SetMaxDynamicTableSize(tableSize)
+					encoder.SetMaxDynamicTableSize(tableSize)
+					roundTrip.SetMaxDynamicTableSize(tableSize)
+				}
+
+				if c.Wire != "" {
+					wire, err := hex.DecodeString(c.Wire)
+					require.NoError(t, err, "seqno %d", c.Seqno)
+					headers, err := decoder.Decode(wire)
+					require.NoError(t, err, "seqno %d", c.Seqno)
+					assert.Equal(t, want, headers, "seqno %d", c.Seqno)
+				}
+
+				block, err := encoder.Encode(want)
+				require.NoError(t, err, "seqno %d", c.Seqno)
+				headers, err := roundTrip.Decode(block)
+				require.NoError(t, err, "seqno %d", c.Seqno)
+				assert.Equal(t, want, headers, "seqno %d: round trip", c.Seqno)
+			}
+		})
+	}
+}
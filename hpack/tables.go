@@ -18,6 +18,20 @@ func NewHeader(name, value string) Header {
 	}
 }
 
+// NewSensitiveHeader returns a header that is never added to a compression
+// table, not even by intermediaries (RFC 7541 §7.1.3), e.g. for short
+// secrets that could otherwise be guessed.
+func NewSensitiveHeader(name, value string) Header {
+	header := NewHeader(name, value)
+	header.neverIndexed = true
+	return header
+}
+
+// Sensitive reports whether the header must never be indexed.
+func (h Header) Sensitive() bool {
+	return h.neverIndexed
+}
+
 func (h Header) Size() int {
 	return len(h.Name) + len(h.Value) + 32
 }
@@ -87,17 +101,51 @@ var staticTable = [...]Header{
 	{Name: "www-authenticate"},
 }
 
+// headerField is a name/value pair used to look up table entries.
+type headerField struct {
+	name, value string
+}
+
+var (
+	staticFieldIndex = map[headerField]int{}
+	staticNameIndex  = map[string]int{}
+)
+
+func init() {
+	for i := len(staticTable) - 1; i > 0; i-- {
+		header := staticTable[i]
+		staticFieldIndex[headerField{header.Name, header.Value}] = i
+		staticNameIndex[header.Name] = i
+	}
+}
+
+// indexTable is the combined static and dynamic table. The dynamic table is
+// a ring buffer so insertion and eviction are constant time, and entries are
+// indexed by name and by name/value pair for the encoder.
+//
+// Entries are identified by their insertion sequence number: the newest
+// entry has sequence inserted-1 and HPACK index len(staticTable), older
+// entries follow.
 type indexTable struct {
-	dynamicTable []Header
-	currentSize  int
-	maxSize      int
+	ring  []Header
+	first int // ring position of the oldest entry
+	len   int
+
+	currentSize int
+	maxSize     int
+
+	inserted   int
+	fieldIndex map[headerField]int
+	nameIndex  map[string]int
 }
 
 func NewIndexTable() *indexTable {
 	return &indexTable{
-		dynamicTable: make([]Header, 0),
-		currentSize:  0,
-		maxSize:      4096,
+		ring:        make([]Header, 16),
+		currentSize: 0,
+		maxSize:     4096,
+		fieldIndex:  map[headerField]int{},
+		nameIndex:   map[string]int{},
 	}
 }
 
@@ -112,29 +160,96 @@ func (i *indexTable) Get(index int) (Header, error) {
 		return staticTable[index], nil
 	}
 	index -= len(staticTable)
-	if index < len(i.dynamicTable) {
-		return i.dynamicTable[index], nil
+	if index < i.len {
+		return i.ring[(i.first+i.len-1-index)%len(i.ring)], nil
 	}
 
 	return Header{}, ErrIndexingTable
 }
 
+// Search looks header up in the static table, then the dynamic table. It
+// returns the index of an entry matching both name and value if there is
+// one, otherwise the index of an entry matching only the name, or 0.
+func (i *indexTable) Search(header Header) (index int, valueMatch bool) {
+	field := headerField{header.Name, header.Value}
+	if index, ok := staticFieldIndex[field]; ok {
+		return index, true
+	}
+	if seq, ok := i.fieldIndex[field]; ok {
+		return i.seqIndex(seq), true
+	}
+	if index, ok := staticNameIndex[header.Name]; ok {
+		return index, false
+	}
+	if seq, ok := i.nameIndex[header.Name]; ok {
+		return i.seqIndex(seq), false
+	}
+	return 0, false
+}
+
+func (i *indexTable) seqIndex(seq int) int {
+	return len(staticTable) + i.inserted - 1 - seq
+}
+
 func (i *indexTable) UpdateMaxSize(size int) {
 	i.maxSize = size
 	i.reduce()
 }
 
+// Add inserts header as the newest entry, evicting old entries to make
+// room. An entry larger than the whole table empties it and is not added.
 func (i *indexTable) Add(header Header) {
-	i.dynamicTable = append([]Header{header}, i.dynamicTable...)
+	header.neverIndexed = false
+	if header.Size() > i.maxSize {
+		for i.len > 0 {
+			i.evict()
+		}
+		return
+	}
+
 	i.currentSize += header.Size()
 	i.reduce()
+
+	if i.len == len(i.ring) {
+		ring := make([]Header, 2*len(i.ring))
+		for n := 0; n < i.len; n++ {
+			ring[n] = i.ring[(i.first+n)%len(i.ring)]
+		}
+		i.ring = ring
+		i.first = 0
+	}
+	i.ring[(i.first+i.len)%len(i.ring)] = header
+	i.len++
+
+	seq := i.inserted
+	i.inserted++
+	i.fieldIndex[headerField{header.Name, header.Value}] = seq
+	i.nameIndex[header.Name] = seq
 }
 
+// reduce evicts entries until the table fits in maxSize, counting any
+// entry about to be added in currentSize.
 func (i *indexTable) reduce() {
-	for i.currentSize > i.maxSize {
-		header := i.dynamicTable[len(i.dynamicTable)-1]
-		i.dynamicTable = i.dynamicTable[:len(i.dynamicTable)-1]
-		i.currentSize -= header.Size()
+	for i.currentSize > i.maxSize && i.len > 0 {
+		i.evict()
+	}
+}
+
+func (i *indexTable) evict() {
+	header := i.ring[i.first]
+	i.ring[i.first] = Header{}
+	seq := i.inserted - i.len
+	i.first = (i.first + 1) % len(i.ring)
+	i.len--
+	i.currentSize -= header.Size()
+
+	// a newer entry may have taken over the index
+	field := headerField{header.Name, header.Value}
+	if i.fieldIndex[field] == seq {
+		delete(i.fieldIndex, field)
+	}
+	if i.nameIndex[header.Name] == seq {
+		delete(i.nameIndex, header.Name)
 	}
 }
 
@@ -0,0 +1,127 @@
+package hpack
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexTableRing(t *testing.T) {
+	table := NewIndexTable()
+
+	// more entries than the initial ring, with each one 32+1+3 bytes
+	for n := 0; n < 100; n++ {
+		table.Add(Header{Name: "a", Value: fmt.Sprintf("%03d", n)})
+	}
+	assert.Equal(t, 100, table.len)
+	assert.Equal(t, 3600, table.currentSize)
+
+	for n := 0; n < 100; n++ {
+		header, err := table.Get(len(staticTable) + n)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%03d", 99-n), header.Value)
+	}
+	_, err := table.Get(len(staticTable) + 100)
+	assert.ErrorIs(t, err, ErrIndexingTable)
+
+	// shrinking evicts the oldest entries first
+	table.UpdateMaxSize(360)
+	assert.Equal(t, 10, table.len)
+	header, err := table.Get(len(staticTable) + 9)
+	require.NoError(t, err)
+	assert.Equal(t, "090", header.Value)
+
+	// and the ring keeps wrapping around after evictions
+	for n := 100; n < 150; n++ {
+		table.Add(Header{Name: "a", Value: fmt.Sprintf("%03d", n)})
+	}
+	assert.Equal(t, 10, table.len)
+	assert.Equal(t, 360, table.currentSize)
+	header, err = table.Get(len(staticTable))
+	require.NoError(t, err)
+	assert.Equal(t, "149", header.Value)
+}
+
+func TestIndexTableOversizedEntry(t *testing.T) {
+	table := NewIndexTable()
+	table.UpdateMaxSize(64)
+	table.Add(Header{Name: "a", Value: "b"})
+	require.Equal(t, 1, table.len)
+
+	table.Add(Header{Name: "a", Value: string(make([]byte, 64))})
+	assert.Equal(t, 0, table.len)
+	assert.Equal(t, 0, table.currentSize)
+	_, valueMatch := table.Search(Header{Name: "a", Value: "b"})
+	assert.False(t, valueMatch)
+
+	// an entry of exactly the table size fits
+	table.Add(Header{Name: "a", Value: string(make([]byte, 31))})
+	assert.Equal(t, 1, table.len)
+	assert.Equal(t, 64, table.currentSize)
+}
+
+func TestIndexTableSearch(t *testing.T) {
+	table := NewIndexTable()
+
+	tests := []struct {
+		header     Header
+		index      int
+		valueMatch bool
+	}{
+		{Header{Name: ":method", Value: "GET"}, 2, true},
+		{Header{Name: ":method", Value: "PUT"}, 2, false},
+		{Header{Name: "x-custom", Value: "1"}, 0, false},
+	}
+	for _, test := range tests {
+		index, valueMatch := table.Search(test.header)
+		assert.Equal(t, test.index, index, test.header)
+		assert.Equal(t, test.valueMatch, valueMatch, test.header)
+	}
+
+	table.Add(Header{Name: "x-custom", Value: "1"})
+	table.Add(Header{Name: "x-custom", Value: "2"})
+	table.Add(Header{Name: ":method", Value: "PUT"})
+
+	tests = []struct {
+		header     Header
+		index      int
+		valueMatch bool
+	}{
+		// the static table wins on a full match
+		{Header{Name: ":method", Value: "GET"}, 2, true},
+		{Header{Name: ":method", Value: "PUT"}, 62, true},
+		{Header{Name: "x-custom", Value: "1"}, 64, true},
+		{Header{Name: "x-custom", Value: "2"}, 63, true},
+		// the newest entry for a name
+		{Header{Name: "x-custom", Value: "3"}, 63, false},
+	}
+	for _, test := range tests {
+		index, valueMatch := table.Search(test.header)
+		assert.Equal(t, test.index, index, test.header)
+		assert.Equal(t, test.valueMatch, valueMatch, test.header)
+	}
+
+	// evicting an entry keeps index entries that a newer one took over
+	table.Add(Header{Name: "x-custom", Value: "1"})
+	table.UpdateMaxSize(2 * 42)
+	index, valueMatch := table.Search(Header{Name: "x-custom", Value: "1"})
+	assert.Equal(t, 62, index)
+	assert.True(t, valueMatch)
+	index, valueMatch = table.Search(Header{Name: "x-custom", Value: "2"})
+	assert.Equal(t, 62, index)
+	assert.False(t, valueMatch)
+}
+
+func BenchmarkIndexTableAdd(b *testing.B) {
+	table := NewIndexTable()
+	headers := make([]Header, 64)
+	for n := range headers {
+		headers[n] = Header{Name: "x-header", Value: fmt.Sprintf("value-%d", n)}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		table.Add(headers[n%len(headers)])
+	}
+}
@@ -0,0 +1,180 @@
+package http11
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMalformedChunk = errors.New("malformed chunked encoding")
+
+	errLineTooLong = errors.New("line too long")
+)
+
+// maxChunkLineLength bounds a chunk-size line including any extensions.
+const maxChunkLineLength = 4096
+
+// chunkedReader decodes a chunked body (RFC 9112 §7.1). Trailer fields are
+// stored in trailers once the last chunk has been read.
+type chunkedReader struct {
+	r *bufio.Reader
+	// n is what is left of the current chunk.
+	n        int64
+	trailers map[string]string
+	err      error
+}
+
+func newChunkedReader(r *bufio.Reader, trailers map[string]string) *chunkedReader {
+	return &chunkedReader{r: r, trailers: trailers}
+}
+
+func (c *chunkedReader) Read(bs []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.n == 0 {
+		c.err = c.nextChunk()
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	if int64(len(bs)) > c.n {
+		bs = bs[:c.n]
+	}
+	n, err := c.r.Read(bs)
+	c.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.n == 0 {
+		err = c.chunkEnd()
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk reads a chunk-size line, or the trailer section after the last
+// chunk in which case it returns io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	line, err := readChunkLine(c.r)
+	if err != nil {
+		return err
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		// chunk extensions are ignored
+		line = line[:i]
+	}
+	line = strings.TrimRight(line, " \t")
+	if line == "" || len(line) > 15 {
+		return ErrMalformedChunk
+	}
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil || size < 0 {
+		return ErrMalformedChunk
+	}
+
+	if size == 0 {
+		if err := readTrailers(c.r, c.trailers); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	c.n = size
+	return nil
+}
+
+// chunkEnd reads the line break ending a chunk's data.
+func (c *chunkedReader) chunkEnd() error {
+	line, err := readChunkLine(c.r)
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return ErrMalformedChunk
+	}
+	return nil
+}
+
+func readTrailers(r *bufio.Reader, trailers map[string]string) error {
+	size := 0
+	for {
+		line, err := readChunkLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		size += len(line)
+		if size > maxChunkLineLength {
+			return ErrMalformedChunk
+		}
+
+		name, value, err := parseHeaderField(line)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrMalformedChunk, err)
+		}
+		if trailers == nil {
+			continue
+		}
+		if err := addHeader(trailers, name, value); err != nil {
+			return fmt.Errorf("%w: %s", ErrMalformedChunk, err)
+		}
+	}
+}
+
+func readChunkLine(r *bufio.Reader) (string, error) {
+	line, err := readLine(r, maxChunkLineLength)
+	if err == errLineTooLong {
+		return "", ErrMalformedChunk
+	}
+	return line, err
+}
+
+// ChunkedWriter writes a body with chunked encoding. Each Write becomes a
+// chunk; Close writes the last chunk followed by Trailers.
+type ChunkedWriter struct {
+	w io.Writer
+
+	Trailers map[string]string
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{w: w}
+}
+
+func (c *ChunkedWriter) Write(bs []byte) (int, error) {
+	// an empty chunk would end the body
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(c.w, "%x\r\n", len(bs)); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(bs)
+	if err != nil {
+		return n, err
+	}
+	if _, err := io.WriteString(c.w, "\r\n"); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (c *ChunkedWriter) Close() error {
+	if _, err := io.WriteString(c.w, "0\r\n"); err != nil {
+		return err
+	}
+	for name, value := range c.Trailers {
+		if _, err := fmt.Fprintf(c.w, "%s: %s\r\n", name, value); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(c.w, "\r\n")
+	return err
+}
@@ -0,0 +1,130 @@
+package http11
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		body     string
+		trailers map[string]string
+		err      error
+	}{
+		{
+			name:     "chunks",
+			input:    "5\r\nhello\r\n7\r\n, world\r\n0\r\n\r\n",
+			body:     "hello, world",
+			trailers: map[string]string{},
+		},
+		{
+			name:     "extensions and bare LF",
+			input:    "5;name=value\nhello\n0;last\n\n",
+			body:     "hello",
+			trailers: map[string]string{},
+		},
+		{
+			name:     "upper case hex",
+			input:    "A\r\n0123456789\r\n0\r\n\r\n",
+			body:     "0123456789",
+			trailers: map[string]string{},
+		},
+		{
+			name:     "trailers",
+			input:    "3\r\nabc\r\n0\r\nX-Checksum: 123\r\nExpires: never\r\n\r\n",
+			body:     "abc",
+			trailers: map[string]string{"x-checksum": "123", "expires": "never"},
+		},
+		{
+			name:  "bad size",
+			input: "zz\r\nabc\r\n0\r\n\r\n",
+			err:   ErrMalformedChunk,
+		},
+		{
+			name:  "negative size",
+			input: "-1\r\nabc\r\n0\r\n\r\n",
+			err:   ErrMalformedChunk,
+		},
+		{
+			name:  "overflowing size",
+			input: "10000000000000000\r\nabc\r\n",
+			err:   ErrMalformedChunk,
+		},
+		{
+			name:  "missing chunk end",
+			input: "3\r\nabcd\r\n0\r\n\r\n",
+			body:  "abc",
+			err:   ErrMalformedChunk,
+		},
+		{
+			name:  "bad trailer",
+			input: "0\r\nnonsense\r\n\r\n",
+			err:   ErrMalformedChunk,
+		},
+		{
+			name:  "truncated data",
+			input: "5\r\nhel",
+			body:  "hel",
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "missing last chunk",
+			input: "5\r\nhello\r\n",
+			body:  "hello",
+			err:   io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trailers := map[string]string{}
+			r := newChunkedReader(bufio.NewReader(strings.NewReader(tt.input)), trailers)
+			body, err := io.ReadAll(r)
+			assert.Equal(t, tt.body, string(body))
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.trailers, trailers)
+		})
+	}
+}
+
+func TestChunkedReaderLeavesRest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("3\r\nabc\r\n0\r\n\r\nGET / HTTP/1.1\r\n"))
+	body, err := io.ReadAll(newChunkedReader(r, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+}
+
+func TestChunkedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf)
+
+	io.WriteString(w, "hello")
+	io.WriteString(w, "")
+	io.WriteString(w, strings.Repeat("a", 20))
+	w.Trailers = map[string]string{"x-checksum": "123"}
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, "5\r\nhello\r\n14\r\n"+strings.Repeat("a", 20)+"\r\n0\r\nx-checksum: 123\r\n\r\n", buf.String())
+
+	trailers := map[string]string{}
+	body, err := io.ReadAll(newChunkedReader(bufio.NewReader(&buf), trailers))
+	require.NoError(t, err)
+	assert.Equal(t, "hello"+strings.Repeat("a", 20), string(body))
+	assert.Equal(t, map[string]string{"x-checksum": "123"}, trailers)
+}
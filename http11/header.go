@@ -0,0 +1,181 @@
+package http11
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// lineReader reads the start line and header section of a message,
+// bounding both the length of each line and their total size.
+type lineReader struct {
+	r *bufio.Reader
+	// remaining is what is left of the header section's budget.
+	remaining int
+	maxLine   int
+}
+
+func newLineReader(r *bufio.Reader, limits Limits) *lineReader {
+	l := &lineReader{r: r, remaining: limits.MaxHeaderBytes, maxLine: limits.MaxLineLength}
+	if l.remaining <= 0 {
+		l.remaining = maxInt
+	}
+	if l.maxLine <= 0 {
+		l.maxLine = maxInt
+	}
+	return l
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// readLine returns errLineTooLong for a line longer than maxLine, and
+// ErrHeaderTooLarge once the header section exceeds its budget.
+func (l *lineReader) readLine() (string, error) {
+	max := l.maxLine
+	if l.remaining < max {
+		max = l.remaining
+	}
+	line, err := readLine(l.r, max)
+	if err == errLineTooLong && max == l.remaining {
+		return "", ErrHeaderTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	l.remaining -= len(line) + 2
+	if l.remaining < 0 {
+		return "", ErrHeaderTooLarge
+	}
+	return line, nil
+}
+
+// readLine reads a line of at most max bytes, without its CRLF or LF.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		fragment, isPrefix, err := r.ReadLine()
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		line = append(line, fragment...)
+		if len(line) > max {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// readHeaderFields reads header fields up to the empty line ending the
+// section, adding them to headers with lower case names.
+func (l *lineReader) readHeaderFields(headers map[string]string) error {
+	for {
+		line, err := l.readLine()
+		if err == errLineTooLong {
+			return ErrHeaderTooLarge
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+
+		name, value, err := parseHeaderField(line)
+		if err != nil {
+			return err
+		}
+		if err := addHeader(headers, name, value); err != nil {
+			return err
+		}
+	}
+}
+
+// parseHeaderField splits a field line (RFC 9112 §5) into its lower cased
+// name and its value without surrounding whitespace.
+func parseHeaderField(line string) (string, string, error) {
+	if line[0] == ' ' || line[0] == '\t' {
+		return "", "", fmt.Errorf("obsolete line folding is not allowed")
+	}
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("missing colon in header line %q", line)
+	}
+	name, value := line[:i], strings.Trim(line[i+1:], " \t")
+	if !validToken(name) {
+		return "", "", fmt.Errorf("invalid header name %q", name)
+	}
+	if !validFieldValue(value) {
+		return "", "", fmt.Errorf("invalid value for header %q", name)
+	}
+	return strings.ToLower(name), value, nil
+}
+
+// addHeader adds a field, combining repeated ones into a list as allowed by
+// RFC 9110 §5.3.
+func addHeader(headers map[string]string, name, value string) error {
+	prev, ok := headers[name]
+	if !ok {
+		headers[name] = value
+		return nil
+	}
+
+	switch name {
+	case "host":
+		return fmt.Errorf("duplicate host header")
+	case "content-length":
+		// identical values are harmless, anything else is request smuggling
+		if prev != value {
+			return fmt.Errorf("conflicting content-length: %q and %q", prev, value)
+		}
+	case "cookie":
+		headers[name] = prev + "; " + value
+	default:
+		headers[name] = prev + ", " + value
+	}
+	return nil
+}
+
+// validToken reports whether s is a token (RFC 9110 §5.6.2).
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// validFieldValue reports whether s only has visible characters, spaces,
+// tabs and obs-text (RFC 9110 §5.5).
+func validFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// validVersion reports whether s is an HTTP-version, like HTTP/1.1.
+func validVersion(s string) bool {
+	return len(s) == 8 && strings.HasPrefix(s, "HTTP/") &&
+		'0' <= s[5] && s[5] <= '9' && s[6] == '.' && '0' <= s[7] && s[7] <= '9'
+}
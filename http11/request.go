@@ -3,8 +3,10 @@ package http11
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -20,7 +22,38 @@ var validMethods = map[string]bool{
 	"CONNECT": true,
 	"OPTIONS": true,
 	"TRACE":   true,
-	"PATH":    true,
+	"PATCH":   true,
+}
+
+var (
+	ErrHeaderTooLarge = errors.New("request header too large")
+	ErrBodyTooLarge   = errors.New("request body too large")
+	ErrURITooLong     = errors.New("request target too long")
+	// ErrNotImplemented is returned for well-formed requests with a method
+	// or a transfer coding we don't know.
+	ErrNotImplemented = errors.New("not implemented")
+	// ErrBadPreface is returned when a request line that starts the HTTP/2
+	// client preface isn't followed by the rest of it.
+	ErrBadPreface = errors.New("invalid HTTP/2 client preface")
+)
+
+// Limits bounds the size of a request. Zero means no limit.
+type Limits struct {
+	// MaxHeaderBytes bounds the request line and header fields, including
+	// line breaks.
+	MaxHeaderBytes int
+	// MaxLineLength bounds each of those lines. A longer request line fails
+	// with ErrURITooLong, a longer header line with ErrHeaderTooLarge.
+	MaxLineLength int
+	// MaxBodySize bounds the decoded body. Reading past it fails with
+	// ErrBodyTooLarge.
+	MaxBodySize int64
+}
+
+// DefaultLimits are the limits used by UnmarshalReader.
+var DefaultLimits = Limits{
+	MaxHeaderBytes: 1 << 20,
+	MaxLineLength:  8 << 10,
 }
 
 type HTTP11Request struct {
@@ -30,7 +63,14 @@ type HTTP11Request struct {
 
 	Headers map[string]string
 
-	Body []byte
+	// Body streams the request body from the reader passed to
+	// UnmarshalReader, so it must be read before the next request. It is
+	// http.NoBody if the request has none.
+	Body io.Reader
+
+	// Trailers holds the trailer fields of a chunked body once Body has
+	// been read to EOF.
+	Trailers map[string]string
 }
 
 type h1ParsingState int
@@ -65,88 +105,260 @@ func (h1 HTTP11Request) Marshal() []byte {
 }
 
 func (h1 *HTTP11Request) UnmarshalReader(reader *bufio.Reader) error {
+	return h1.UnmarshalReaderWithLimits(reader, DefaultLimits)
+}
+
+func (h1 *HTTP11Request) UnmarshalReaderWithLimits(reader *bufio.Reader, limits Limits) error {
 	if h1.Headers == nil {
 		h1.Headers = map[string]string{}
 	}
+	h1.Body = http.NoBody
+	lines := newLineReader(reader, limits)
+
 	state := method
 	for state != end {
 		switch state {
 		case method:
-			line, err := reader.ReadString('\n')
-			if err != nil {
+			if err := h1.parseRequestLine(lines); err != nil {
 				return err
 			}
 
-			line = strings.TrimSpace(line)
-			parts := strings.Split(line, " ")
-			if len(parts) != 3 {
-				return fmt.Errorf("did not get 3 parts from method")
-			}
-
-			h1.Method = parts[0]
-			h1.Path = parts[1]
-			h1.Protocol = parts[2]
-
-			if validMethods[h1.Method] {
-				state = headers
-			} else if h1.Method == "PRI" {
-				reader.Read(make([]byte, 8))
+			if h1.Method == "PRI" {
+				if err := readPrefaceEnd(reader); err != nil {
+					return err
+				}
 				state = end
 			} else {
-				return fmt.Errorf("unrecognized method: %q", h1.Method)
+				state = headers
 			}
 		case headers:
-			for {
-				line, _, err := reader.ReadLine()
-				if err != nil {
-					return err
-				}
-
-				if len(line) == 0 {
-					state = body
-					break
-				}
-
-				parts := strings.SplitN(string(line), ": ", 2)
-				if len(parts) != 2 {
-					fmt.Printf("%v\n", parts)
-					return fmt.Errorf("did not get 2 parts from header line, got=%d", len(parts))
-				}
-				h1.Headers[strings.ToLower(parts[0])] = parts[1]
+			if err := lines.readHeaderFields(h1.Headers); err != nil {
+				return err
 			}
+			state = body
 		case body:
-			contentLengthStr, ok := h1.Headers["content-length"]
-			if !ok {
-				state = end
-				break
-			}
-			contentLength, err := strconv.Atoi(contentLengthStr)
-			if err != nil {
+			if err := h1.setBody(reader, limits.MaxBodySize); err != nil {
 				return err
 			}
+			state = end
+		}
+	}
+	return nil
+}
 
-			h1.Body = make([]byte, contentLength)
+// parseRequestLine parses "method SP request-target SP HTTP-version"
+// (RFC 9112 §3), skipping empty lines left over from a previous request.
+func (h1 *HTTP11Request) parseRequestLine(lines *lineReader) error {
+	var line string
+	for line == "" {
+		var err error
+		line, err = lines.readLine()
+		if err == errLineTooLong {
+			return ErrURITooLong
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-			_, err = io.ReadFull(reader, h1.Body)
-			if err != nil {
-				return err
-			}
-			state = end
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed request line: %q", line)
+	}
+	h1.Method, h1.Path, h1.Protocol = parts[0], parts[1], parts[2]
+
+	if !validToken(h1.Method) {
+		return fmt.Errorf("invalid method: %q", h1.Method)
+	}
+	if !validTarget(h1.Path) {
+		return fmt.Errorf("invalid request target: %q", h1.Path)
+	}
+	if !validVersion(h1.Protocol) {
+		return fmt.Errorf("invalid protocol: %q", h1.Protocol)
+	}
+
+	// the start of the HTTP/2 client preface
+	if h1.Method == "PRI" {
+		if h1.Path != "*" || h1.Protocol != "HTTP/2.0" {
+			return fmt.Errorf("malformed preface: %q", line)
 		}
+		return nil
+	}
+
+	if h1.Protocol != "HTTP/1.1" && h1.Protocol != "HTTP/1.0" {
+		return fmt.Errorf("unsupported protocol: %q", h1.Protocol)
+	}
+	if !validMethods[h1.Method] {
+		return fmt.Errorf("%w: method %q", ErrNotImplemented, h1.Method)
 	}
 	return nil
 }
 
+// readPrefaceEnd reads what follows the "PRI * HTTP/2.0" request line in
+// the HTTP/2 client preface.
+func readPrefaceEnd(reader *bufio.Reader) error {
+	const prefaceEnd = "\r\nSM\r\n\r\n"
+	bs := make([]byte, len(prefaceEnd))
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		return err
+	}
+	if string(bs) != prefaceEnd {
+		return ErrBadPreface
+	}
+	return nil
+}
+
+// validTarget reports whether s is a plausible request-target: non empty
+// and without whitespace or control characters.
+func validTarget(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// setBody sets up Body according to the framing headers (RFC 9112 §6.3).
+func (h1 *HTTP11Request) setBody(reader *bufio.Reader, maxSize int64) error {
+	transferEncoding, chunked := h1.Headers["transfer-encoding"]
+	contentLengthStr, sized := h1.Headers["content-length"]
+
+	switch {
+	case chunked && sized:
+		return fmt.Errorf("both transfer-encoding and content-length set")
+	case chunked:
+		if err := checkTransferCodings(transferEncoding); err != nil {
+			return err
+		}
+		h1.Trailers = map[string]string{}
+		h1.Body = newChunkedReader(reader, h1.Trailers)
+	case sized:
+		contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
+		if err != nil || strings.TrimLeft(contentLengthStr, "0123456789") != "" {
+			return fmt.Errorf("invalid content-length: %q", contentLengthStr)
+		}
+		if maxSize > 0 && contentLength > maxSize {
+			return ErrBodyTooLarge
+		}
+		if contentLength > 0 {
+			h1.Body = &contentLengthReader{r: reader, n: contentLength}
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	if maxSize > 0 {
+		h1.Body = &maxBodyReader{r: h1.Body, n: maxSize}
+	}
+	return nil
+}
+
+// checkTransferCodings accepts a Transfer-Encoding of chunked, which must
+// come last, and identity. Any other coding would be left on the body for
+// the handler to undo without telling it, so it is not implemented (RFC
+// 9112 §6.1).
+func checkTransferCodings(transferEncoding string) error {
+	codings := strings.Split(transferEncoding, ",")
+	for i, coding := range codings {
+		switch coding = strings.TrimSpace(coding); {
+		case strings.EqualFold(coding, "chunked"):
+			if i != len(codings)-1 {
+				return fmt.Errorf("chunked applied more than once, or not last: %q", transferEncoding)
+			}
+			return nil
+		case strings.EqualFold(coding, "identity"):
+		default:
+			return fmt.Errorf("%w: transfer coding %q", ErrNotImplemented, coding)
+		}
+	}
+	return fmt.Errorf("transfer-encoding not ending in chunked: %q", transferEncoding)
+}
+
+// contentLengthReader reads a body of n bytes, failing with
+// io.ErrUnexpectedEOF if the connection ends first.
+type contentLengthReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *contentLengthReader) Read(bs []byte) (int, error) {
+	if c.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(bs)) > c.n {
+		bs = bs[:c.n]
+	}
+	n, err := c.r.Read(bs)
+	c.n -= int64(n)
+	if err == io.EOF && c.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// maxBodyReader fails with ErrBodyTooLarge once r has more than n bytes.
+type maxBodyReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxBodyReader) Read(bs []byte) (int, error) {
+	if m.n <= 0 {
+		// anything but EOF is past the limit
+		var probe [1]byte
+		n, err := m.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(bs)) > m.n {
+		bs = bs[:m.n]
+	}
+	n, err := m.r.Read(bs)
+	m.n -= int64(n)
+	return n, err
+}
+
+// H2Headers translates the request to an HTTP/2 header list, dropping the
+// connection-specific fields HTTP/2 forbids (RFC 9113 §8.2.2).
 func (h1 *HTTP11Request) H2Headers() []hpack.Header {
 	headers := []hpack.Header{
 		hpack.NewHeader(":method", h1.Method),
+		hpack.NewHeader(":scheme", "http"),
 		hpack.NewHeader(":path", h1.Path),
 		hpack.NewHeader(":authority", h1.Headers["host"]),
 	}
 
+	nominated := map[string]bool{}
+	for _, name := range strings.Split(h1.Headers["connection"], ",") {
+		nominated[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
 	for name, value := range h1.Headers {
+		switch {
+		case connectionSpecific[name], nominated[name]:
+			continue
+		case name == "te" && value != "trailers":
+			continue
+		}
 		headers = append(headers, hpack.NewHeader(name, value))
 	}
 
 	return headers
 }
+
+var connectionSpecific = map[string]bool{
+	"connection":        true,
+	"host":              true,
+	"http2-settings":    true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
@@ -0,0 +1,299 @@
+package http11
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jakegut/goh2/hpack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unmarshal(t *testing.T, input string, limits Limits) (*HTTP11Request, *bufio.Reader, error) {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(input))
+	h1 := &HTTP11Request{}
+	err := h1.UnmarshalReaderWithLimits(r, limits)
+	return h1, r, err
+}
+
+func TestUnmarshalBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		body     string
+		trailers map[string]string
+	}{
+		{
+			name:  "no body",
+			input: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name:  "content-length",
+			input: "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+			body:  "hello",
+		},
+		{
+			name:     "chunked",
+			input:    "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n",
+			body:     "hello",
+			trailers: map[string]string{"x-sum": "1"},
+		},
+		{
+			name:     "identity then chunked",
+			input:    "POST / HTTP/1.1\r\nTransfer-Encoding: identity, Chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+			body:     "abc",
+			trailers: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h1, _, err := unmarshal(t, tt.input, DefaultLimits)
+			require.NoError(t, err)
+			body, err := io.ReadAll(h1.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+			assert.Equal(t, tt.trailers, h1.Trailers)
+		})
+	}
+}
+
+func TestUnmarshalNoBody(t *testing.T) {
+	h1, _, err := unmarshal(t, "GET / HTTP/1.1\r\nContent-Length: 0\r\n\r\n", DefaultLimits)
+	require.NoError(t, err)
+	assert.Equal(t, http.NoBody, h1.Body)
+}
+
+func TestUnmarshalStreamsBody(t *testing.T) {
+	input := "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST /b HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nd\r\n0\r\n\r\n" +
+		"GET /c HTTP/1.1\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+
+	for _, want := range []struct{ path, body string }{{"/a", "abc"}, {"/b", "d"}, {"/c", ""}} {
+		h1 := &HTTP11Request{}
+		require.NoError(t, h1.UnmarshalReader(r))
+		assert.Equal(t, want.path, h1.Path)
+		body, err := io.ReadAll(h1.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want.body, string(body))
+	}
+}
+
+func TestUnmarshalTruncatedBody(t *testing.T) {
+	h1, _, err := unmarshal(t, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello", DefaultLimits)
+	require.NoError(t, err)
+	_, err = io.ReadAll(h1.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestUnmarshalBadFraming(t *testing.T) {
+	inputs := []string{
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: five\r\n\r\n",
+	}
+	for _, input := range inputs {
+		_, _, err := unmarshal(t, input, DefaultLimits)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestUnmarshalUnknownTransferCoding(t *testing.T) {
+	for _, te := range []string{"gzip, chunked", "chunked, chunked", "identity", "gzip"} {
+		_, _, err := unmarshal(t, "POST / HTTP/1.1\r\nTransfer-Encoding: "+te+"\r\n\r\n0\r\n\r\n", DefaultLimits)
+		require.Error(t, err, te)
+		// codings we can't undo are turned away with a 501
+		assert.Equal(t, strings.Contains(te, "gzip"), errors.Is(err, ErrNotImplemented), te)
+	}
+}
+
+func TestUnmarshalLimits(t *testing.T) {
+	header := "GET / HTTP/1.1\r\nX-Large: " + strings.Repeat("a", 100) + "\r\n\r\n"
+	_, _, err := unmarshal(t, header, Limits{MaxHeaderBytes: 100})
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	_, _, err = unmarshal(t, header, Limits{MaxHeaderBytes: len(header)})
+	assert.NoError(t, err)
+
+	_, _, err = unmarshal(t, "POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello world", Limits{MaxBodySize: 10})
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	chunked := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"
+	h1, _, err := unmarshal(t, chunked, Limits{MaxBodySize: 10})
+	require.NoError(t, err)
+	body, err := io.ReadAll(h1.Body)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, "hello worl", string(body))
+
+	h1, _, err = unmarshal(t, chunked, Limits{MaxBodySize: 11})
+	require.NoError(t, err)
+	body, err = io.ReadAll(h1.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+}
+
+func TestUnmarshalRequestLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		method string
+		path   string
+		err    error
+	}{
+		{line: "GET / HTTP/1.1", method: "GET", path: "/"},
+		{line: "PATCH /a?b=c HTTP/1.0", method: "PATCH", path: "/a?b=c"},
+		{line: "OPTIONS * HTTP/1.1", method: "OPTIONS", path: "*"},
+		{line: "BREW /pot HTTP/1.1", err: ErrNotImplemented},
+		{line: "PATH / HTTP/1.1", err: ErrNotImplemented},
+		{line: "GET  / HTTP/1.1"},
+		{line: "GET / HTTP/1.1 "},
+		{line: "GET /a b HTTP/1.1"},
+		{line: "GET\t/ HTTP/1.1"},
+		{line: "GE(T / HTTP/1.1"},
+		{line: "GET / HTTP/1.2.3"},
+		{line: "GET / HTTP/2.0"},
+		{line: "GET / http/1.1"},
+		{line: "GET /\x01 HTTP/1.1"},
+		{line: "PRI / HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			h1, _, err := unmarshal(t, tt.line+"\r\n\r\n", DefaultLimits)
+			if tt.method == "" {
+				require.Error(t, err)
+				if tt.err != nil {
+					assert.ErrorIs(t, err, tt.err)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.method, h1.Method)
+			assert.Equal(t, tt.path, h1.Path)
+		})
+	}
+}
+
+func TestUnmarshalSkipsLeadingEmptyLines(t *testing.T) {
+	h1, _, err := unmarshal(t, "\r\n\r\nGET / HTTP/1.1\r\n\r\n", DefaultLimits)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", h1.Method)
+}
+
+func TestUnmarshalPreface(t *testing.T) {
+	h1, r, err := unmarshal(t, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\nframes", DefaultLimits)
+	require.NoError(t, err)
+	assert.Equal(t, "PRI", h1.Method)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "frames", string(rest))
+}
+
+func TestUnmarshalBadPreface(t *testing.T) {
+	_, _, err := unmarshal(t, "PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n", DefaultLimits)
+	assert.ErrorIs(t, err, ErrBadPreface)
+}
+
+func TestH2Headers(t *testing.T) {
+	h1, _, err := unmarshal(t, "POST /upload HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: Upgrade, HTTP2-Settings, X-Hop\r\n"+
+		"Upgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABk\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Hop: 1\r\n"+
+		"TE: gzip\r\n"+
+		"Accept: */*\r\n"+
+		"Content-Length: 0\r\n\r\n", DefaultLimits)
+	require.NoError(t, err)
+
+	headers := h1.H2Headers()
+	assert.Equal(t, []hpack.Header{
+		hpack.NewHeader(":method", "POST"),
+		hpack.NewHeader(":scheme", "http"),
+		hpack.NewHeader(":path", "/upload"),
+		hpack.NewHeader(":authority", "example.com"),
+	}, headers[:4])
+	assert.ElementsMatch(t, []hpack.Header{
+		hpack.NewHeader("accept", "*/*"),
+		hpack.NewHeader("content-length", "0"),
+	}, headers[4:])
+
+	h1.Headers["te"] = "trailers"
+	assert.Contains(t, h1.H2Headers(), hpack.NewHeader("te", "trailers"))
+}
+
+func TestUnmarshalHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  string
+		headers map[string]string
+	}{
+		{
+			name:    "optional whitespace",
+			fields:  "Host:example.com\r\nX-A: \t spaced out \t\r\nX-Empty:\r\n",
+			headers: map[string]string{"host": "example.com", "x-a": "spaced out", "x-empty": ""},
+		},
+		{
+			name:    "colons in values",
+			fields:  "X-Time: 12:30:00\r\n",
+			headers: map[string]string{"x-time": "12:30:00"},
+		},
+		{
+			name:    "duplicates are combined",
+			fields:  "Accept: text/html\r\naccept: text/plain\r\nCookie: a=1\r\nCookie: b=2\r\n",
+			headers: map[string]string{"accept": "text/html, text/plain", "cookie": "a=1; b=2"},
+		},
+		{
+			name:    "identical content-length",
+			fields:  "Content-Length: 0\r\nContent-Length: 0\r\n",
+			headers: map[string]string{"content-length": "0"},
+		},
+		{
+			name:    "obs-text",
+			fields:  "X-Latin: caf\xe9\r\n",
+			headers: map[string]string{"x-latin": "caf\xe9"},
+		},
+		{name: "obs-fold", fields: "X-A: one\r\n two\r\n"},
+		{name: "whitespace before colon", fields: "X-A : one\r\n"},
+		{name: "missing colon", fields: "X-A one\r\n"},
+		{name: "empty name", fields: ": one\r\n"},
+		{name: "invalid name", fields: "X(A): one\r\n"},
+		{name: "control character", fields: "X-A: o\x00ne\r\n"},
+		{name: "bare CR", fields: "X-A: o\rne\r\n"},
+		{name: "duplicate host", fields: "Host: a\r\nHost: b\r\n"},
+		{name: "conflicting content-length", fields: "Content-Length: 1\r\nContent-Length: 2\r\n\r\nab"},
+		{name: "signed content-length", fields: "Content-Length: +1\r\n\r\na"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h1, _, err := unmarshal(t, "GET / HTTP/1.1\r\n"+tt.fields+"\r\n", DefaultLimits)
+			if tt.headers == nil {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.headers, h1.Headers)
+		})
+	}
+}
+
+func TestUnmarshalLineLength(t *testing.T) {
+	limits := Limits{MaxHeaderBytes: 1 << 10, MaxLineLength: 100}
+
+	_, _, err := unmarshal(t, "GET /"+strings.Repeat("a", 100)+" HTTP/1.1\r\n\r\n", limits)
+	assert.ErrorIs(t, err, ErrURITooLong)
+
+	_, _, err = unmarshal(t, "GET / HTTP/1.1\r\nX-A: "+strings.Repeat("a", 100)+"\r\n\r\n", limits)
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// many short lines still add up
+	fields := strings.Repeat("X-A: "+strings.Repeat("a", 50)+"\r\n", 20)
+	_, _, err = unmarshal(t, "GET / HTTP/1.1\r\n"+fields+"\r\n", limits)
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+}
@@ -0,0 +1,113 @@
+package http11
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response is the status line and header section of an HTTP/1.1 response.
+type Response struct {
+	// Protocol defaults to HTTP/1.1.
+	Protocol   string
+	StatusCode int
+	// Reason defaults to the status text of StatusCode.
+	Reason string
+
+	Headers map[string]string
+	// Fields are written after Headers, a line for each value, for fields
+	// that may repeat such as Set-Cookie.
+	Fields http.Header
+}
+
+func (r Response) Marshal() []byte {
+	var buf bytes.Buffer
+	r.marshal(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the status line and header section to w.
+func (r Response) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	r.marshal(&buf)
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func (r Response) marshal(buf *bytes.Buffer) {
+	protocol := r.Protocol
+	if protocol == "" {
+		protocol = "HTTP/1.1"
+	}
+	reason := r.Reason
+	if reason == "" {
+		reason = http.StatusText(r.StatusCode)
+	}
+	fmt.Fprintf(buf, "%s %03d %s\r\n", protocol, r.StatusCode, reason)
+
+	for key, val := range r.Headers {
+		buf.WriteString(key)
+		buf.WriteString(": ")
+		buf.WriteString(val)
+		buf.WriteString("\r\n")
+	}
+	r.Fields.Write(buf)
+
+	buf.WriteString("\r\n")
+}
+
+// UnmarshalReader reads a status line and header section, leaving any
+// body in reader.
+func (r *Response) UnmarshalReader(reader *bufio.Reader) error {
+	if r.Headers == nil {
+		r.Headers = map[string]string{}
+	}
+	lines := newLineReader(reader, DefaultLimits)
+
+	line, err := lines.readLine()
+	if err == errLineTooLong {
+		return ErrHeaderTooLarge
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.parseStatusLine(line); err != nil {
+		return err
+	}
+
+	return lines.readHeaderFields(r.Headers)
+}
+
+// parseStatusLine parses "HTTP-version SP status-code SP [reason-phrase]"
+// (RFC 9112 §4).
+func (r *Response) parseStatusLine(line string) error {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("malformed status line: %q", line)
+	}
+	if !validVersion(parts[0]) {
+		return fmt.Errorf("invalid protocol: %q", parts[0])
+	}
+	if len(parts[1]) != 3 {
+		return fmt.Errorf("invalid status code: %q", parts[1])
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 {
+		return fmt.Errorf("invalid status code: %q", parts[1])
+	}
+
+	r.Protocol = parts[0]
+	r.StatusCode = code
+	r.Reason = ""
+	if len(parts) == 3 {
+		if !validFieldValue(parts[2]) {
+			return fmt.Errorf("invalid reason phrase: %q", parts[2])
+		}
+		r.Reason = parts[2]
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package http11
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseMarshal(t *testing.T) {
+	resp := Response{
+		StatusCode: 101,
+		Headers:    map[string]string{"Upgrade": "h2c"},
+	}
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: h2c\r\n\r\n", string(resp.Marshal()))
+
+	resp = Response{Protocol: "HTTP/1.0", StatusCode: 299, Reason: "Fine"}
+	assert.Equal(t, "HTTP/1.0 299 Fine\r\n\r\n", string(resp.Marshal()))
+}
+
+func TestResponseWriteTo(t *testing.T) {
+	resp := Response{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Length": "0"},
+		Fields:     http.Header{"Set-Cookie": {"a=1", "b=2"}},
+	}
+	var buf bytes.Buffer
+	n, err := resp.WriteTo(&buf)
+	require.NoError(t, err)
+	want := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n"
+	assert.Equal(t, want, buf.String())
+	assert.Equal(t, int64(len(want)), n)
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	resp := Response{
+		StatusCode: 101,
+		Headers:    map[string]string{"connection": "Upgrade", "upgrade": "h2c"},
+	}
+	r := bufio.NewReader(bytes.NewReader(append(resp.Marshal(), "rest"...)))
+
+	var got Response
+	require.NoError(t, got.UnmarshalReader(r))
+	assert.Equal(t, Response{
+		Protocol:   "HTTP/1.1",
+		StatusCode: 101,
+		Reason:     "Switching Protocols",
+		Headers:    resp.Headers,
+	}, got)
+
+	rest, err := r.ReadString(0)
+	assert.Equal(t, "rest", rest, err)
+}
+
+func TestResponseStatusLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		code   int
+		reason string
+	}{
+		{line: "HTTP/1.1 200 OK", code: 200, reason: "OK"},
+		{line: "HTTP/1.1 404 Not Found", code: 404, reason: "Not Found"},
+		{line: "HTTP/1.1 204 ", code: 204},
+		{line: "HTTP/1.1 204", code: 204},
+		{line: "HTTP/1.1 2000 OK"},
+		{line: "HTTP/1.1 099 Early"},
+		{line: "HTTP/1.1 abc OK"},
+		{line: "HTTP/1 200 OK"},
+		{line: "200 OK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			var resp Response
+			err := resp.UnmarshalReader(bufio.NewReader(strings.NewReader(tt.line + "\r\n\r\n")))
+			if tt.code == 0 {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, tt.reason, resp.Reason)
+		})
+	}
+}
@@ -0,0 +1,1271 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakegut/goh2/hpack"
+)
+
+const (
+	// transportStreamWindow is the SETTINGS_INITIAL_WINDOW_SIZE a client
+	// connection advertises, and transportConnWindow what it raises the
+	// connection window to. Both are handed back as response bodies are
+	// read.
+	transportStreamWindow = 4 << 20
+	transportConnWindow   = 16 << 20
+
+	// defaultMaxFrameSize is the SETTINGS_MAX_FRAME_SIZE both ends start
+	// with.
+	defaultMaxFrameSize = 1 << 14
+
+	maxWindowSize = 1<<31 - 1
+
+	// defaultClientMaxStreams is the most requests a client connection
+	// carries at once unless the server sets SETTINGS_MAX_CONCURRENT_STREAMS.
+	defaultClientMaxStreams = 100
+)
+
+var (
+	// errClientConnUnusable means the request was not sent because the
+	// connection is closing, or has no room for requests at all, so it can
+	// be retried on another one.
+	errClientConnUnusable = errors.New("http2: client connection can't take new requests")
+	// errClientConnFull means the request was not sent because the
+	// connection is at the server's SETTINGS_MAX_CONCURRENT_STREAMS, which
+	// the requests in flight on it will make room under.
+	errClientConnFull   = errors.New("http2: client connection has no room for another request")
+	errClientConnClosed = errors.New("http2: client connection closed")
+	// errStreamRefused means the server did not process the request, as
+	// promised by GOAWAY or a REFUSED_STREAM reset.
+	errStreamRefused = errors.New("http2: request refused by server")
+	errBodyClosed    = errors.New("http2: response body closed")
+)
+
+// ClientConn is the client side of a single HTTP/2 connection, on which
+// any number of requests can be in flight at once. Frames are read by a
+// single goroutine which dispatches them to the streams; requests write
+// their own HEADERS and DATA frames.
+type ClientConn struct {
+	conn      net.Conn
+	bufreader *bufio.Reader
+
+	maxHeaderListSize uint32
+
+	// wmu serialises writes to conn. It also guards the HPACK encoder, as
+	// header blocks must be encoded in the order they are sent.
+	wmu          sync.Mutex
+	hpackEncoder *hpack.HPackEncoder
+
+	// control queues frames for the writer goroutine. The reader queues
+	// acknowledgements there as it must never block on writing.
+	controlMu    sync.Mutex
+	control      []func()
+	controlReady chan struct{}
+
+	// hpackDecoder is only used by the reader.
+	hpackDecoder *hpack.HPackDecoder
+
+	mu sync.Mutex
+	// cond is signalled when send windows grow and when streams or the
+	// connection close.
+	cond *sync.Cond
+	// settings are the server's.
+	settings     *ConnectionSettings
+	streams      map[uint32]*clientStream
+	nextStreamID uint32
+	sendWindow   int64
+	recvWindow   int
+	recvUnacked  int
+	goAway       *GoAwayFrame
+	closed       bool
+	err          error
+	// idleSince is when the last request finished.
+	idleSince time.Time
+	// pings maps the payload of each PING in flight to the channel
+	// closed by its acknowledgement.
+	pings   map[[8]byte]chan struct{}
+	pingSeq uint64
+
+	// settingsReceived is closed once the server's first SETTINGS frame
+	// has been applied.
+	settingsReceived chan struct{}
+	readerDone       chan struct{}
+	onClose          func(*ClientConn)
+}
+
+func newClientConn(conn net.Conn, maxHeaderListSize uint32) *ClientConn {
+	cc := &ClientConn{
+		conn:              conn,
+		bufreader:         bufio.NewReader(conn),
+		maxHeaderListSize: maxHeaderListSize,
+		hpackEncoder:      &hpack.HPackEncoder{},
+		hpackDecoder:      hpack.Decoder(),
+		controlReady:      make(chan struct{}, 1),
+		settings:          NewSettings(),
+		streams:           map[uint32]*clientStream{},
+		nextStreamID:      1,
+		sendWindow:        int64(NewSettings().InitialWindowSize),
+		recvWindow:        transportConnWindow,
+		idleSince:         time.Now(),
+		pings:             map[[8]byte]chan struct{}{},
+		settingsReceived:  make(chan struct{}),
+		readerDone:        make(chan struct{}),
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+	// the limit is unbounded until the server sets one, but one
+	// connection shouldn't carry everything
+	cc.settings.MaxConcurrentStreams = defaultClientMaxStreams
+	cc.hpackDecoder.SetMaxHeaderListSize(int(maxHeaderListSize))
+	return cc
+}
+
+// initialSettings is the SETTINGS frame a client connection opens with.
+func (cc *ClientConn) initialSettings() *SettingsFrame {
+	return &SettingsFrame{
+		Args: []SettingFrameArgs{
+			{Param: SettingsEnablePush, Value: 0},
+			{Param: SettingsInitialWindowSize, Value: transportStreamWindow},
+			{Param: SettingsMaxHeaderListSize, Value: cc.maxHeaderListSize},
+		},
+	}
+}
+
+// start runs the reader and writer and sends the client preface. The
+// reader has to be running first, as the server may block writing its
+// own SETTINGS until they are read.
+func (cc *ClientConn) start() error {
+	go cc.readLoop()
+	go cc.writeLoop()
+
+	settings, _ := cc.initialSettings().Encode()
+	windowUpdate, _ := (&WindowUpdateFrame{
+		SizeIncrement: transportConnWindow - NewSettings().InitialWindowSize,
+	}).Encode()
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	for _, bs := range [][]byte{[]byte(ClientPreface), settings, windowUpdate} {
+		if _, err := cc.conn.Write(bs); err != nil {
+			cc.conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the connection, failing any requests in flight.
+func (cc *ClientConn) Close() error {
+	err := cc.conn.Close()
+	<-cc.readerDone
+	return err
+}
+
+// canTakeNewRequest reports whether a new request may be sent on cc.
+func (cc *ClientConn) canTakeNewRequest() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.canTakeNewRequestLocked()
+}
+
+// canTakeNewRequestLocked also rules out connections at the server's
+// SETTINGS_MAX_CONCURRENT_STREAMS, which can take requests again later.
+func (cc *ClientConn) canTakeNewRequestLocked() bool {
+	return !cc.retiredLocked() && uint32(len(cc.streams)) < cc.settings.MaxConcurrentStreams
+}
+
+// retired reports whether cc will never take new requests again.
+func (cc *ClientConn) retired() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.retiredLocked()
+}
+
+func (cc *ClientConn) retiredLocked() bool {
+	return cc.closed || cc.goAway != nil || cc.nextStreamID >= maxWindowSize
+}
+
+// idle reports whether cc has no requests in flight.
+func (cc *ClientConn) idle() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.streams) == 0
+}
+
+// idleFor returns how long cc has had no requests in flight.
+func (cc *ClientConn) idleFor() time.Duration {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if len(cc.streams) > 0 {
+		return 0
+	}
+	return time.Since(cc.idleSince)
+}
+
+// awaitSettings waits for the server's first SETTINGS frame, so that its
+// limits are known before requests are sent.
+func (cc *ClientConn) awaitSettings(ctx context.Context) error {
+	select {
+	case <-cc.settingsReceived:
+		return nil
+	case <-cc.readerDone:
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return cc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping sends a PING frame and waits for the server to acknowledge it.
+func (cc *ClientConn) Ping(ctx context.Context) error {
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return cc.err
+	}
+	cc.pingSeq++
+	var opaque [8]byte
+	binary.BigEndian.PutUint64(opaque[:], cc.pingSeq)
+	ack := make(chan struct{})
+	cc.pings[opaque] = ack
+	cc.mu.Unlock()
+
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pings, opaque)
+		cc.mu.Unlock()
+	}()
+
+	cc.queueFrame(&PingFrame{Opaque: opaque[:]})
+
+	select {
+	case <-ack:
+		return nil
+	case <-cc.readerDone:
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return cc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RoundTrip sends req on a new stream and waits for the response headers.
+func (cc *ClientConn) RoundTrip(req *http.Request) (*http.Response, error) {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	headers, err := clientRequestHeaders(req, hasBody)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	cs, err := cc.openStream(req, headers, !hasBody)
+	if err == errClientConnUnusable || err == errClientConnFull {
+		// the body is left for a retry on another connection
+		return nil, err
+	}
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	if hasBody {
+		go cs.writeBody(req.Body)
+	}
+	go cs.watchContext(req.Context())
+
+	return cs.awaitResponse(req.Context())
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// clientRequestHeaders builds the header list for req (RFC 9113 §8.3.1),
+// leaving out the connection-specific fields HTTP/2 forbids.
+func clientRequestHeaders(req *http.Request, hasBody bool) ([]hpack.Header, error) {
+	authority := req.Host
+	if authority == "" {
+		authority = req.URL.Host
+	}
+	if authority == "" {
+		return nil, errors.New("http2: request has no host")
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := req.URL.RequestURI()
+	if method == http.MethodOptions && req.URL.Path == "" && req.URL.RawQuery == "" {
+		path = "*"
+	}
+
+	headers := []hpack.Header{
+		hpack.NewHeader(":method", method),
+		hpack.NewHeader(":scheme", "http"),
+		hpack.NewHeader(":authority", authority),
+		hpack.NewHeader(":path", path),
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "host", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "content-length":
+			continue
+		}
+		for _, value := range values {
+			if name == "te" && value != "trailers" {
+				continue
+			}
+			headers = append(headers, hpack.NewHeader(name, value))
+		}
+	}
+
+	switch {
+	case hasBody && req.ContentLength > 0:
+		headers = append(headers, hpack.NewHeader("content-length", strconv.FormatInt(req.ContentLength, 10)))
+	case !hasBody && (method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch):
+		headers = append(headers, hpack.NewHeader("content-length", "0"))
+	}
+	return headers, nil
+}
+
+// openStream allocates the next stream and sends its HEADERS. Both happen
+// under wmu so streams are opened in order.
+func (cc *ClientConn) openStream(req *http.Request, headers []hpack.Header, endStream bool) (*clientStream, error) {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	cc.mu.Lock()
+	if !cc.canTakeNewRequestLocked() {
+		err := errClientConnUnusable
+		if !cc.retiredLocked() && len(cc.streams) > 0 {
+			err = errClientConnFull
+		}
+		cc.mu.Unlock()
+		return nil, err
+	}
+	cs := cc.newStreamLocked(req)
+	cs.apply(SendHeaders)
+	if endStream {
+		cs.apply(SendEndStream)
+	}
+	maxFrameSize := int(cc.settings.MaxFrameSize)
+	cc.mu.Unlock()
+
+	if err := cc.writeHeadersLocked(cs.id, headers, endStream, maxFrameSize); err != nil {
+		cc.conn.Close()
+		cs.abort(err)
+		return nil, err
+	}
+	return cs, nil
+}
+
+// newStreamLocked must be called with mu held.
+func (cc *ClientConn) newStreamLocked(req *http.Request) *clientStream {
+	cs := &clientStream{
+		cc:         cc,
+		id:         cc.nextStreamID,
+		req:        req,
+		state:      StreamStateIdle,
+		sendWindow: int64(cc.settings.InitialWindowSize),
+		recvWindow: transportStreamWindow,
+		respReady:  make(chan struct{}),
+		done:       make(chan struct{}),
+		body:       newPipe(),
+	}
+	cc.nextStreamID += 2
+	cc.streams[cs.id] = cs
+	return cs
+}
+
+// writeHeadersLocked encodes headers and sends them as a HEADERS frame
+// followed by as many CONTINUATION frames as needed. wmu must be held.
+func (cc *ClientConn) writeHeadersLocked(streamid uint32, headers []hpack.Header, endStream bool, maxFrameSize int) error {
+	block, err := cc.hpackEncoder.Encode(headers)
+	if err != nil {
+		return err
+	}
+
+	first := true
+	for first || len(block) > 0 {
+		fragment := block
+		if len(fragment) > maxFrameSize {
+			fragment = fragment[:maxFrameSize]
+		}
+		block = block[len(fragment):]
+
+		var frame Frame
+		if first {
+			frame = &HeadersFrame{
+				Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+				EndStream:     endStream,
+				EndHeaders:    len(block) == 0,
+				BlockFragment: fragment,
+			}
+		} else {
+			frame = &ContinuationFrame{
+				Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+				EndHeaders:    len(block) == 0,
+				BlockFragment: fragment,
+			}
+		}
+		first = false
+
+		if err := cc.writeFrameLocked(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cc *ClientConn) writeFrame(frame Frame) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	return cc.writeFrameLocked(frame)
+}
+
+func (cc *ClientConn) writeFrameLocked(frame Frame) error {
+	bs, err := frame.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = cc.conn.Write(bs)
+	return err
+}
+
+// queue hands fn to the writer goroutine, which runs it with wmu held.
+func (cc *ClientConn) queue(fn func()) {
+	cc.controlMu.Lock()
+	cc.control = append(cc.control, fn)
+	cc.controlMu.Unlock()
+
+	select {
+	case cc.controlReady <- struct{}{}:
+	default:
+	}
+}
+
+func (cc *ClientConn) queueFrame(frame Frame) {
+	cc.queue(func() {
+		cc.writeFrameLocked(frame)
+	})
+}
+
+func (cc *ClientConn) writeLoop() {
+	for {
+		select {
+		case <-cc.controlReady:
+		case <-cc.readerDone:
+			return
+		}
+
+		cc.controlMu.Lock()
+		control := cc.control
+		cc.control = nil
+		cc.controlMu.Unlock()
+
+		cc.wmu.Lock()
+		for _, fn := range control {
+			fn()
+		}
+		cc.wmu.Unlock()
+	}
+}
+
+func (cc *ClientConn) readLoop() {
+	err := cc.readFrames()
+
+	var connErr ConnectionError
+	if errors.As(err, &connErr) {
+		cc.writeFrame(&GoAwayFrame{ErrorCode: connErr.Code, Opaque: []byte(connErr.Reason)})
+	}
+	if err == io.EOF {
+		err = errClientConnClosed
+	}
+
+	cc.mu.Lock()
+	cc.closed = true
+	cc.err = err
+	streams := cc.streams
+	cc.streams = map[uint32]*clientStream{}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	for _, cs := range streams {
+		cs.abort(err)
+	}
+	cc.conn.Close()
+	close(cc.readerDone)
+
+	if cc.onClose != nil {
+		cc.onClose(cc)
+	}
+}
+
+func (cc *ClientConn) readFrames() error {
+	for {
+		frame, err := ParseFrame(cc.bufreader, defaultMaxFrameSize)
+		if err == ErrUnknownFrame {
+			continue
+		}
+		if err == nil {
+			err = cc.handleFrame(frame)
+		}
+
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			cc.resetStream(streamErr.StreamID, streamErr.Code, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (cc *ClientConn) handleFrame(frame Frame) error {
+	switch fr := frame.(type) {
+	case *SettingsFrame:
+		if fr.Ack {
+			return nil
+		}
+		return cc.handleSettings(fr)
+	case *PingFrame:
+		if !fr.Ack {
+			cc.queueFrame(&PingFrame{Ack: true, Opaque: fr.Opaque})
+			return nil
+		}
+		cc.handlePingAck(fr)
+	case *GoAwayFrame:
+		cc.handleGoAway(fr)
+	case *WindowUpdateFrame:
+		return cc.handleWindowUpdate(fr)
+	case *HeadersFrame:
+		return cc.handleHeaders(fr)
+	case *ContinuationFrame:
+		return connError(ErrProtocolError, "unexpected CONTINUATION on stream %d", fr.Header().StreamID)
+	case *DataFrame:
+		return cc.handleData(fr)
+	case *RSTStreamFrame:
+		cc.handleReset(fr)
+	case *PushPromiseFrame:
+		return connError(ErrProtocolError, "push is disabled")
+	}
+	return nil
+}
+
+func (cc *ClientConn) handleSettings(fr *SettingsFrame) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for _, arg := range fr.Args {
+		oldWindow := cc.settings.InitialWindowSize
+		if err := cc.settings.SetValue(arg.Param, arg.Value); err != nil {
+			return err
+		}
+
+		switch arg.Param {
+		case SettingsInitialWindowSize:
+			delta := int64(arg.Value) - int64(oldWindow)
+			for _, cs := range cc.streams {
+				cs.sendWindow += delta
+				if cs.sendWindow > maxWindowSize {
+					return connError(ErrFlowControlError, "window of stream %d overflows", cs.id)
+				}
+			}
+		case SettingsHeaderTableSize:
+			size := int(arg.Value)
+			// ordered before the acknowledgement, after which the
+			// server expects the new size
+			cc.queue(func() {
+				cc.hpackEncoder.SetMaxDynamicTableSize(size)
+			})
+		}
+	}
+	cc.cond.Broadcast()
+	cc.queueFrame(&SettingsFrame{Ack: true})
+
+	select {
+	case <-cc.settingsReceived:
+	default:
+		close(cc.settingsReceived)
+	}
+	return nil
+}
+
+func (cc *ClientConn) handlePingAck(fr *PingFrame) {
+	var opaque [8]byte
+	copy(opaque[:], fr.Opaque)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if ack, ok := cc.pings[opaque]; ok {
+		close(ack)
+		delete(cc.pings, opaque)
+	}
+}
+
+// handleGoAway stops new requests on the connection and fails the ones the
+// server says it never processed, which are safe to retry.
+func (cc *ClientConn) handleGoAway(fr *GoAwayFrame) {
+	cc.mu.Lock()
+	cc.goAway = fr
+	var refused []*clientStream
+	for id, cs := range cc.streams {
+		if id > fr.LastStreamID {
+			refused = append(refused, cs)
+		}
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	for _, cs := range refused {
+		cs.abort(errStreamRefused)
+	}
+
+	cc.mu.Lock()
+	cc.closeIfRetiredIdleLocked()
+	cc.mu.Unlock()
+}
+
+func (cc *ClientConn) handleWindowUpdate(fr *WindowUpdateFrame) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	streamid := fr.Header().StreamID
+	increment := int64(fr.SizeIncrement)
+	if streamid == 0 {
+		cc.sendWindow += increment
+		if cc.sendWindow > maxWindowSize {
+			return connError(ErrFlowControlError, "connection window overflows")
+		}
+	} else if cs := cc.streams[streamid]; cs != nil {
+		cs.sendWindow += increment
+		if cs.sendWindow > maxWindowSize {
+			return StreamError{StreamID: streamid, Code: ErrFlowControlError}
+		}
+	}
+	cc.cond.Broadcast()
+	return nil
+}
+
+// stream returns the active stream streamid. Frames for streams we never
+// opened are a connection error; ones for streams that have finished are
+// ignored.
+func (cc *ClientConn) stream(streamid uint32) (*clientStream, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if streamid%2 == 0 {
+		return nil, connError(ErrProtocolError, "frame on server stream %d", streamid)
+	}
+	if streamid >= cc.nextStreamID {
+		return nil, connError(ErrProtocolError, "frame on idle stream %d", streamid)
+	}
+	return cc.streams[streamid], nil
+}
+
+func (cc *ClientConn) handleHeaders(fr *HeadersFrame) error {
+	headers, err := cc.readHeaderBlock(fr)
+	if err != nil {
+		return err
+	}
+
+	cs, err := cc.stream(fr.Header().StreamID)
+	if cs == nil || err != nil {
+		return err
+	}
+	if headers == nil {
+		return StreamError{StreamID: cs.id, Code: ErrProtocolError}
+	}
+	return cs.handleHeaders(fr, headers)
+}
+
+// readHeaderBlock reads any CONTINUATION frames following fr and decodes
+// the whole header block. This must happen for every block to keep the
+// HPACK state in sync. The headers are nil if the list exceeded
+// maxHeaderListSize.
+func (cc *ClientConn) readHeaderBlock(fr *HeadersFrame) (headers []hpack.Header, err error) {
+	streamid := fr.Header().StreamID
+	maxBlockSize := 2 * int(cc.maxHeaderListSize)
+	blockSize := len(fr.BlockFragment)
+
+	headers = []hpack.Header{}
+	cc.hpackDecoder.SetEmitFunc(func(header hpack.Header) {
+		headers = append(headers, header)
+	})
+	defer func() {
+		if err != nil {
+			// drop the rest of the abandoned block
+			cc.hpackDecoder.Close()
+		}
+	}()
+	if _, err := cc.hpackDecoder.Write(fr.BlockFragment); err != nil {
+		return nil, connError(ErrCompressionError, "decoding header block: %s", err)
+	}
+
+	for endHeaders := fr.EndHeaders; !endHeaders; {
+		frame, err := ParseFrame(cc.bufreader, defaultMaxFrameSize)
+		if err != nil {
+			return nil, headerBlockError(streamid, err)
+		}
+		continuation, ok := frame.(*ContinuationFrame)
+		if !ok || continuation.Header().StreamID != streamid {
+			return nil, connError(ErrProtocolError, "expected CONTINUATION for stream %d, got %T", streamid, frame)
+		}
+
+		blockSize += len(continuation.BlockFragment)
+		if blockSize > maxBlockSize {
+			return nil, connError(ErrEnhanceYourCalm, "header block exceeds %d bytes", maxBlockSize)
+		}
+		if _, err := cc.hpackDecoder.Write(continuation.BlockFragment); err != nil {
+			return nil, connError(ErrCompressionError, "decoding header block: %s", err)
+		}
+		endHeaders = continuation.EndHeaders
+	}
+
+	err = cc.hpackDecoder.Close()
+	if err == hpack.ErrHeaderListTooLarge {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, connError(ErrCompressionError, "decoding header block: %s", err)
+	}
+	return headers, nil
+}
+
+func (cc *ClientConn) handleData(fr *DataFrame) error {
+	size := len(fr.Framed.Payload)
+	cs, err := cc.stream(fr.Header().StreamID)
+	if err != nil {
+		return err
+	}
+	if err := cc.takeWindow(cs, fr); err != nil {
+		return err
+	}
+	if cs == nil {
+		// the connection window still counts it
+		cc.returnWindow(nil, size)
+		return nil
+	}
+
+	if err := cs.handleData(fr); err != nil {
+		cc.returnWindow(nil, size)
+		return err
+	}
+	// padding is never read, so it's handed back right away
+	cc.returnWindow(cs, size-len(fr.Data))
+	return nil
+}
+
+// takeWindow charges DATA, padding included, to the receive windows of the
+// connection and of cs, if it is still open. The credit is handed back by
+// returnWindow as the response body is read, so a server can't make us
+// buffer more than a window's worth.
+func (cc *ClientConn) takeWindow(cs *clientStream, fr *DataFrame) error {
+	size := len(fr.Framed.Payload)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if size > cc.recvWindow {
+		return connError(ErrFlowControlError, "DATA on stream %d overflows the connection window", fr.Header().StreamID)
+	}
+	if cs != nil && size > cs.recvWindow {
+		return connError(ErrFlowControlError, "DATA on stream %d overflows its window", fr.Header().StreamID)
+	}
+	cc.recvWindow -= size
+	if cs != nil {
+		cs.recvWindow -= size
+	}
+	return nil
+}
+
+// returnWindow acknowledges n bytes of flow-controlled data received on
+// cs, or just on the connection if cs is nil. WINDOW_UPDATE frames are
+// only sent once half a window is due, to avoid a frame per read.
+func (cc *ClientConn) returnWindow(cs *clientStream, n int) {
+	if n <= 0 {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.recvUnacked += n
+	if cc.recvUnacked >= transportConnWindow/2 {
+		cc.queueFrame(&WindowUpdateFrame{SizeIncrement: uint32(cc.recvUnacked)})
+		cc.recvWindow += cc.recvUnacked
+		cc.recvUnacked = 0
+	}
+
+	if cs == nil || cs.state == StreamStateClosed || cs.state == StreamStateHalfClosedRemote {
+		return
+	}
+	cs.recvUnacked += n
+	if cs.recvUnacked >= transportStreamWindow/2 {
+		cc.queueFrame(&WindowUpdateFrame{
+			Framed:        Framed{Header: FrameHeader{StreamID: cs.id}},
+			SizeIncrement: uint32(cs.recvUnacked),
+		})
+		cs.recvWindow += cs.recvUnacked
+		cs.recvUnacked = 0
+	}
+}
+
+func (cc *ClientConn) handleReset(fr *RSTStreamFrame) {
+	cc.mu.Lock()
+	cs := cc.streams[fr.Header().StreamID]
+	cc.mu.Unlock()
+	if cs == nil {
+		return
+	}
+
+	switch fr.ErrorCode {
+	case ErrRefusedStream:
+		cs.abort(errStreamRefused)
+	case ErrNoError:
+		// the server has sent a complete response and doesn't want the
+		// rest of the request body
+		cs.abortSending()
+	default:
+		cs.abort(StreamError{StreamID: cs.id, Code: fr.ErrorCode})
+	}
+}
+
+// resetStream sends RST_STREAM for streamid and fails its request with err.
+func (cc *ClientConn) resetStream(streamid uint32, code ErrorCode, err error) {
+	cc.queueFrame(&RSTStreamFrame{
+		Framed:    Framed{Header: FrameHeader{StreamID: streamid}},
+		ErrorCode: code,
+	})
+
+	cc.mu.Lock()
+	cs := cc.streams[streamid]
+	cc.mu.Unlock()
+	if cs != nil {
+		cs.abort(err)
+	}
+}
+
+// forgetStreamLocked must be called with mu held.
+func (cc *ClientConn) forgetStreamLocked(cs *clientStream) {
+	if cc.streams[cs.id] != cs {
+		return
+	}
+	delete(cc.streams, cs.id)
+	if len(cc.streams) == 0 {
+		cc.idleSince = time.Now()
+	}
+	cc.cond.Broadcast()
+	cc.closeIfRetiredIdleLocked()
+}
+
+// closeIfRetiredIdleLocked closes a connection after GOAWAY once its last
+// request has finished. mu must be held.
+func (cc *ClientConn) closeIfRetiredIdleLocked() {
+	if cc.goAway != nil && !cc.closed && len(cc.streams) == 0 {
+		cc.conn.Close()
+	}
+}
+
+// clientStream is a single request and its response.
+type clientStream struct {
+	cc  *ClientConn
+	id  uint32
+	req *http.Request
+
+	// The following are guarded by cc.mu.
+	state       StreamState
+	sendWindow  int64
+	recvWindow  int
+	recvUnacked int
+	resp        *http.Response
+	err         error
+	// sendDone is set once nothing more will be sent for the stream.
+	sendDone bool
+
+	// respReady is closed once resp or err is set.
+	respReady chan struct{}
+	// done is closed once the stream has finished either way.
+	done chan struct{}
+
+	body *pipe
+}
+
+// apply moves the stream along the transition for trigger, reporting
+// false if trigger isn't allowed in the current state. cc.mu must be held.
+func (cs *clientStream) apply(trigger StreamTrigger) bool {
+	to, ok := NextStreamState(cs.state, trigger)
+	if !ok {
+		return false
+	}
+	cs.state = to
+	if to == StreamStateHalfClosedLocal {
+		cs.sendDone = true
+	}
+	if to == StreamStateClosed {
+		cs.finishLocked()
+	}
+	return true
+}
+
+// finishLocked ends the stream. cc.mu must be held.
+func (cs *clientStream) finishLocked() {
+	select {
+	case <-cs.done:
+		return
+	default:
+	}
+	cs.state = StreamStateClosed
+	cs.sendDone = true
+	close(cs.done)
+	cs.cc.forgetStreamLocked(cs)
+}
+
+// abort fails the stream with err, unless it has already finished.
+func (cs *clientStream) abort(err error) {
+	cs.cc.mu.Lock()
+	defer cs.cc.mu.Unlock()
+
+	select {
+	case <-cs.done:
+		return
+	default:
+	}
+	cs.err = err
+	if cs.resp == nil {
+		close(cs.respReady)
+	}
+	cs.body.closeWithError(err)
+	cs.finishLocked()
+}
+
+// abortSending stops sending the request body, leaving the response alone.
+func (cs *clientStream) abortSending() {
+	cs.cc.mu.Lock()
+	defer cs.cc.mu.Unlock()
+	cs.sendDone = true
+	if cs.state == StreamStateHalfClosedRemote {
+		cs.finishLocked()
+	}
+	cs.cc.cond.Broadcast()
+}
+
+// cancel resets the stream unless it has already finished.
+func (cs *clientStream) cancel(err error) {
+	select {
+	case <-cs.done:
+		return
+	default:
+	}
+	cs.cc.resetStream(cs.id, ErrCancel, err)
+}
+
+func (cs *clientStream) watchContext(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		cs.cancel(ctx.Err())
+	case <-cs.done:
+	}
+}
+
+func (cs *clientStream) awaitResponse(ctx context.Context) (*http.Response, error) {
+	select {
+	case <-cs.respReady:
+	case <-ctx.Done():
+		cs.cancel(ctx.Err())
+		<-cs.respReady
+	}
+
+	cs.cc.mu.Lock()
+	defer cs.cc.mu.Unlock()
+	if cs.resp == nil {
+		return nil, cs.err
+	}
+	return cs.resp, nil
+}
+
+// writeBody sends body as DATA frames, as far as the flow control windows
+// allow, and ends the stream.
+func (cs *clientStream) writeBody(body io.ReadCloser) {
+	defer body.Close()
+
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		n, err := body.Read(buf)
+		data := buf[:n]
+		for len(data) > 0 {
+			allowed, ok := cs.awaitSendWindow(len(data))
+			if !ok {
+				return
+			}
+			if werr := cs.writeData(data[:allowed], false); werr != nil {
+				return
+			}
+			data = data[allowed:]
+		}
+
+		if err == io.EOF {
+			cs.endStream()
+			return
+		}
+		if err != nil {
+			cs.cancel(err)
+			return
+		}
+	}
+}
+
+func (cs *clientStream) writeData(data []byte, endStream bool) error {
+	err := cs.cc.writeFrame(&DataFrame{
+		Framed:    Framed{Header: FrameHeader{StreamID: cs.id}},
+		Data:      data,
+		EndStream: endStream,
+	})
+	if err != nil {
+		cs.abort(err)
+	}
+	return err
+}
+
+func (cs *clientStream) endStream() {
+	cs.cc.mu.Lock()
+	if cs.sendDone {
+		cs.cc.mu.Unlock()
+		return
+	}
+	cs.apply(SendEndStream)
+	cs.cc.mu.Unlock()
+
+	cs.writeData(nil, true)
+}
+
+// awaitSendWindow blocks until up to want bytes may be sent, reporting
+// false if the stream stopped sending meanwhile.
+func (cs *clientStream) awaitSendWindow(want int) (int, bool) {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for {
+		if cs.sendDone || cc.closed {
+			return 0, false
+		}
+		if cs.sendWindow > 0 && cc.sendWindow > 0 {
+			n := int64(want)
+			for _, limit := range []int64{cs.sendWindow, cc.sendWindow, int64(cc.settings.MaxFrameSize)} {
+				if limit < n {
+					n = limit
+				}
+			}
+			cs.sendWindow -= n
+			cc.sendWindow -= n
+			return int(n), true
+		}
+		cc.cond.Wait()
+	}
+}
+
+func (cs *clientStream) handleHeaders(fr *HeadersFrame, headers []hpack.Header) error {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if !cs.apply(RecvHeaders) {
+		return StreamError{StreamID: cs.id, Code: ErrStreamClosed}
+	}
+
+	if cs.resp == nil {
+		status := headerValue(headers, ":status")
+		code, err := strconv.Atoi(status)
+		if err != nil || len(status) != 3 || code < 100 {
+			return StreamError{StreamID: cs.id, Code: ErrProtocolError}
+		}
+		if code < 200 {
+			// interim responses are skipped
+			if fr.EndStream {
+				return StreamError{StreamID: cs.id, Code: ErrProtocolError}
+			}
+			return nil
+		}
+		cs.resp = cs.newResponse(code, headers)
+		close(cs.respReady)
+	} else {
+		if !fr.EndStream {
+			// trailers must end the stream
+			return StreamError{StreamID: cs.id, Code: ErrProtocolError}
+		}
+		for _, header := range headers {
+			if !strings.HasPrefix(header.Name, ":") {
+				cs.resp.Trailer.Add(http.CanonicalHeaderKey(header.Name), header.Value)
+			}
+		}
+	}
+
+	if fr.EndStream {
+		cs.body.closeWithError(io.EOF)
+		cs.apply(RecvEndStream)
+	}
+	return nil
+}
+
+// headerValue returns the value of the first header called name.
+func headerValue(headers []hpack.Header, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func (cs *clientStream) newResponse(code int, headers []hpack.Header) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        http.Header{},
+		Trailer:       http.Header{},
+		ContentLength: -1,
+		Request:       cs.req,
+		Body:          &clientBody{cs: cs},
+	}
+	for _, header := range headers {
+		if !strings.HasPrefix(header.Name, ":") {
+			resp.Header.Add(http.CanonicalHeaderKey(header.Name), header.Value)
+		}
+	}
+	if cl, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = cl
+	}
+	// declared trailers are listed before they arrive, as net/http does
+	for _, names := range resp.Header["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				resp.Trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+	return resp
+}
+
+func (cs *clientStream) handleData(fr *DataFrame) error {
+	cs.cc.mu.Lock()
+	defer cs.cc.mu.Unlock()
+
+	if cs.resp == nil {
+		return StreamError{StreamID: cs.id, Code: ErrProtocolError}
+	}
+	if !cs.apply(RecvData) {
+		return StreamError{StreamID: cs.id, Code: ErrStreamClosed}
+	}
+	cs.body.write(fr.Data)
+	if fr.EndStream {
+		cs.body.closeWithError(io.EOF)
+		cs.apply(RecvEndStream)
+	}
+	return nil
+}
+
+var _ io.ReadCloser = (*clientBody)(nil)
+
+// clientBody is a response body, handing flow control credit back to the
+// server as it is read.
+type clientBody struct {
+	cs *clientStream
+}
+
+func (b *clientBody) Read(bs []byte) (int, error) {
+	n, err := b.cs.body.Read(bs)
+	b.cs.cc.returnWindow(b.cs, n)
+	return n, err
+}
+
+func (b *clientBody) Close() error {
+	b.cs.cancel(errBodyClosed)
+	unread := b.cs.body.closeRead()
+	b.cs.cc.returnWindow(nil, unread)
+	return nil
+}
+
+// pipe buffers a response body between the reader goroutine and the
+// caller, blocking reads until data or an error arrives.
+type pipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// err is returned once buf is drained, io.EOF after a complete body.
+	err error
+	// readClosed is set once the reader is gone and data is discarded.
+	readClosed bool
+}
+
+func newPipe() *pipe {
+	p := &pipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pipe) Read(bs []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.buf.Len() == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.buf.Len() > 0 {
+		return p.buf.Read(bs)
+	}
+	return 0, p.err
+}
+
+func (p *pipe) write(bs []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.readClosed || p.err != nil {
+		return
+	}
+	p.buf.Write(bs)
+	p.cond.Signal()
+}
+
+func (p *pipe) closeWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+// closeRead discards the buffer and fails further reads, returning how
+// many bytes were never read.
+func (p *pipe) closeRead() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := p.buf.Len()
+	p.buf.Reset()
+	p.readClosed = true
+	p.err = errBodyClosed
+	p.cond.Broadcast()
+	return n
+}
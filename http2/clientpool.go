@@ -0,0 +1,164 @@
+package http2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// settingsTimeout bounds how long a new connection waits for the server's
+// SETTINGS before it is given up on.
+const settingsTimeout = 15 * time.Second
+
+// clientConnPool holds a Transport's connections, keyed by authority.
+// Requests share a connection until the server's
+// SETTINGS_MAX_CONCURRENT_STREAMS is reached, after which another one is
+// dialed.
+type clientConnPool struct {
+	t *Transport
+
+	mu    sync.Mutex
+	conns map[string][]*ClientConn
+	// dialing holds the dial in progress for each authority, which any
+	// request finding no connection waits for rather than dialing its own.
+	dialing map[string]*dialCall
+}
+
+type dialCall struct {
+	done chan struct{}
+	cc   *ClientConn
+	err  error
+}
+
+// available returns a connection to addr that can take another request.
+// Connections idle for longer than HealthCheckAfter are pinged first, and
+// closed if the server doesn't answer within PingTimeout.
+func (p *clientConnPool) available(ctx context.Context, addr string) *ClientConn {
+	for {
+		cc := p.pick(addr)
+		if cc == nil || p.healthy(ctx, cc) {
+			return cc
+		}
+		cc.Close()
+	}
+}
+
+func (p *clientConnPool) pick(addr string) *ClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.conns[addr][:0]
+	var picked *ClientConn
+	for _, cc := range p.conns[addr] {
+		if cc.retired() {
+			// left to close once its last request is done
+			continue
+		}
+		conns = append(conns, cc)
+		if picked == nil && cc.canTakeNewRequest() {
+			picked = cc
+		}
+	}
+	p.setConnsLocked(addr, conns)
+	return picked
+}
+
+func (p *clientConnPool) healthy(ctx context.Context, cc *ClientConn) bool {
+	if p.t.HealthCheckAfter <= 0 || cc.idleFor() < p.t.HealthCheckAfter {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.t.pingTimeout())
+	defer cancel()
+	return cc.Ping(ctx) == nil
+}
+
+// dial returns a new connection to addr, sharing a dial already in
+// progress.
+func (p *clientConnPool) dial(ctx context.Context, addr string) (*ClientConn, error) {
+	p.mu.Lock()
+	call, ok := p.dialing[addr]
+	if !ok {
+		call = &dialCall{done: make(chan struct{})}
+		if p.dialing == nil {
+			p.dialing = map[string]*dialCall{}
+		}
+		p.dialing[addr] = call
+		// not tied to ctx, as other requests may end up waiting for it
+		go p.runDial(call, addr)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.cc, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *clientConnPool) runDial(call *dialCall, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), settingsTimeout)
+	defer cancel()
+
+	call.cc, call.err = p.t.dialClientConn(ctx, addr)
+
+	p.mu.Lock()
+	delete(p.dialing, addr)
+	if call.err == nil {
+		p.addLocked(addr, call.cc)
+	}
+	p.mu.Unlock()
+	close(call.done)
+}
+
+func (p *clientConnPool) add(addr string, cc *ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addLocked(addr, cc)
+}
+
+func (p *clientConnPool) addLocked(addr string, cc *ClientConn) {
+	if p.conns == nil {
+		p.conns = map[string][]*ClientConn{}
+	}
+	p.conns[addr] = append(p.conns[addr], cc)
+}
+
+func (p *clientConnPool) remove(addr string, cc *ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var conns []*ClientConn
+	for _, c := range p.conns[addr] {
+		if c != cc {
+			conns = append(conns, c)
+		}
+	}
+	p.setConnsLocked(addr, conns)
+}
+
+func (p *clientConnPool) setConnsLocked(addr string, conns []*ClientConn) {
+	if len(conns) == 0 {
+		delete(p.conns, addr)
+	} else {
+		p.conns[addr] = conns
+	}
+}
+
+// closeIdle closes the connections with no requests in flight.
+func (p *clientConnPool) closeIdle() {
+	p.mu.Lock()
+	var idle []*ClientConn
+	for _, conns := range p.conns {
+		for _, cc := range conns {
+			if cc.idle() {
+				idle = append(idle, cc)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for _, cc := range idle {
+		cc.Close()
+	}
+}
@@ -0,0 +1,288 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gohttp2 "golang.org/x/net/http2"
+	gohpack "golang.org/x/net/http2/hpack"
+)
+
+// newFakeTransport returns a Transport whose connections go to fake
+// servers, the nth dial being served by serve(n, framer). Headers are read
+// as MetaHeadersFrames.
+func newFakeTransport(t *testing.T, serve func(n int, framer *gohttp2.Framer)) (*Transport, *int32) {
+	t.Helper()
+
+	var dials int32
+	var mu sync.Mutex
+	var servers []net.Conn
+
+	tr := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			n := int(atomic.AddInt32(&dials, 1))
+			server, client := net.Pipe()
+			mu.Lock()
+			servers = append(servers, server)
+			mu.Unlock()
+
+			go serveFake(server, func(framer *gohttp2.Framer) {
+				framer.ReadMetaHeaders = gohpack.NewDecoder(4096, nil)
+				serve(n, framer)
+			})
+			return client, nil
+		},
+	}
+
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+	return tr, &dials
+}
+
+// writeFakeResponse answers streamid with a 200 and body.
+func writeFakeResponse(framer *gohttp2.Framer, streamid uint32, body string) {
+	framer.WriteHeaders(gohttp2.HeadersFrameParam{
+		StreamID:      streamid,
+		BlockFragment: encodeHeaders(":status", "200"),
+		EndHeaders:    true,
+	})
+	framer.WriteData(streamid, true, []byte(body))
+}
+
+func TestPoolMaxConcurrentStreams(t *testing.T) {
+	for _, n := range []int{
+		5,
+		// more than the retry limit's worth of connections
+		2*(maxRetries+1) + 2,
+	} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			testPoolMaxConcurrentStreams(t, n)
+		})
+	}
+}
+
+// testPoolMaxConcurrentStreams sends n requests at once to servers taking
+// two at a time.
+func testPoolMaxConcurrentStreams(t *testing.T, n int) {
+	arrived := make(chan struct{}, n)
+	release := make(chan struct{})
+
+	tr, dials := newFakeTransport(t, func(conn int, framer *gohttp2.Framer) {
+		framer.WriteSettings(gohttp2.Setting{ID: gohttp2.SettingMaxConcurrentStreams, Val: 2})
+
+		var mu sync.Mutex
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			fr, ok := frame.(*gohttp2.MetaHeadersFrame)
+			if !ok {
+				continue
+			}
+			go func(streamid uint32, path string) {
+				if path != "/warmup" {
+					arrived <- struct{}{}
+					<-release
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				writeFakeResponse(framer, streamid, fmt.Sprint(conn))
+			}(fr.StreamID, fr.PseudoValue("path"))
+		}
+	})
+	roundTrip(t, tr, newRequest(t, "GET", "http://example.com/warmup", nil))
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := tr.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d requests arrived", i)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	// two streams on each connection
+	assert.Equal(t, int32((n+1)/2), atomic.LoadInt32(dials))
+}
+
+func TestPoolRetiresOnGoAway(t *testing.T) {
+	closed := make(chan int, 2)
+	tr, dials := newFakeTransport(t, func(conn int, framer *gohttp2.Framer) {
+		framer.WriteSettings()
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				closed <- conn
+				return
+			}
+			if fr, ok := frame.(*gohttp2.MetaHeadersFrame); ok {
+				if conn == 1 {
+					// the stream just opened will still be processed
+					framer.WriteGoAway(fr.StreamID, gohttp2.ErrCodeNo, nil)
+				}
+				writeFakeResponse(framer, fr.StreamID, fmt.Sprint(conn))
+			}
+		}
+	})
+
+	_, body := roundTrip(t, tr, newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, "1", body)
+
+	select {
+	case conn := <-closed:
+		assert.Equal(t, 1, conn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after GOAWAY")
+	}
+
+	_, body = roundTrip(t, tr, newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, "2", body)
+	assert.Equal(t, int32(2), atomic.LoadInt32(dials))
+}
+
+func TestPoolRetriesRefusedRequests(t *testing.T) {
+	tr, dials := newFakeTransport(t, func(conn int, framer *gohttp2.Framer) {
+		framer.WriteSettings()
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch fr := frame.(type) {
+			case *gohttp2.MetaHeadersFrame:
+				if conn%2 == 1 {
+					// nothing was processed
+					framer.WriteGoAway(0, gohttp2.ErrCodeNo, nil)
+					continue
+				}
+				// each connection serves a single request
+				framer.WriteGoAway(fr.StreamID, gohttp2.ErrCodeNo, nil)
+				if fr.StreamEnded() {
+					writeFakeResponse(framer, fr.StreamID, fmt.Sprint(conn))
+				}
+			case *gohttp2.DataFrame:
+				if fr.StreamEnded() {
+					writeFakeResponse(framer, fr.StreamID, fmt.Sprint(conn))
+				}
+			}
+		}
+	})
+
+	_, body := roundTrip(t, tr, newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, "2", body)
+
+	// bytes.Reader bodies can be rewound with GetBody
+	_, body = roundTrip(t, tr, newRequest(t, "POST", "http://example.com/", bytes.NewReader([]byte("hello"))))
+	assert.Equal(t, "4", body)
+
+	req := newRequest(t, "POST", "http://example.com/", io.NopCloser(strings.NewReader("hello")))
+	_, err := tr.RoundTrip(req)
+	assert.Equal(t, errStreamRefused, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(dials))
+}
+
+func TestPoolRetriesAreBounded(t *testing.T) {
+	tr, dials := newFakeTransport(t, func(conn int, framer *gohttp2.Framer) {
+		// no connection ever takes a request, each turning it away unsent
+		framer.WriteSettings(gohttp2.Setting{ID: gohttp2.SettingMaxConcurrentStreams, Val: 0})
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+
+	_, err := tr.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, errClientConnUnusable, err)
+	assert.Equal(t, int32(maxRetries+1), atomic.LoadInt32(dials))
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	tr, dials := newFakeTransport(t, func(conn int, framer *gohttp2.Framer) {
+		framer.WriteSettings()
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch fr := frame.(type) {
+			case *gohttp2.MetaHeadersFrame:
+				writeFakeResponse(framer, fr.StreamID, fmt.Sprint(conn))
+			case *gohttp2.PingFrame:
+				// the first connection has gone quiet
+				if conn > 1 && !fr.IsAck() {
+					framer.WritePing(true, fr.Data)
+				}
+			}
+		}
+	})
+	tr.HealthCheckAfter = time.Millisecond
+	tr.PingTimeout = 50 * time.Millisecond
+
+	_, body := roundTrip(t, tr, newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, "1", body)
+	time.Sleep(5 * time.Millisecond)
+
+	_, body = roundTrip(t, tr, newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, "2", body)
+	time.Sleep(5 * time.Millisecond)
+
+	// a healthy connection is reused
+	_, body = roundTrip(t, tr, newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, "2", body)
+	assert.Equal(t, int32(2), atomic.LoadInt32(dials))
+}
+
+func TestClientConnPing(t *testing.T) {
+	tr, _ := newTestTransport(t, echoHandler)
+	conn, err := tr.DialContext(context.Background(), "tcp", "example.com:80")
+	require.NoError(t, err)
+	cc, err := tr.NewClientConn(conn)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, cc.Ping(context.Background()))
+	}
+
+	quiet := newFakeServer(t, func(framer *gohttp2.Framer) {})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, quiet.Ping(ctx), context.DeadlineExceeded)
+
+	resp, err := cc.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -4,15 +4,43 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jakegut/goh2/hpack"
 	"github.com/jakegut/goh2/http11"
 )
 
+// ClientPreface starts every HTTP/2 connection (RFC 9113 §3.4).
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	defaultMaxHeaderListSize     = 64 << 10
+	defaultMaxContinuationFrames = 16
+	defaultMaxConcurrentStreams  = 100
+	// defaultMaxUpgradeBodySize bounds the body of an h2c upgrade request,
+	// which is buffered whole before switching protocols, when
+	// MaxRequestBodySize doesn't.
+	defaultMaxUpgradeBodySize = 1 << 20
+)
+
+// initialWindowSize is the receive window of the connection and of every
+// stream. We never advertise another, so it stays the RFC 9113 default and
+// bounds how much of a request body is buffered ahead of its handler.
+const initialWindowSize = 65535
+
+// maxRecentlyClosedStreams bounds how many closed streams are remembered for
+// tolerating late DATA on streams we reset.
+const maxRecentlyClosedStreams = 128
+
 type Connection struct {
 	net.Conn
 
@@ -27,127 +55,322 @@ type Connection struct {
 
 	windowSize uint32
 
-	streamMu       sync.Mutex
-	streamHandlers map[uint32]chan Frame
-	streamEvents   chan StreamEvent
+	// flowMu guards the connection's receive window: recvWindow is how
+	// much DATA the client may still send, and recvUnacked how much has
+	// been consumed since the last WINDOW_UPDATE.
+	flowMu      sync.Mutex
+	recvWindow  int
+	recvUnacked int
+
+	streamMu     sync.Mutex
+	streams      map[uint32]*Stream
+	streamEvents chan StreamEvent
+
+	// closedStreams remembers the most recently closed streams, in
+	// closedOrder, mapped to whether we reset them ourselves.
+	closedStreams map[uint32]bool
+	closedOrder   []uint32
 
 	Handler HandlerFunc
 
+	// Logger receives the connection's diagnostics. Nothing is logged if
+	// it is nil.
+	Logger Logger
+
+	// log is Logger, or a silent logger, adding id as "conn" to every
+	// record.
+	id  uint64
+	log Logger
+
+	// Trace, if set, is told about every frame read and written and the
+	// changes they make to the connection. See NewTextTrace.
+	Trace *ConnectionTrace
+
+	// Metrics, if set, collects metrics about the connection, usually
+	// along with other connections.
+	Metrics *Metrics
+
+	// decoderTable and encoderTable are the HPACK table sizes last
+	// reported to Trace and Metrics.
+	decoderTable hpackTableSize
+	encoderTable hpackTableSize
+
+	// MaxHeaderListSize is advertised as SETTINGS_MAX_HEADER_LIST_SIZE and
+	// enforced while decoding every header block. Requests exceeding it are
+	// answered with a 431 response. Defaults to 64KiB.
+	MaxHeaderListSize uint32
+
+	// MaxConcurrentStreams is advertised as SETTINGS_MAX_CONCURRENT_STREAMS.
+	// Streams the client opens beyond it are refused with REFUSED_STREAM.
+	// Defaults to 100.
+	MaxConcurrentStreams uint32
+
+	// MaxRequestBodySize bounds the body of plain HTTP/1.1 requests and h2c
+	// upgrade requests. Reading past it fails with http11.ErrBodyTooLarge.
+	// Zero means no limit, except for the bodies of h2c upgrade requests,
+	// which are read in full up front and limited to 1MiB.
+	MaxRequestBodySize int64
+
+	// MaxContinuationFrames bounds the number of CONTINUATION frames that
+	// may follow a HEADERS frame before the connection is closed with
+	// ENHANCE_YOUR_CALM. Defaults to 16.
+	MaxContinuationFrames int
+
+	// ResetLimit, PingLimit, SettingsLimit and EmptyFrameLimit bound how
+	// often the client may reset streams, send PING or SETTINGS frames, and
+	// send DATA, HEADERS or CONTINUATION frames carrying nothing, each of
+	// which costs the server more than the client. Exceeding one closes the
+	// connection with ENHANCE_YOUR_CALM. Zero values use limits no
+	// well-behaved client gets near.
+	ResetLimit      FloodLimit
+	PingLimit       FloodLimit
+	SettingsLimit   FloodLimit
+	EmptyFrameLimit FloodLimit
+
+	// IdleTimeout closes the connection with GOAWAY once it has had no open
+	// streams for this long. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// ReadIdleTimeout is how long the connection may go without receiving
+	// a frame before the client is checked on with a PING. Zero disables
+	// the check.
+	ReadIdleTimeout time.Duration
+
+	// PingTimeout bounds how long that PING may go unacknowledged before
+	// the connection is closed. Defaults to 15 seconds.
+	PingTimeout time.Duration
+
+	// ReadHeaderTimeout is how long a client has to finish the header block
+	// of a request, from its HEADERS frame to END_HEADERS. As no other frame
+	// may be read meanwhile, the connection is closed with
+	// ENHANCE_YOUR_CALM if it doesn't. Zero means no timeout.
+	ReadHeaderTimeout time.Duration
+
+	// ReadBodyTimeout is how long a client has to send a request body once
+	// its headers have arrived. Reading the rest of the body then fails with
+	// os.ErrDeadlineExceeded and the stream is reset with CANCEL. Zero
+	// means no timeout.
+	ReadBodyTimeout time.Duration
+
+	// WriteTimeout bounds each response, from the request headers arriving
+	// until the response has been sent, after which the stream is reset
+	// with CANCEL. It also bounds every single write to the connection,
+	// a client not reading for that long closing the connection. Zero
+	// means no timeout.
+	WriteTimeout time.Duration
+
+	// lastRead is when the last frame was read, in Unix nanoseconds.
+	lastRead atomic.Int64
+	// idleSince is when the last open stream closed, guarded by streamMu.
+	idleSince time.Time
+	// idleChanged is signalled when the last open stream closes.
+	idleChanged chan struct{}
+
+	// pings maps the payload of each PING we sent to the channel closed by
+	// its acknowledgement. It is nil until the connection speaks HTTP/2.
+	pingMu  sync.Mutex
+	pings   map[[8]byte]chan struct{}
+	pingSeq uint64
+
+	// stopErr is set by stop and returned by the reader loop.
+	stopMu  sync.Mutex
+	stopErr error
+
+	// writeErr is set by the writer once a write fails, after which
+	// nothing more is written.
+	writeErr error
+
+	// flood accounts for the frames limited above, in the reader loop.
+	flood floodBuckets
+
+	// handlers runs the handlers, shared with the other connections of a
+	// Server. Without one each handler gets a goroutine of its own.
+	handlers *handlerPool
+
+	// done is closed once the connection is shutting down, releasing any
+	// stream goroutines still waiting on frames or the writer.
+	done <-chan struct{}
+
 	writerWG sync.WaitGroup
+	streamWG sync.WaitGroup
 }
 
 func (c *Connection) Handle() {
 	ctx, cancel := context.WithCancel(context.Background())
+	c.initLogger()
+	c.log.Info("serving connection", "remote", c.Conn.RemoteAddr().String())
+	if c.Metrics != nil {
+		c.Conn = meteredConn{Conn: c.Conn, m: c.Metrics}
+	}
+	c.Metrics.connOpened()
 
+	// closeCode is the code of the GOAWAY we close the connection with,
+	// which ends the streams still open.
+	closeCode := ErrNoError
 	defer func() {
-		log.Printf("closing connection")
+		c.log.Debug("closing connection")
 		cancel()
+		c.handlers.cancel(c.done)
+		c.abandonStreams(closeCode)
 		c.writerWG.Wait()
-		close(c.streamEvents)
 		if err := c.Conn.Close(); err != nil {
-			log.Printf("error closing connection: %s", err)
+			c.log.Error("closing connection failed", "err", err)
 		}
-		log.Printf("connection closed")
+		c.streamWG.Wait()
+		c.Metrics.connClosed(c.decoderTable, c.encoderTable)
+		c.log.Info("connection closed")
 	}()
 
 	c.bufreader = bufio.NewReader(c)
-	c.streamHandlers = map[uint32]chan Frame{}
+	c.streams = map[uint32]*Stream{}
+	c.closedStreams = map[uint32]bool{}
+	if c.MaxHeaderListSize == 0 {
+		c.MaxHeaderListSize = defaultMaxHeaderListSize
+	}
+	if c.MaxContinuationFrames == 0 {
+		c.MaxContinuationFrames = defaultMaxContinuationFrames
+	}
+	if c.MaxConcurrentStreams == 0 {
+		c.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	c.initFloodBuckets()
+	c.recvWindow = initialWindowSize
+
 	c.hpackDecoder = hpack.Decoder()
+	c.hpackDecoder.SetMaxHeaderListSize(int(c.MaxHeaderListSize))
+	c.hpackDecoder.SetNameInterning(true)
 	c.hpackEncoder = &hpack.HPackEncoder{}
+	c.initHPACKTables()
 	c.streamEvents = make(chan StreamEvent, 8)
+	c.idleChanged = make(chan struct{}, 1)
+	c.done = ctx.Done()
 
-	if err := c.handleHandshake(); err != nil {
-		log.Printf("handling handshake: %s", err)
+	c.writerWG.Add(1)
+	go c.handleStreamEvents(ctx)
+
+	h1 := &http11.HTTP11Request{}
+	if err := h1.UnmarshalReaderWithLimits(c.bufreader, c.http11Limits()); err != nil {
+		c.badHTTP11Request(err)
+		return
+	}
+	if h1.Method != "PRI" && !isH2CUpgrade(h1) {
+		c.serveHTTP11(h1)
 		return
 	}
 
-	c.writerWG.Add(1)
-	go c.handleStreamEvents(ctx)
-	if err := c.handleH2(); err != nil {
-		if err == ErrConnProtocolError {
-			c.writeFrame(&GoAwayFrame{
-				LastStreamID: c.maxStreamId,
-				ErrorCode:    ErrProtocolError,
-			})
-		} else if err == ErrConnStreamError {
+	err := c.handleHandshake(h1)
+	if err == nil {
+		c.startKeepalive(ctx)
+		err = c.handleH2()
+	}
+	if err != nil {
+		var connErr ConnectionError
+		switch {
+		case errors.As(err, &connErr) && connErr.Code == ErrNoError:
+			c.log.Info("closing connection with GOAWAY", "code", connErr.Code, "err", err)
+		case errors.As(err, &connErr):
+			c.log.Warn("closing connection with GOAWAY", "code", connErr.Code, "err", err)
+		default:
+			c.log.Debug("connection ended", "err", err)
+		}
+		if errors.As(err, &connErr) {
+			closeCode = connErr.Code
 			c.writeFrame(&GoAwayFrame{
 				LastStreamID: c.maxStreamId,
-				ErrorCode:    ErrStreamClosed,
+				ErrorCode:    connErr.Code,
+				Opaque:       []byte(connErr.Reason),
 			})
 		}
-		log.Printf("handling: %s", err)
-		return
 	}
 }
 
-func (c *Connection) handleHandshake() error {
+// isH2CUpgrade reports whether h1 asks to upgrade to h2c as described in
+// RFC 7540 §3.2. Anything else, including requests with more than one
+// HTTP2-Settings, is served as HTTP/1.1.
+func isH2CUpgrade(h1 *http11.HTTP11Request) bool {
+	settings, ok := h1.Headers["http2-settings"]
+	return h1.Protocol == "HTTP/1.1" &&
+		hasToken(h1.Headers["upgrade"], "h2c") &&
+		hasToken(h1.Headers["connection"], "upgrade") &&
+		hasToken(h1.Headers["connection"], "http2-settings") &&
+		ok && !strings.Contains(settings, ",")
+}
+
+// handleHandshake starts HTTP/2 after h1, which is either the start of the
+// client preface or an HTTP/1.1 request asking to upgrade to h2c.
+func (c *Connection) handleHandshake(h1 *http11.HTTP11Request) error {
 	if c.settings == nil {
 		c.settings = NewSettings()
 	}
 	c.windowSize = c.settings.InitialWindowSize
-	h1 := &http11.HTTP11Request{}
-	if err := h1.UnmarshalReader(c.bufreader); err != nil {
-		return err
-	}
 
 	if h1.Method == "PRI" {
-		initSettings := &SettingsFrame{
-			Ack:  false,
-			Args: make([]SettingFrameArgs, 0),
-		}
-
-		bs, _ := initSettings.Encode()
+		settings := c.initialSettings()
+		bs, _ := settings.Encode()
 
-		c.Write(bs)
+		if _, err := c.Write(bs); err != nil {
+			return err
+		}
+		c.wroteFrame(settings)
 
 		return nil
 	}
 
-	if h1.Headers["upgrade"] != "h2c" {
-		return fmt.Errorf("expected 'h2c' in upgrade, got: %q", h1.Headers["upgrade"])
+	// the request is answered as HTTP/1.1 until we agree to switch
+	settingsPayload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(h1.Headers["http2-settings"], "="))
+	if err == nil {
+		err = c.settings.DecodePayload(settingsPayload)
 	}
-
-	settings, ok := h1.Headers["http2-settings"]
-	if !ok {
-		return fmt.Errorf("expected 'http2-settings' header")
+	if err != nil {
+		err = fmt.Errorf("invalid HTTP2-Settings: %w", err)
+		c.badHTTP11Request(err)
+		return err
 	}
+	c.Trace.settingsChanged(c.settings)
 
-	settingsPayload, err := base64.RawURLEncoding.DecodeString(settings)
+	// the body precedes the client preface, so it's read up front
+	limit := c.MaxRequestBodySize
+	if limit == 0 {
+		limit = defaultMaxUpgradeBodySize
+	}
+	body, err := io.ReadAll(io.LimitReader(h1.Body, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		err = http11.ErrBodyTooLarge
+	}
 	if err != nil {
+		c.badHTTP11Request(err)
 		return err
 	}
 
-	c.settings.DecodePayload(settingsPayload)
-
-	resp := http11.HTTP11Request{
-		Method:   "HTTP/1.1",
-		Path:     "101",
-		Protocol: "Switching Protocols",
+	resp := http11.Response{
+		StatusCode: http.StatusSwitchingProtocols,
 		Headers: map[string]string{
 			"Connection": "Upgrade",
 			"Upgrade":    "h2c",
 		},
 	}
+	if _, err := c.Write(resp.Marshal()); err != nil {
+		return err
+	}
+	c.streamEvents <- headerTableSizeEvent{Size: c.settings.HeaderTableSize}
 
-	bs := resp.Marshal()
-
+	settings := c.initialSettings()
+	bs, _ := settings.Encode()
 	if _, err := c.Write(bs); err != nil {
 		return err
 	}
+	c.wroteFrame(settings)
 
-	initSettings := &SettingsFrame{
-		Ack:  false,
-		Args: make([]SettingFrameArgs, 0),
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(c.bufreader, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return connError(ErrProtocolError, "invalid client preface %q", preface)
 	}
 
-	bs, _ = initSettings.Encode()
-
-	c.Write(bs)
-
-	// discard magic string (client preface)
-
-	c.bufreader.Read(make([]byte, 24))
-
+	// the upgrade request becomes stream 1, half-closed (remote) once its
+	// body has been replayed
 	c.newStream(1)
 
 	initHeaders := &HeadersFrame{
@@ -156,149 +379,473 @@ func (c *Connection) handleHandshake() error {
 				StreamID: 1,
 			},
 		},
-		EndStream:  h1.Body == nil,
+		EndStream:  len(body) == 0,
 		EndHeaders: true,
 		Headers:    h1.H2Headers(),
 	}
 
 	c.sendToStream(1, initHeaders)
 
-	if h1.Body != nil {
-		maxLen := int(c.settings.MaxFrameSize)
-
-		bs := h1.Body
-		for len(bs) > 0 {
-			mx := maxLen
-			if len(bs) < mx {
-				mx = len(bs)
-			}
+	maxLen := int(c.settings.MaxFrameSize)
+	for len(body) > 0 {
+		mx := maxLen
+		if len(body) < mx {
+			mx = len(body)
+		}
 
-			df := &DataFrame{
-				Framed: Framed{
-					Header: FrameHeader{
-						StreamID: 1,
-					},
+		df := &DataFrame{
+			Framed: Framed{
+				Header: FrameHeader{
+					StreamID: 1,
 				},
-				EndStream: mx < maxLen,
-				Data:      bs[:mx],
-			}
+			},
+			EndStream: mx == len(body),
+			Data:      body[:mx],
+		}
 
-			c.sendToStream(1, df)
+		c.sendToStream(1, df)
 
-			bs = bs[mx:]
-		}
+		body = body[mx:]
 	}
 
 	return nil
 }
 
+// initialSettings is the SETTINGS frame we open the connection with.
+func (c *Connection) initialSettings() *SettingsFrame {
+	return &SettingsFrame{
+		Ack: false,
+		Args: []SettingFrameArgs{
+			{Param: SettingsMaxConcurrentStreams, Value: c.MaxConcurrentStreams},
+			{Param: SettingsMaxHeaderListSize, Value: c.MaxHeaderListSize},
+		},
+	}
+}
+
 func (c *Connection) readFrame() (Frame, error) {
-	frame, err := ParseFrame(c.bufreader, c.settings.MaxFrameSize)
-	if err != nil {
-		if err == ErrExceedsMaxFrameSize {
-			c.writeFrame(&GoAwayFrame{
-				LastStreamID: c.maxStreamId,
-				ErrorCode:    ErrFrameSizeError,
-			})
-			return nil, err
-		} else if err == ErrUnknownFrame {
-			return nil, nil
-		} else {
-			return nil, err
-		}
+	// we never advertise SETTINGS_MAX_FRAME_SIZE, so frames are held to the
+	// default whatever the client allows us to send
+	frame, err := ParseFrame(c.bufreader, defaultMaxFrameSize)
+	if stopErr := c.stopped(); stopErr != nil {
+		return nil, stopErr
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+	if err == ErrUnknownFrame {
+		c.log.Debug("ignoring frame of unknown type")
+		c.Metrics.frameRead(FrameType(frameTypeCount))
+		return nil, nil
+	}
+	if err == nil {
+		c.log.Debug("read frame", "stream", frame.Header().StreamID, "frame", frameTypeOf(frame), "length", frame.Header().Length)
+		c.Metrics.frameRead(frameTypeOf(frame))
+		c.Trace.frameRead(frame)
 	}
-	return frame, nil
+	return frame, err
 }
 
+// wroteFrame reports a frame once it has been written.
+func (c *Connection) wroteFrame(frame Frame) {
+	c.Metrics.frameWritten(frameTypeOf(frame))
+	c.Trace.frameWritten(frame)
+	if goAway, ok := frame.(*GoAwayFrame); ok {
+		c.Trace.goAway(goAway, true)
+	}
+}
+
+// handleH2 runs the reader loop until the connection fails. Stream errors
+// are answered with RST_STREAM and the loop carries on; any other error is
+// returned and ends the connection.
 func (c *Connection) handleH2() error {
 	for {
 		frame, err := c.readFrame()
+		if err == nil {
+			err = c.handleFrame(frame)
+		}
+
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			c.log.Warn("resetting stream", "stream", streamErr.StreamID, "code", streamErr.Code)
+			c.resetStream(streamErr.StreamID, streamErr.Code)
+			continue
+		}
 		if err != nil {
 			return err
 		}
+	}
+}
 
-		if frame.Header().StreamID > 0 && frame.Header().StreamID%2 == 0 {
-			return ErrConnProtocolError
+// decodeHeaderFragment feeds part of a header block to the HPACK decoder.
+func (c *Connection) decodeHeaderFragment(fragment []byte) error {
+	if _, err := c.hpackDecoder.Write(fragment); err != nil {
+		return connError(ErrCompressionError, "decoding header block: %s", err)
+	}
+	return nil
+}
+
+func (c *Connection) handleFrame(frame Frame) error {
+	if frame == nil {
+		return nil
+	}
+	if err := c.checkFlood(frame); err != nil {
+		return err
+	}
+
+	switch fr := frame.(type) {
+	case *HeadersFrame:
+		tooLarge, err := c.readHeaderBlock(fr)
+		if err != nil {
+			return err
 		}
+		c.noteHPACKTable(false)
+		if tooLarge {
+			return c.rejectHeaderList(fr)
+		}
+	case *ContinuationFrame:
+		return connError(ErrProtocolError, "unexpected CONTINUATION on stream %d", fr.Header().StreamID)
+	case *PushPromiseFrame:
+		return connError(ErrProtocolError, "clients cannot push")
+	case *SettingsFrame:
+		if !fr.Ack {
+			for _, args := range fr.Args {
+				if err := c.settings.SetValue(args.Param, args.Value); err != nil {
+					return err
+				}
+				if args.Param == SettingsHeaderTableSize {
+					c.streamEvents <- headerTableSizeEvent{Size: args.Value}
+				}
+			}
+			c.Trace.settingsChanged(c.settings)
 
-		switch fr := frame.(type) {
-		case *HeadersFrame:
-			headers, err := c.hpackDecoder.Decode(fr.BlockFragment)
-			if err != nil {
-				return err
+			set := &SettingsFrame{
+				Ack: true,
 			}
-			fr.Headers = headers
 
-			streamId := fr.Header().StreamID
-			endHeaders := fr.EndHeaders
+			c.writeFrame(set)
+		}
+	case *PingFrame:
+		if !fr.Ack {
+			fr.Ack = true
 
-			for !endHeaders {
-				frame, err := c.readFrame()
-				if err != nil {
-					return err
-				}
+			c.writeFrame(fr)
+		} else {
+			c.handlePingAck(fr)
+		}
+	case *GoAwayFrame:
+		c.log.Info("received GOAWAY", "last_stream", fr.LastStreamID, "code", fr.ErrorCode)
+		c.Trace.goAway(fr, false)
+	case *WindowUpdateFrame:
+		c.log.Debug("ignoring WINDOW_UPDATE", "stream", fr.Header().StreamID, "increment", fr.SizeIncrement)
+	case *DataFrame:
+		if err := c.takeWindow(fr); err != nil {
+			return err
+		}
+	}
 
-				continuationFrame, ok := frame.(*ContinuationFrame)
-				if !ok {
-					return ErrConnProtocolError
-				}
+	if frame.Header().StreamID > 0 {
+		return c.handleStreamFrame(frame)
+	}
 
-				if streamId != continuationFrame.Header().StreamID {
-					return ErrConnProtocolError
-				}
+	return nil
+}
 
-				contHeaders, err := c.hpackDecoder.Decode(continuationFrame.BlockFragment)
-				if err != nil {
-					return err
-				}
-				fr.Headers = append(fr.Headers, contHeaders...)
+// takeWindow charges fr against the connection's receive window. The
+// credit is handed back by returnWindow once the stream is done with the
+// data, so a client can't make us buffer more than a window's worth.
+func (c *Connection) takeWindow(fr *DataFrame) error {
+	size := len(fr.Framed.Payload)
 
-				endHeaders = continuationFrame.EndHeaders
-			}
+	c.flowMu.Lock()
+	defer c.flowMu.Unlock()
 
-			fr.EndHeaders = true
+	if size > c.recvWindow {
+		return connError(ErrFlowControlError, "DATA on stream %d overflows the connection window", fr.Header().StreamID)
+	}
+	c.recvWindow -= size
+	if size > 0 && c.recvWindow == 0 {
+		c.Metrics.flowControlStall(false)
+	}
+	return nil
+}
 
-			log.Printf("creating new stream for %d", fr.Header().StreamID)
+// returnWindow acknowledges n bytes of DATA consumed on the connection.
+// WINDOW_UPDATE frames are only sent once half a window is due, to avoid
+// a frame per read. It is called by handlers reading request bodies too.
+func (c *Connection) returnWindow(n int) {
+	if n <= 0 {
+		return
+	}
 
-			c.newStream(fr.Header().StreamID)
+	c.flowMu.Lock()
+	c.recvUnacked += n
+	increment := 0
+	if c.recvUnacked >= initialWindowSize/2 {
+		increment = c.recvUnacked
+		c.recvWindow += increment
+		c.recvUnacked = 0
+	}
+	c.flowMu.Unlock()
 
-		case *SettingsFrame:
-			if !fr.Ack {
-				for _, args := range fr.Args {
-					c.settings.SetValue(args.Param, args.Value)
-				}
+	if increment == 0 {
+		return
+	}
+	select {
+	case c.streamEvents <- StreamOutgoingFrameEvent{Frame: &WindowUpdateFrame{SizeIncrement: uint32(increment)}}:
+	case <-c.done:
+	}
+}
 
-				set := &SettingsFrame{
-					Ack: true,
-				}
+// readHeaderBlock reads any CONTINUATION frames following fr and decodes
+// the complete header block into fr.Headers. Fragments are decoded as they
+// arrive, the decoder keeping any header field split across frames. This
+// must happen for every header block, even ones that end up ignored, to
+// keep HPACK state in sync. It reports whether the header list exceeded
+// MaxHeaderListSize, in which case fr.Headers is left empty.
+func (c *Connection) readHeaderBlock(fr *HeadersFrame) (tooLarge bool, err error) {
+	streamId := fr.Header().StreamID
+	maxBlockSize := c.maxHeaderBlockSize()
+	blockSize := len(fr.BlockFragment)
+	continuations := 0
+
+	var headers []hpack.Header
+	c.hpackDecoder.SetEmitFunc(func(header hpack.Header) {
+		headers = append(headers, header)
+	})
+	defer func() {
+		if err != nil {
+			// drop the rest of the abandoned block
+			c.hpackDecoder.Close()
+		}
+	}()
+	if err := c.decodeHeaderFragment(fr.BlockFragment); err != nil {
+		return false, err
+	}
 
-				c.writeFrame(set)
-			}
-		case *PingFrame:
-			if !fr.Ack {
-				fr.Ack = true
+	if !fr.EndHeaders && c.ReadHeaderTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.ReadHeaderTimeout))
+		defer c.clearReadDeadline()
+	}
 
-				// TODO: handle length != 8
+	for endHeaders := fr.EndHeaders; !endHeaders; {
+		frame, err := c.readFrame()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, connError(ErrEnhanceYourCalm, "header block not finished within %s", c.ReadHeaderTimeout)
+		}
+		if err != nil {
+			return false, headerBlockError(streamId, err)
+		}
 
-				c.writeFrame(fr)
-			}
-		case *WindowUpdateFrame:
-			fmt.Println("HANDLE WINDOW UPDATE WHOOOPS")
-		case nil:
-			continue
+		continuationFrame, ok := frame.(*ContinuationFrame)
+		if !ok {
+			return false, connError(ErrProtocolError, "expected CONTINUATION, got %T", frame)
 		}
 
-		if frame.Header().StreamID > 0 {
-			if !c.sendToStream(frame.Header().StreamID, frame) {
-				// if it's a lower streamid that's not present in the handlers, then it's closed with a STREAM_CLOSED error
-				if c.maxStreamId >= frame.Header().StreamID {
-					return ErrConnStreamError
-				} else {
-					return ErrConnProtocolError
-				}
+		if streamId != continuationFrame.Header().StreamID {
+			return false, connError(ErrProtocolError, "CONTINUATION for stream %d interleaved with stream %d", continuationFrame.Header().StreamID, streamId)
+		}
+
+		if err := c.checkFlood(continuationFrame); err != nil {
+			return false, err
+		}
+		continuations++
+		if continuations > c.MaxContinuationFrames {
+			return false, connError(ErrEnhanceYourCalm, "more than %d CONTINUATION frames", c.MaxContinuationFrames)
+		}
+
+		blockSize += len(continuationFrame.BlockFragment)
+		if blockSize > maxBlockSize {
+			return false, connError(ErrEnhanceYourCalm, "header block exceeds %d bytes", maxBlockSize)
+		}
+		if err := c.decodeHeaderFragment(continuationFrame.BlockFragment); err != nil {
+			return false, err
+		}
+
+		endHeaders = continuationFrame.EndHeaders
+	}
+
+	fr.EndHeaders = true
+
+	err = c.hpackDecoder.Close()
+	if err == hpack.ErrHeaderListTooLarge {
+		return true, nil
+	}
+	if err != nil {
+		return false, connError(ErrCompressionError, "decoding header block: %s", err)
+	}
+	fr.Headers = headers
+	c.Metrics.headerBlock(false, headerListSize(headers), blockSize)
+	c.Trace.headersRead(streamId, headers)
+	return false, nil
+}
+
+// headerBlockError turns an error reading the frames of an unfinished
+// header block into a connection error. Nothing but CONTINUATION may come
+// before the block ends, and the HPACK decoder can't carry on past an
+// abandoned block, so a stream error can't just reset the stream.
+func headerBlockError(streamid uint32, err error) error {
+	var streamErr StreamError
+	if errors.As(err, &streamErr) || err == ErrUnknownFrame {
+		return connError(ErrProtocolError, "invalid frame inside the header block of stream %d: %s", streamid, err)
+	}
+	return err
+}
+
+// maxHeaderBlockSize bounds the encoded size of a header block.
+// HPACK rarely makes a header list larger than its plain size, so anything
+// well beyond MaxHeaderListSize can't be a header list we would accept.
+func (c *Connection) maxHeaderBlockSize() int {
+	return 2 * int(c.MaxHeaderListSize)
+}
+
+// rejectHeaderList answers a header block that exceeded MaxHeaderListSize.
+// New requests get a 431 response without ever reaching a handler, followed
+// by RST_STREAM(NO_ERROR) if the client was still going to send a body;
+// oversized trailers reset their stream.
+func (c *Connection) rejectHeaderList(fr *HeadersFrame) error {
+	streamid := fr.Header().StreamID
+	c.log.Warn("header list too large", "stream", streamid, "limit", c.MaxHeaderListSize)
+
+	if streamid <= c.maxStreamId {
+		c.streamMu.Lock()
+		_, active := c.streams[streamid]
+		c.streamMu.Unlock()
+		if active {
+			return StreamError{StreamID: streamid, Code: ErrProtocolError}
+		}
+		return c.handleClosedStreamFrame(fr)
+	}
+
+	if streamid%2 == 0 {
+		return connError(ErrProtocolError, "client opened even stream %d", streamid)
+	}
+
+	c.streamMu.Lock()
+	c.maxStreamId = streamid
+	c.streamMu.Unlock()
+
+	c.writeFrame(&HeadersFrame{
+		Framed: Framed{
+			Header: FrameHeader{
+				StreamID: streamid,
+			},
+		},
+		EndStream:  true,
+		EndHeaders: true,
+		Headers: []hpack.Header{
+			hpack.NewHeader(":status", fmt.Sprintf("%d", http.StatusRequestHeaderFieldsTooLarge)),
+		},
+	})
+
+	if fr.EndStream {
+		c.markStreamClosed(streamid, false)
+		return nil
+	}
+
+	c.writeFrame(&RSTStreamFrame{
+		Framed: Framed{
+			Header: FrameHeader{
+				StreamID: streamid,
+			},
+		},
+		ErrorCode: ErrNoError,
+	})
+	c.markStreamClosed(streamid, true)
+	return nil
+}
+
+func (c *Connection) streamCount() int {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	return len(c.streams)
+}
+
+// refuseStream turns away a stream opened beyond MaxConcurrentStreams
+// with REFUSED_STREAM, telling the client it may retry the request.
+func (c *Connection) refuseStream(streamid uint32) {
+	c.log.Info("refusing stream", "stream", streamid, "limit", c.MaxConcurrentStreams)
+
+	c.streamMu.Lock()
+	c.maxStreamId = streamid
+	c.streamMu.Unlock()
+
+	c.writeFrame(&RSTStreamFrame{
+		Framed: Framed{
+			Header: FrameHeader{
+				StreamID: streamid,
+			},
+		},
+		ErrorCode: ErrRefusedStream,
+	})
+	c.markStreamClosed(streamid, true)
+}
+
+// handleStreamFrame routes a frame to its stream, enforcing the stream
+// identifier and state rules of RFC 9113 §5.1 for streams that are idle or
+// already closed.
+func (c *Connection) handleStreamFrame(frame Frame) error {
+	streamid := frame.Header().StreamID
+
+	if streamid > c.maxStreamId {
+		switch frame.(type) {
+		case *HeadersFrame:
+			if streamid%2 == 0 {
+				return connError(ErrProtocolError, "client opened even stream %d", streamid)
 			}
+			if c.streamCount() >= int(c.MaxConcurrentStreams) {
+				c.refuseStream(streamid)
+				return nil
+			}
+			c.log.Debug("opening stream", "stream", streamid)
+			c.newStream(streamid)
+		case *PriorityFrame:
+			// allowed on idle streams, and we don't act on priorities
+			return nil
+		default:
+			return connError(ErrProtocolError, "%T on idle stream %d", frame, streamid)
 		}
 	}
+
+	if _, ok := frame.(*PriorityFrame); ok {
+		return nil
+	}
+
+	if c.sendToStream(streamid, frame) {
+		return nil
+	}
+
+	if fr, ok := frame.(*DataFrame); ok {
+		// dropped, but the connection window still counts it
+		c.returnWindow(len(fr.Framed.Payload))
+	}
+	return c.handleClosedStreamFrame(frame)
+}
+
+func (c *Connection) handleClosedStreamFrame(frame Frame) error {
+	streamid := frame.Header().StreamID
+
+	switch frame.(type) {
+	case *WindowUpdateFrame, *RSTStreamFrame:
+		// may have been in flight when the stream closed, however long
+		// ago that was (RFC 9113 §6.9)
+		return nil
+	}
+
+	c.streamMu.Lock()
+	reset, recent := c.closedStreams[streamid]
+	c.streamMu.Unlock()
+
+	if !recent {
+		if _, ok := frame.(*HeadersFrame); ok {
+			return connError(ErrProtocolError, "stream %d opened out of order", streamid)
+		}
+		return connError(ErrStreamClosed, "%T on closed stream %d", frame, streamid)
+	}
+
+	if reset {
+		// the peer may not have seen our RST_STREAM yet
+		return nil
+	}
+
+	return connError(ErrStreamClosed, "%T on closed stream %d", frame, streamid)
 }
 
 func (c *Connection) handleStreamEvents(ctx context.Context) {
@@ -306,36 +853,70 @@ func (c *Connection) handleStreamEvents(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			return
-		case event := <-c.streamEvents:
-			switch ev := event.(type) {
-			case StreamOutgoingFrameEvent:
-				frame := ev.Frame
-				if headerFrame, ok := frame.(*HeadersFrame); ok {
-					fmt.Printf("headers: %+v\n", headerFrame.Headers)
-					payload, _ := c.hpackEncoder.Encode(headerFrame.Headers)
-					headerFrame.BlockFragment = payload
-					frame = headerFrame
+			// flush whatever was queued before shutdown, e.g. a final GOAWAY
+			for {
+				select {
+				case event := <-c.streamEvents:
+					c.handleStreamEvent(event)
+				default:
+					return
 				}
+			}
+		case event := <-c.streamEvents:
+			c.handleStreamEvent(event)
+		}
+	}
+}
 
-				fmt.Printf("encoding frame: %T\n", frame)
+// headerTableSizeEvent applies the peer's SETTINGS_HEADER_TABLE_SIZE to
+// the HPACK encoder. It goes through the writer so it is ordered with the
+// header blocks being encoded.
+type headerTableSizeEvent struct {
+	Size uint32
+}
 
-				encFrame, err := frame.Encode()
-				if err != nil {
-					log.Printf("error encoding frame: %s", err)
-				}
+func (headerTableSizeEvent) streamID() uint32 { return 0 }
+
+func (c *Connection) handleStreamEvent(event StreamEvent) {
+	switch ev := event.(type) {
+	case StreamOutgoingFrameEvent:
+		frame := ev.Frame
+		if headerFrame, ok := frame.(*HeadersFrame); ok {
+			payload, _ := c.hpackEncoder.Encode(headerFrame.Headers)
+			headerFrame.BlockFragment = payload
+			frame = headerFrame
+			c.Metrics.headerBlock(true, headerListSize(headerFrame.Headers), len(payload))
+			c.noteHPACKTable(true)
+		}
 
-				n, err := c.Write(encFrame)
-				if err != nil {
-					log.Printf("error writing frame: %s", err)
-				}
-				log.Printf("wrote %d bytes", n)
-			case StreamTransitionEvent:
-				if ev.ToState == StreamStateClosed {
-					c.closeStream(ev.StreamID)
-				}
-			}
+		streamid, frameType := frame.Header().StreamID, frameTypeOf(frame)
+		encFrame, err := frame.Encode()
+		if err != nil {
+			c.log.Error("encoding frame failed", "stream", streamid, "frame", frameType, "err", err)
+			return
+		}
 
+		if c.writeErr != nil {
+			return
+		}
+		if c.WriteTimeout > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		}
+		n, err := c.Write(encFrame)
+		if err != nil {
+			c.log.Error("writing frame failed", "stream", streamid, "frame", frameType, "err", err)
+			c.writeErr = err
+			c.stop(err)
+			return
+		}
+		c.log.Debug("wrote frame", "stream", streamid, "frame", frameType, "bytes", n)
+		c.wroteFrame(frame)
+	case headerTableSizeEvent:
+		c.hpackEncoder.SetMaxDynamicTableSize(int(ev.Size))
+		c.noteHPACKTable(true)
+	case StreamTransitionEvent:
+		if ev.ToState == StreamStateClosed {
+			c.closeStream(ev.StreamID, false)
 		}
 	}
 }
@@ -349,12 +930,22 @@ func (c *Connection) newStream(streamid uint32) {
 	} else {
 		return
 	}
-	if _, ok := c.streamHandlers[streamid]; ok {
+	if _, ok := c.streams[streamid]; ok {
 		return
 	}
-	stream := NewStream(uint32(streamid), c.streamEvents, c.Handler, &c.writerWG)
-
-	c.streamHandlers[streamid] = stream
+	timeouts := StreamTimeouts{
+		ReadBody: c.ReadBodyTimeout,
+		Write:    c.WriteTimeout,
+	}
+	stream := NewStream(uint32(streamid), c.streamEvents, c.Handler, timeouts, c.done, &c.streamWG)
+	stream.handlers = c.handlers
+	stream.returnConnWindow = c.returnWindow
+	stream.log = withArgs(c.log, "stream", streamid)
+	stream.trace = c.Trace
+	stream.metrics = c.Metrics
+	c.Metrics.streamOpened()
+
+	c.streams[streamid] = stream
 }
 
 func (c *Connection) writeFrame(frame Frame) {
@@ -364,21 +955,98 @@ func (c *Connection) writeFrame(frame Frame) {
 	}
 }
 
+// resetStream sends RST_STREAM for streamid and tears down its handler.
+func (c *Connection) resetStream(streamid uint32, code ErrorCode) {
+	rst := &RSTStreamFrame{
+		Framed: Framed{
+			Header: FrameHeader{
+				StreamID: streamid,
+			},
+		},
+		ErrorCode: code,
+	}
+	c.sendToStream(streamid, rst)
+	c.closeStream(streamid, true)
+	c.writeFrame(rst)
+}
+
+// sendToStream delivers frame to an active stream. It reports false if the
+// stream is unknown or has already finished, in which case it is
+// considered closed from then on.
 func (c *Connection) sendToStream(streamid uint32, frame Frame) bool {
+	c.streamMu.Lock()
+	stream := c.streams[streamid]
+	c.streamMu.Unlock()
+
+	if stream == nil {
+		return false
+	}
+	if !stream.deliver(frame) {
+		c.closeStream(streamid, false)
+		return false
+	}
+	return true
+}
+
+// closeStream stops routing frames to streamid and remembers it as
+// recently closed, so frames the peer sent before noticing are tolerated.
+// reset records that we sent RST_STREAM, after which everything the peer
+// still has in flight for the stream is ignored.
+func (c *Connection) closeStream(streamid uint32, reset bool) {
 	c.streamMu.Lock()
 	defer c.streamMu.Unlock()
 
-	if c.streamHandlers[streamid] != nil {
-		c.streamHandlers[streamid] <- frame
-		log.Printf("sent %T to stream %d", frame, streamid)
-		return true
+	stream, ok := c.streams[streamid]
+	if !ok {
+		if reset {
+			if _, recent := c.closedStreams[streamid]; recent {
+				c.closedStreams[streamid] = true
+			}
+		}
+		return
 	}
-	return false
+	delete(c.streams, streamid)
+	if len(c.streams) == 0 {
+		c.idleSince = time.Now()
+		select {
+		case c.idleChanged <- struct{}{}:
+		default:
+		}
+	}
+
+	c.rememberClosedStream(streamid, reset || stream.resetSent.Load())
 }
 
-func (c *Connection) closeStream(streamid uint32) {
+// abandonStreams closes the streams still open once the connection has
+// shut down, so their handlers stop waiting on the request body.
+func (c *Connection) abandonStreams(code ErrorCode) {
+	c.streamMu.Lock()
+	streams := make([]*Stream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.streamMu.Unlock()
+
+	for _, stream := range streams {
+		stream.connClosed(code)
+	}
+}
+
+// markStreamClosed records a stream that was closed without ever being
+// handed to a Stream.
+func (c *Connection) markStreamClosed(streamid uint32, reset bool) {
 	c.streamMu.Lock()
 	defer c.streamMu.Unlock()
 
-	delete(c.streamHandlers, streamid)
+	c.rememberClosedStream(streamid, reset)
+}
+
+// rememberClosedStream must be called with streamMu held.
+func (c *Connection) rememberClosedStream(streamid uint32, reset bool) {
+	c.closedStreams[streamid] = reset
+	c.closedOrder = append(c.closedOrder, streamid)
+	if len(c.closedOrder) > maxRecentlyClosedStreams {
+		delete(c.closedStreams, c.closedOrder[0])
+		c.closedOrder = c.closedOrder[1:]
+	}
 }
@@ -0,0 +1,1122 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakegut/goh2/hpack"
+	"github.com/jakegut/goh2/http11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gohttp2 "golang.org/x/net/http2"
+	gohpack "golang.org/x/net/http2/hpack"
+)
+
+// testClient speaks raw HTTP/2 frames to a Connection over a net.Pipe.
+type testClient struct {
+	t testing.TB
+
+	conn   net.Conn
+	frames chan Frame
+
+	encoder *hpack.HPackEncoder
+	decoder *hpack.HPackDecoder
+
+	serverSettings *SettingsFrame
+}
+
+func newTestClient(t testing.TB, c *Connection) *testClient {
+	t.Helper()
+
+	server, client := net.Pipe()
+	c.Conn = server
+	if c.Handler == nil {
+		c.Handler = func(w http.ResponseWriter, r Request) {
+			io.Copy(io.Discard, r.Body)
+		}
+	}
+
+	handled := make(chan struct{})
+	go func() {
+		c.Handle()
+		close(handled)
+	}()
+
+	tc := &testClient{
+		t:       t,
+		conn:    client,
+		frames:  make(chan Frame, 64),
+		encoder: &hpack.HPackEncoder{},
+		decoder: hpack.Decoder(),
+	}
+
+	go func() {
+		defer close(tc.frames)
+		for {
+			frame, err := ParseFrame(client, 1<<24-1)
+			if err == ErrUnknownFrame {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			tc.frames <- frame
+		}
+	}()
+
+	t.Cleanup(func() {
+		client.Close()
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Errorf("connection did not shut down")
+		}
+	})
+
+	_, err := client.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	tc.writeFrame(&SettingsFrame{})
+
+	settings, ok := tc.readFrame().(*SettingsFrame)
+	require.True(t, ok, "expected server SETTINGS")
+	require.False(t, settings.Ack)
+	tc.serverSettings = settings
+
+	return tc
+}
+
+func (tc *testClient) writeFrame(frame Frame) {
+	tc.t.Helper()
+	bs, err := frame.Encode()
+	require.NoError(tc.t, err)
+	tc.writeRaw(bs)
+}
+
+func (tc *testClient) writeRaw(bs []byte) {
+	tc.t.Helper()
+	tc.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := tc.conn.Write(bs)
+	require.NoError(tc.t, err)
+}
+
+func (tc *testClient) writeHeaders(streamid uint32, endStream bool, headers ...hpack.Header) {
+	tc.t.Helper()
+	block, err := tc.encoder.Encode(headers)
+	require.NoError(tc.t, err)
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+		EndStream:     endStream,
+		EndHeaders:    true,
+		BlockFragment: block,
+	})
+}
+
+func (tc *testClient) writeData(streamid uint32, endStream bool, data []byte) {
+	tc.t.Helper()
+	tc.writeFrame(&DataFrame{
+		Framed:    Framed{Header: FrameHeader{StreamID: streamid}},
+		EndStream: endStream,
+		Data:      data,
+	})
+}
+
+// readFrame returns the next frame from the server, or nil once the
+// connection is closed.
+func (tc *testClient) readFrame() Frame {
+	tc.t.Helper()
+	select {
+	case frame := <-tc.frames:
+		if hf, ok := frame.(*HeadersFrame); ok {
+			headers, err := tc.decoder.Decode(hf.BlockFragment)
+			require.NoError(tc.t, err)
+			hf.Headers = headers
+		}
+		return frame
+	case <-time.After(5 * time.Second):
+		tc.t.Fatalf("timed out waiting for frame")
+		return nil
+	}
+}
+
+// expectFrame reads frames until one matching match arrives, skipping
+// SETTINGS acknowledgements and other unrelated frames.
+func (tc *testClient) expectFrame(desc string, match func(Frame) bool) Frame {
+	tc.t.Helper()
+	for {
+		frame := tc.readFrame()
+		if frame == nil {
+			tc.t.Fatalf("connection closed waiting for %s", desc)
+		}
+		if match(frame) {
+			return frame
+		}
+	}
+}
+
+func (tc *testClient) expectGoAway(code ErrorCode) *GoAwayFrame {
+	tc.t.Helper()
+	frame := tc.expectFrame("GOAWAY", func(f Frame) bool {
+		_, ok := f.(*GoAwayFrame)
+		return ok
+	}).(*GoAwayFrame)
+	assert.Equal(tc.t, code, frame.ErrorCode, "GOAWAY error code, reason: %q", frame.Opaque)
+	return frame
+}
+
+func (tc *testClient) expectRSTStream(streamid uint32, code ErrorCode) {
+	tc.t.Helper()
+	frame := tc.expectFrame("RST_STREAM", func(f Frame) bool {
+		_, ok := f.(*RSTStreamFrame)
+		return ok
+	}).(*RSTStreamFrame)
+	assert.Equal(tc.t, streamid, frame.Header().StreamID)
+	assert.Equal(tc.t, code, frame.ErrorCode)
+}
+
+// expectResponse reads the response on streamid up to END_STREAM and returns
+// its headers and body.
+func (tc *testClient) expectResponse(streamid uint32) ([]hpack.Header, []byte) {
+	tc.t.Helper()
+	var headers []hpack.Header
+	var body []byte
+	for {
+		frame := tc.readFrame()
+		if frame == nil {
+			tc.t.Fatalf("connection closed waiting for response on stream %d", streamid)
+		}
+		if frame.Header().StreamID != streamid {
+			continue
+		}
+		switch fr := frame.(type) {
+		case *HeadersFrame:
+			headers = append(headers, fr.Headers...)
+			if fr.EndStream {
+				return headers, body
+			}
+		case *DataFrame:
+			body = append(body, fr.Data...)
+			if fr.EndStream {
+				return headers, body
+			}
+		case *RSTStreamFrame:
+			tc.t.Fatalf("stream %d reset: %s", streamid, fr.ErrorCode)
+		}
+	}
+}
+
+// ping round-trips a PING, proving every frame sent before it was processed.
+func (tc *testClient) ping() {
+	tc.t.Helper()
+	opaque := []byte("goh2test")
+	tc.writeFrame(&PingFrame{Opaque: opaque})
+	tc.expectFrame("PING ack", func(f Frame) bool {
+		p, ok := f.(*PingFrame)
+		return ok && p.Ack
+	})
+}
+
+func requestHeaders(method, path string) []hpack.Header {
+	return []hpack.Header{
+		hpack.NewHeader(":method", method),
+		hpack.NewHeader(":scheme", "http"),
+		hpack.NewHeader(":path", path),
+		hpack.NewHeader(":authority", "example.com"),
+	}
+}
+
+func TestConnectionServesRequest(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			w.Write([]byte(r.Method + " " + r.Path))
+		},
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/hello")...)
+	headers, body := tc.expectResponse(1)
+	assert.Equal(t, "200", headerValue(headers, ":status"))
+	assert.Equal(t, "GET /hello", string(body))
+}
+
+func TestConnectionStreamIdentifiers(t *testing.T) {
+	rawFrame := func(frameType FrameType, streamid uint32, payload []byte) []byte {
+		bs, _ := EncodeFrame(payload, frameType, 0, streamid)
+		return bs
+	}
+
+	tests := []struct {
+		name string
+		run  func(tc *testClient)
+		code ErrorCode
+	}{
+		{
+			name: "even stream id",
+			run: func(tc *testClient) {
+				tc.writeHeaders(2, true, requestHeaders("GET", "/")...)
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "decreasing stream id",
+			run: func(tc *testClient) {
+				tc.writeHeaders(5, true, requestHeaders("GET", "/")...)
+				tc.expectResponse(5)
+				tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "DATA on idle stream",
+			run: func(tc *testClient) {
+				tc.writeData(1, true, []byte("hi"))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "RST_STREAM on idle stream",
+			run: func(tc *testClient) {
+				tc.writeFrame(&RSTStreamFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, ErrorCode: ErrCancel})
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "WINDOW_UPDATE on idle stream",
+			run: func(tc *testClient) {
+				tc.writeFrame(&WindowUpdateFrame{Framed: Framed{Header: FrameHeader{StreamID: 3}}, SizeIncrement: 10})
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "SETTINGS on a stream",
+			run: func(tc *testClient) {
+				tc.writeRaw(rawFrame(FrameSettings, 1, nil))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "PING on a stream",
+			run: func(tc *testClient) {
+				tc.writeRaw(rawFrame(FramePing, 1, make([]byte, 8)))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "GOAWAY on a stream",
+			run: func(tc *testClient) {
+				tc.writeRaw(rawFrame(FrameGoAway, 1, make([]byte, 8)))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "HEADERS on stream 0",
+			run: func(tc *testClient) {
+				tc.writeRaw(rawFrame(FrameHeaders, 0, nil))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "DATA on stream 0",
+			run: func(tc *testClient) {
+				tc.writeRaw(rawFrame(FrameData, 0, []byte("hi")))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "RST_STREAM on stream 0",
+			run: func(tc *testClient) {
+				tc.writeRaw(rawFrame(FrameRSTStream, 0, make([]byte, 4)))
+			},
+			code: ErrProtocolError,
+		},
+		{
+			name: "DATA on closed stream",
+			run: func(tc *testClient) {
+				tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+				tc.expectResponse(1)
+				tc.ping()
+				tc.writeData(1, true, []byte("late"))
+			},
+			code: ErrStreamClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestClient(t, &Connection{})
+			tt.run(tc)
+			tc.expectGoAway(tt.code)
+		})
+	}
+}
+
+func TestConnectionFrameTooLarge(t *testing.T) {
+	tc := newTestClient(t, &Connection{})
+
+	// letting us send larger frames doesn't let the client send them
+	tc.writeFrame(&SettingsFrame{Args: []SettingFrameArgs{{Param: SettingsMaxFrameSize, Value: 1<<24 - 1}}})
+	// the header is enough for the frame to be turned away
+	tc.writeRaw([]byte{0, 0x40, 0x01, byte(FramePing), 0, 0, 0, 0, 0})
+	tc.expectGoAway(ErrFrameSizeError)
+}
+
+func TestConnectionToleratesLateFramesOnClosedStream(t *testing.T) {
+	tc := newTestClient(t, &Connection{})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(1)
+	tc.ping()
+
+	tc.writeFrame(&WindowUpdateFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, SizeIncrement: 100})
+	tc.writeFrame(&RSTStreamFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, ErrorCode: ErrCancel})
+	tc.writeFrame(&PriorityFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, StreamDependency: 0, Weight: 16})
+	// PRIORITY is also allowed on idle streams and must not open them
+	tc.writeFrame(&PriorityFrame{Framed: Framed{Header: FrameHeader{StreamID: 7}}, StreamDependency: 0, Weight: 16})
+
+	tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+	headers, _ := tc.expectResponse(3)
+	assert.Equal(t, "200", headerValue(headers, ":status"))
+}
+
+func TestConnectionToleratesLateFramesOnLongClosedStream(t *testing.T) {
+	tc := newTestClient(t, &Connection{})
+
+	// enough streams for the first to be forgotten
+	var streamid uint32
+	for i := 0; i <= maxRecentlyClosedStreams; i++ {
+		streamid = uint32(2*i + 1)
+		tc.writeHeaders(streamid, true, requestHeaders("GET", "/")...)
+		tc.expectResponse(streamid)
+	}
+	tc.ping()
+
+	tc.writeFrame(&WindowUpdateFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, SizeIncrement: 100})
+	tc.writeFrame(&RSTStreamFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, ErrorCode: ErrCancel})
+	tc.writeFrame(&PriorityFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}, StreamDependency: 0, Weight: 16})
+
+	streamid += 2
+	tc.writeHeaders(streamid, true, requestHeaders("GET", "/")...)
+	headers, _ := tc.expectResponse(streamid)
+	assert.Equal(t, "200", headerValue(headers, ":status"))
+}
+
+// writeBody sends n bytes of DATA on streamid in frames of the default
+// maximum size.
+func (tc *testClient) writeBody(streamid uint32, n int) {
+	tc.t.Helper()
+	for n > 0 {
+		size := n
+		if size > 1<<14 {
+			size = 1 << 14
+		}
+		tc.writeData(streamid, false, make([]byte, size))
+		n -= size
+	}
+}
+
+// expectWindowUpdates reads frames until WINDOW_UPDATE frames for the
+// connection and for streamid have arrived, returning their increments.
+func (tc *testClient) expectWindowUpdates(streamid uint32) (conn, stream uint32) {
+	tc.t.Helper()
+	for conn == 0 || stream == 0 {
+		wu := tc.expectFrame("WINDOW_UPDATE", func(f Frame) bool {
+			_, ok := f.(*WindowUpdateFrame)
+			return ok
+		}).(*WindowUpdateFrame)
+		switch wu.Header().StreamID {
+		case 0:
+			conn = wu.SizeIncrement
+		case streamid:
+			stream = wu.SizeIncrement
+		}
+	}
+	return conn, stream
+}
+
+func TestConnectionFlowControl(t *testing.T) {
+	release := make(chan struct{})
+	read := make(chan error, 1)
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			<-release
+			_, err := io.ReadFull(r.Body, make([]byte, 40000))
+			read <- err
+			<-release
+		},
+	})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeBody(1, 40000)
+	// nothing is handed back before the handler reads it
+	tc.writeFrame(&PingFrame{Opaque: []byte("goh2test")})
+	for {
+		frame := tc.readFrame()
+		require.NotNil(t, frame)
+		if _, ok := frame.(*WindowUpdateFrame); ok {
+			t.Fatalf("WINDOW_UPDATE for stream %d before the body was read", frame.Header().StreamID)
+		}
+		if p, ok := frame.(*PingFrame); ok && p.Ack {
+			break
+		}
+	}
+
+	release <- struct{}{}
+	require.NoError(t, <-read)
+	conn, stream := tc.expectWindowUpdates(1)
+	assert.Equal(t, uint32(40000), conn)
+	assert.Equal(t, uint32(40000), stream)
+	close(release)
+	tc.expectResponse(1)
+}
+
+func TestConnectionFlowControlUnreadBody(t *testing.T) {
+	release := make(chan struct{})
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			<-release
+		},
+	})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeBody(1, 40000)
+	tc.ping()
+	close(release)
+
+	// what the handler left unread is handed back once it returns
+	tc.expectResponse(1)
+	conn, stream := tc.expectWindowUpdates(1)
+	assert.Equal(t, uint32(40000), conn)
+	assert.Equal(t, uint32(40000), stream)
+}
+
+func TestConnectionFlowControlError(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			<-release
+		},
+	})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeBody(1, initialWindowSize+1)
+	tc.expectGoAway(ErrFlowControlError)
+}
+
+func TestConnectionMaxConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	tc := newTestClient(t, &Connection{
+		MaxConcurrentStreams: 2,
+		Handler: func(w http.ResponseWriter, r Request) {
+			if r.Path == "/block" {
+				<-release
+			}
+			io.Copy(io.Discard, r.Body)
+			fmt.Fprint(w, r.Path)
+		},
+	})
+	assert.Contains(t, tc.serverSettings.Args, SettingFrameArgs{Param: SettingsMaxConcurrentStreams, Value: 2})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/block")...)
+	tc.writeHeaders(3, false, requestHeaders("POST", "/upload")...)
+	tc.writeHeaders(5, false, requestHeaders("POST", "/refused")...)
+	tc.expectRSTStream(5, ErrRefusedStream)
+	// the body the client sent before seeing RST_STREAM is ignored
+	tc.writeData(5, true, []byte("late"))
+
+	tc.writeData(3, true, nil)
+	tc.expectResponse(3)
+	close(release)
+	tc.expectResponse(1)
+	// the writer lets go of the finished streams before acking the PING
+	tc.ping()
+	tc.writeHeaders(7, true, requestHeaders("GET", "/")...)
+	_, body := tc.expectResponse(7)
+	assert.Equal(t, "/", string(body))
+}
+
+func TestConnectionAdvertisesMaxHeaderListSize(t *testing.T) {
+	tc := newTestClient(t, &Connection{MaxHeaderListSize: 1234})
+	assert.Contains(t, tc.serverSettings.Args, SettingFrameArgs{Param: SettingsMaxHeaderListSize, Value: 1234})
+}
+
+func TestConnectionHeaderListTooLarge(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		MaxHeaderListSize: 16 << 10,
+		Handler: func(w http.ResponseWriter, r Request) {
+			w.Write([]byte(r.Headers["x-sync"]))
+		},
+	})
+
+	// "x-sync: yes" is added to the dynamic table by the rejected block
+	sync := hpack.NewHeader("x-sync", "yes")
+	first, err := tc.encoder.Encode(append(requestHeaders("POST", "/"), sync))
+	require.NoError(t, err)
+
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		BlockFragment: first,
+	})
+	// each CONTINUATION carries one 10KiB header, going over the limit with
+	// the second one
+	for i := 0; i < 2; i++ {
+		fragment, err := tc.encoder.Encode([]hpack.Header{
+			hpack.NewHeader("x-big", strings.Repeat("a", 10<<10)),
+		})
+		require.NoError(t, err)
+		tc.writeFrame(&ContinuationFrame{
+			Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+			EndHeaders:    i == 1,
+			BlockFragment: fragment,
+		})
+	}
+
+	frame := tc.expectFrame("431 response", func(f Frame) bool {
+		return f.Header().StreamID == 1
+	})
+	hf, ok := frame.(*HeadersFrame)
+	require.True(t, ok, "expected HEADERS, got %T", frame)
+	assert.Equal(t, "431", headerValue(hf.Headers, ":status"))
+	assert.True(t, hf.EndStream)
+	tc.expectRSTStream(1, ErrNoError)
+
+	// the body still in flight is ignored
+	tc.writeData(1, true, []byte("ignored"))
+
+	// the dynamic table entries added by the rejected block are still usable
+	block, err := tc.encoder.Encode(append(requestHeaders("GET", "/"), sync))
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x80|62), block[len(block)-1])
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 3}},
+		EndStream:     true,
+		EndHeaders:    true,
+		BlockFragment: block,
+	})
+	headers, body := tc.expectResponse(3)
+	assert.Equal(t, "200", headerValue(headers, ":status"))
+	assert.Equal(t, "yes", string(body))
+}
+
+func TestConnectionHeaderBlockTooLarge(t *testing.T) {
+	tc := newTestClient(t, &Connection{MaxHeaderListSize: 4 << 10})
+
+	block, err := tc.encoder.Encode([]hpack.Header{
+		hpack.NewHeader("x-big", strings.Repeat("a", 24<<10)),
+	})
+	require.NoError(t, err)
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		BlockFragment: block[:1],
+	})
+	tc.writeFrame(&ContinuationFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		EndHeaders:    true,
+		BlockFragment: block[1:],
+	})
+
+	tc.expectGoAway(ErrEnhanceYourCalm)
+}
+
+// The requests of RFC 7541 Appendix C.3 and C.4, which share a dynamic table.
+var appendixCRequests = []struct {
+	name   string
+	blocks []string
+}{
+	{
+		name: "C.3 without huffman",
+		blocks: []string{
+			"828684410f7777772e6578616d706c652e636f6d",
+			"828684be58086e6f2d6361636865",
+			"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+		},
+	},
+	{
+		name: "C.4 with huffman",
+		blocks: []string{
+			"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			"828684be5886a8eb10649cbf",
+			"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		},
+	},
+}
+
+var appendixCResponses = []string{
+	"GET http:/ www.example.com",
+	"GET http:/ www.example.com cache-control=no-cache",
+	"GET https:/index.html www.example.com custom-key=custom-value",
+}
+
+func TestConnectionSplitHeaderBlocks(t *testing.T) {
+	handler := func(w http.ResponseWriter, r Request) {
+		fmt.Fprintf(w, "%s %s:%s %s", r.Method, r.Headers[":scheme"], r.Path, r.Authority)
+		for name, value := range r.Headers {
+			if name != ":scheme" {
+				fmt.Fprintf(w, " %s=%s", name, value)
+			}
+		}
+	}
+
+	for _, tt := range appendixCRequests {
+		var blocks [][]byte
+		longest := 0
+		for _, inhex := range tt.blocks {
+			block, err := hex.DecodeString(inhex)
+			require.NoError(t, err)
+			blocks = append(blocks, block)
+			if len(block) > longest {
+				longest = len(block)
+			}
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			for offset := 0; offset <= longest; offset++ {
+				tc := newTestClient(t, &Connection{Handler: handler})
+
+				for i, block := range blocks {
+					split := offset
+					if split > len(block) {
+						split = len(block)
+					}
+					streamid := uint32(2*i + 1)
+					tc.writeFrame(&HeadersFrame{
+						Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+						EndStream:     true,
+						BlockFragment: block[:split],
+					})
+					tc.writeFrame(&ContinuationFrame{
+						Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+						EndHeaders:    true,
+						BlockFragment: block[split:],
+					})
+
+					_, body := tc.expectResponse(streamid)
+					assert.Equal(t, appendixCResponses[i], string(body), "request %d split at %d", i+1, split)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionStreamErrorInsideHeaderBlock(t *testing.T) {
+	for name, frame := range map[string]Frame{
+		"zero WINDOW_UPDATE": &WindowUpdateFrame{
+			Framed: Framed{Header: FrameHeader{StreamID: 3}},
+		},
+		"PRIORITY on itself": &PriorityFrame{
+			Framed:           Framed{Header: FrameHeader{StreamID: 5}},
+			StreamDependency: 5,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestClient(t, &Connection{})
+			block, err := tc.encoder.Encode(requestHeaders("GET", "/"))
+			require.NoError(t, err)
+
+			tc.writeFrame(&HeadersFrame{
+				Framed:        Framed{Header: FrameHeader{StreamID: 3}},
+				EndStream:     true,
+				BlockFragment: block[:2],
+			})
+			tc.writeFrame(frame)
+
+			goAway := tc.expectGoAway(ErrProtocolError)
+			assert.Contains(t, string(goAway.Opaque), "header block of stream 3")
+		})
+	}
+}
+
+func TestConnectionContinuationFlood(t *testing.T) {
+	tc := newTestClient(t, &Connection{MaxContinuationFrames: 8})
+
+	block, err := tc.encoder.Encode(requestHeaders("GET", "/"))
+	require.NoError(t, err)
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		EndStream:     true,
+		BlockFragment: block,
+	})
+
+	// an endless stream of empty CONTINUATION frames never ending the block
+	go func() {
+		frame, _ := (&ContinuationFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}}).Encode()
+		for i := 0; i < 1000; i++ {
+			if _, err := tc.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	tc.expectGoAway(ErrEnhanceYourCalm)
+}
+
+func TestConnectionHeaderTableSize(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			w.Header().Set("x-custom", "value")
+		},
+	})
+	tc.decoder.SetMaxDynamicTableSize(0)
+	tc.writeFrame(&SettingsFrame{
+		Args: []SettingFrameArgs{{Param: SettingsHeaderTableSize, Value: 0}},
+	})
+	tc.ping()
+
+	for streamid := uint32(1); streamid <= 3; streamid += 2 {
+		tc.writeHeaders(streamid, true, requestHeaders("GET", "/")...)
+		frame := tc.expectFrame("response", func(f Frame) bool {
+			return f.Header().StreamID == streamid
+		})
+		hf, ok := frame.(*HeadersFrame)
+		require.True(t, ok, "expected HEADERS, got %T", frame)
+		assert.Equal(t, "value", headerValue(hf.Headers, "x-custom"))
+		if streamid == 1 {
+			assert.Equal(t, byte(0x20), hf.BlockFragment[0], "table size update")
+		}
+	}
+}
+
+// h2cSettings is a base64url HTTP2-Settings value with
+// SETTINGS_MAX_CONCURRENT_STREAMS of 100.
+const h2cSettings = "AAMAAABk"
+
+func h2cUpgradeRequest(method, body string, fields ...string) string {
+	req := fmt.Sprintf("%s /upgrade HTTP/1.1\r\nHost: example.com\r\n", method)
+	for _, field := range fields {
+		req += field + "\r\n"
+	}
+	if body != "" {
+		req += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	}
+	return req + "\r\n" + body
+}
+
+// upgradeH2C sends req, which should be an h2c upgrade, and returns an
+// x/net framer speaking HTTP/2 on the upgraded connection. The server's
+// SETTINGS has already been read.
+func upgradeH2C(t *testing.T, conn net.Conn, r *bufio.Reader, req string) *gohttp2.Framer {
+	t.Helper()
+
+	writeRequests(t, conn, req)
+	var resp http11.Response
+	require.NoError(t, resp.UnmarshalReader(r))
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Headers["upgrade"])
+	assert.Equal(t, "Upgrade", resp.Headers["connection"])
+
+	framer := gohttp2.NewFramer(conn, r)
+	framer.ReadMetaHeaders = gohpack.NewDecoder(4096, nil)
+	frame, err := framer.ReadFrame()
+	require.NoError(t, err)
+	settings, ok := frame.(*gohttp2.SettingsFrame)
+	require.True(t, ok, "expected server SETTINGS, got %T", frame)
+	require.False(t, settings.IsAck())
+	return framer
+}
+
+// readH2Response reads frames until streamid ends, returning its response.
+func readH2Response(t *testing.T, framer *gohttp2.Framer, streamid uint32) (string, string) {
+	t.Helper()
+
+	var status string
+	var body []byte
+	for {
+		frame, err := framer.ReadFrame()
+		require.NoError(t, err)
+		if frame.Header().StreamID != streamid {
+			continue
+		}
+		switch fr := frame.(type) {
+		case *gohttp2.MetaHeadersFrame:
+			status = fr.PseudoValue("status")
+		case *gohttp2.DataFrame:
+			body = append(body, fr.Data()...)
+		default:
+			t.Fatalf("unexpected %v", frame)
+		}
+		if frame.Header().Flags.Has(gohttp2.FlagDataEndStream) {
+			return status, string(body)
+		}
+	}
+}
+
+func TestConnectionH2CUpgrade(t *testing.T) {
+	handler := func(w http.ResponseWriter, r Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s len=%d connection=%q upgrade=%q",
+			r.Method, r.Authority, r.Path, len(body), r.Headers["connection"], r.Headers["upgrade"])
+	}
+
+	sizes := []int{0, 1, 16383, 16384, 16385, 2 * 16384, 100000}
+	for _, size := range sizes {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			conn, r := newHTTP1TestConn(t, handler)
+			method := "GET"
+			if size > 0 {
+				method = "POST"
+			}
+			body := strings.Repeat("a", size)
+			framer := upgradeH2C(t, conn, r, h2cUpgradeRequest(method, body,
+				"Connection: Upgrade, HTTP2-Settings", "Upgrade: h2c", "HTTP2-Settings: "+h2cSettings))
+
+			_, err := conn.Write([]byte(ClientPreface))
+			require.NoError(t, err)
+			require.NoError(t, framer.WriteSettings())
+
+			// the upgrade request is answered on stream 1
+			status, respBody := readH2Response(t, framer, 1)
+			assert.Equal(t, "200", status)
+			assert.Equal(t, fmt.Sprintf(`%s example.com /upgrade len=%d connection="" upgrade=""`, method, size), respBody)
+
+			// and the client carries on from stream 3
+			var block bytes.Buffer
+			enc := gohpack.NewEncoder(&block)
+			enc.WriteField(gohpack.HeaderField{Name: ":method", Value: "GET"})
+			enc.WriteField(gohpack.HeaderField{Name: ":scheme", Value: "http"})
+			enc.WriteField(gohpack.HeaderField{Name: ":path", Value: "/next"})
+			enc.WriteField(gohpack.HeaderField{Name: ":authority", Value: "example.com"})
+			require.NoError(t, framer.WriteHeaders(gohttp2.HeadersFrameParam{
+				StreamID:      3,
+				BlockFragment: block.Bytes(),
+				EndStream:     true,
+				EndHeaders:    true,
+			}))
+			status, respBody = readH2Response(t, framer, 3)
+			assert.Equal(t, "200", status)
+			assert.Equal(t, `GET example.com /next len=0 connection="" upgrade=""`, respBody)
+		})
+	}
+}
+
+func TestConnectionH2CUpgradeChunkedBody(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+	req := "POST /upgrade HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " + h2cSettings + "\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"
+	framer := upgradeH2C(t, conn, r, req)
+
+	_, err := conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	require.NoError(t, framer.WriteSettings())
+
+	status, body := readH2Response(t, framer, 1)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "POST example.com /upgrade x-test= body=hello", body)
+}
+
+func TestConnectionH2CUpgradeBadPreface(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+	framer := upgradeH2C(t, conn, r, h2cUpgradeRequest("GET", "",
+		"Connection: Upgrade, HTTP2-Settings", "Upgrade: h2c", "HTTP2-Settings: "+h2cSettings))
+
+	_, err := conn.Write([]byte(strings.Repeat("x", len(ClientPreface))))
+	require.NoError(t, err)
+
+	for {
+		frame, err := framer.ReadFrame()
+		require.NoError(t, err)
+		if goAway, ok := frame.(*gohttp2.GoAwayFrame); ok {
+			assert.Equal(t, gohttp2.ErrCodeProtocol, goAway.ErrCode)
+			return
+		}
+	}
+}
+
+func TestConnectionH2CUpgradeIgnored(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+	}{
+		{"missing connection options", []string{"Connection: Upgrade", "Upgrade: h2c", "HTTP2-Settings: " + h2cSettings}},
+		{"missing settings", []string{"Connection: Upgrade, HTTP2-Settings", "Upgrade: h2c"}},
+		{"repeated settings", []string{"Connection: Upgrade, HTTP2-Settings", "Upgrade: h2c", "HTTP2-Settings: " + h2cSettings, "HTTP2-Settings: " + h2cSettings}},
+		{"other protocol", []string{"Connection: Upgrade, HTTP2-Settings", "Upgrade: websocket", "HTTP2-Settings: " + h2cSettings}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, r := newHTTP1TestConn(t, echoHandler)
+			writeRequests(t, conn, h2cUpgradeRequest("GET", "", tt.fields...))
+			resp, body := readResponse(t, r, "GET")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "GET example.com /upgrade x-test= body=", body)
+		})
+	}
+}
+
+func TestConnectionH2CUpgradeBodyTooLarge(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+	writeRequests(t, conn, h2cUpgradeRequest("POST", strings.Repeat("a", defaultMaxUpgradeBodySize+1),
+		"Connection: Upgrade, HTTP2-Settings", "Upgrade: h2c", "HTTP2-Settings: "+h2cSettings))
+	resp, _ := readResponse(t, r, "POST")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestConnectionH2CUpgradeBadSettings(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+	writeRequests(t, conn, h2cUpgradeRequest("GET", "",
+		"Connection: Upgrade, HTTP2-Settings", "Upgrade: h2c", "HTTP2-Settings: AAMAAA"))
+	resp, _ := readResponse(t, r, "GET")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestConnectionBadPriorKnowledgePreface(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+	writeRequests(t, conn, "PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n")
+
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err, "connection closed without a response")
+}
+
+func TestConnectionIdleTimeout(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		IdleTimeout: 50 * time.Millisecond,
+		Handler: func(w http.ResponseWriter, r Request) {
+			// outlives the idle timeout, which doesn't apply while it runs
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, "done")
+		},
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	_, body := tc.expectResponse(1)
+	assert.Equal(t, "done", string(body))
+	idle := time.Now()
+
+	goAway := tc.expectGoAway(ErrNoError)
+	assert.Equal(t, uint32(1), goAway.LastStreamID)
+	assert.GreaterOrEqual(t, time.Since(idle), 40*time.Millisecond)
+	assert.Nil(t, tc.readFrame(), "connection should be closed")
+}
+
+func TestConnectionReadIdleTimeout(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		ReadIdleTimeout: 20 * time.Millisecond,
+		PingTimeout:     50 * time.Millisecond,
+	})
+
+	isPing := func(f Frame) bool {
+		p, ok := f.(*PingFrame)
+		return ok && !p.Ack
+	}
+
+	// answered PINGs keep the connection open
+	for i := 0; i < 2; i++ {
+		ping := tc.expectFrame("PING", isPing).(*PingFrame)
+		tc.writeFrame(&PingFrame{Ack: true, Opaque: ping.Opaque})
+	}
+
+	tc.expectFrame("PING", isPing)
+	start := time.Now()
+	// the last one goes unanswered
+	for tc.readFrame() != nil {
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestConnectionPing(t *testing.T) {
+	c := &Connection{}
+	_, err := c.Ping(context.Background())
+	assert.Error(t, err, "not speaking HTTP/2 yet")
+
+	tc := newTestClient(t, c)
+
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		rtt, err := c.Ping(context.Background())
+		results <- result{rtt, err}
+	}()
+
+	ping := tc.expectFrame("PING", func(f Frame) bool {
+		p, ok := f.(*PingFrame)
+		return ok && !p.Ack
+	}).(*PingFrame)
+	time.Sleep(10 * time.Millisecond)
+	tc.writeFrame(&PingFrame{Ack: true, Opaque: ping.Opaque})
+
+	res := <-results
+	require.NoError(t, res.err)
+	assert.GreaterOrEqual(t, res.rtt, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Ping(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestConnectionReadHeaderTimeout(t *testing.T) {
+	tc := newTestClient(t, &Connection{ReadHeaderTimeout: 20 * time.Millisecond})
+
+	block, err := tc.encoder.Encode(requestHeaders("GET", "/"))
+	require.NoError(t, err)
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		EndStream:     true,
+		BlockFragment: block[:1],
+	})
+	start := time.Now()
+
+	// the rest of the block never arrives
+	tc.expectGoAway(ErrEnhanceYourCalm)
+	assert.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+}
+
+func TestConnectionReadHeaderTimeoutResets(t *testing.T) {
+	tc := newTestClient(t, &Connection{ReadHeaderTimeout: 20 * time.Millisecond})
+
+	block, err := tc.encoder.Encode(requestHeaders("GET", "/"))
+	require.NoError(t, err)
+	tc.writeFrame(&HeadersFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		EndStream:     true,
+		BlockFragment: block[:1],
+	})
+	tc.writeFrame(&ContinuationFrame{
+		Framed:        Framed{Header: FrameHeader{StreamID: 1}},
+		EndHeaders:    true,
+		BlockFragment: block[1:],
+	})
+	tc.expectResponse(1)
+
+	// the deadline doesn't outlive the header block
+	time.Sleep(40 * time.Millisecond)
+	tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(3)
+}
+
+func TestConnectionWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	tc := newTestClient(t, &Connection{
+		WriteTimeout: 50 * time.Millisecond,
+		Handler: func(w http.ResponseWriter, r Request) {
+			chunk := make([]byte, 4096)
+			for {
+				if _, err := w.Write(chunk); err != nil {
+					errs <- err
+					return
+				}
+			}
+		},
+	})
+
+	// the client never reads the response
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was never stopped")
+	}
+}
@@ -0,0 +1,85 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is a 32-bit HTTP/2 error code as carried by RST_STREAM and
+// GOAWAY frames. Codes not defined by RFC 9113 are preserved as-is.
+type ErrorCode uint32
+
+const (
+	ErrNoError            ErrorCode = 0x0
+	ErrProtocolError      ErrorCode = 0x1
+	ErrInternalError      ErrorCode = 0x2
+	ErrFlowControlError   ErrorCode = 0x3
+	ErrSettingsTimeout    ErrorCode = 0x4
+	ErrStreamClosed       ErrorCode = 0x5
+	ErrFrameSizeError     ErrorCode = 0x6
+	ErrRefusedStream      ErrorCode = 0x7
+	ErrCancel             ErrorCode = 0x8
+	ErrCompressionError   ErrorCode = 0x9
+	ErrConnectError       ErrorCode = 0xa
+	ErrEnhanceYourCalm    ErrorCode = 0xb // this goes hard af
+	ErrInadequateSecurity ErrorCode = 0xc
+	ErrHTTP11Required     ErrorCode = 0xd
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrNoError:            "NO_ERROR",
+	ErrProtocolError:      "PROTOCOL_ERROR",
+	ErrInternalError:      "INTERNAL_ERROR",
+	ErrFlowControlError:   "FLOW_CONTROL_ERROR",
+	ErrSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrStreamClosed:       "STREAM_CLOSED",
+	ErrFrameSizeError:     "FRAME_SIZE_ERROR",
+	ErrRefusedStream:      "REFUSED_STREAM",
+	ErrCancel:             "CANCEL",
+	ErrCompressionError:   "COMPRESSION_ERROR",
+	ErrConnectError:       "CONNECT_ERROR",
+	ErrEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (e ErrorCode) String() string {
+	if name, ok := errorCodeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_0x%x", uint32(e))
+}
+
+// ConnectionError is fatal to the whole connection. The reader loop reports
+// it to the peer with a GOAWAY frame carrying Code before closing.
+type ConnectionError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func connError(code ErrorCode, format string, args ...interface{}) ConnectionError {
+	return ConnectionError{
+		Code:   code,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e ConnectionError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("connection error: %s", e.Code)
+	}
+	return fmt.Sprintf("connection error: %s: %s", e.Code, e.Reason)
+}
+
+// StreamError only affects a single stream. The reader loop resets the
+// stream with a RST_STREAM frame carrying Code and keeps the connection open.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream error: stream %d: %s", e.StreamID, e.Code)
+}
+
+var ErrUnknownFrame = errors.New("frame is UNKNOWN")
@@ -0,0 +1,53 @@
+package http2
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodeString(t *testing.T) {
+	for code, want := range map[ErrorCode]string{
+		ErrNoError:          "NO_ERROR",
+		ErrProtocolError:    "PROTOCOL_ERROR",
+		ErrFlowControlError: "FLOW_CONTROL_ERROR",
+		ErrRefusedStream:    "REFUSED_STREAM",
+		ErrCancel:           "CANCEL",
+		ErrEnhanceYourCalm:  "ENHANCE_YOUR_CALM",
+		ErrHTTP11Required:   "HTTP_1_1_REQUIRED",
+		// codes we don't know of are shown in hex
+		ErrorCode(0xe):        "UNKNOWN_ERROR_0xe",
+		ErrorCode(0xff):       "UNKNOWN_ERROR_0xff",
+		ErrorCode(0xdeadbeef): "UNKNOWN_ERROR_0xdeadbeef",
+	} {
+		assert.Equal(t, want, code.String())
+	}
+	for code := range errorCodeNames {
+		assert.NotContains(t, code.String(), "UNKNOWN")
+	}
+}
+
+func TestConnectionError(t *testing.T) {
+	assert.EqualError(t, ConnectionError{Code: ErrProtocolError}, "connection error: PROTOCOL_ERROR")
+	assert.EqualError(t, ConnectionError{Code: ErrFrameSizeError, Reason: "frame too large"}, "connection error: FRAME_SIZE_ERROR: frame too large")
+	assert.EqualError(t, ConnectionError{Code: ErrorCode(0x42), Reason: "odd"}, "connection error: UNKNOWN_ERROR_0x42: odd")
+
+	err := connError(ErrStreamClosed, "DATA on closed stream %d", 5)
+	assert.Equal(t, ConnectionError{Code: ErrStreamClosed, Reason: "DATA on closed stream 5"}, err)
+	assert.EqualError(t, err, "connection error: STREAM_CLOSED: DATA on closed stream 5")
+
+	var ce ConnectionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, ErrStreamClosed, ce.Code)
+}
+
+func TestStreamError(t *testing.T) {
+	assert.EqualError(t, StreamError{StreamID: 3, Code: ErrCancel}, "stream error: stream 3: CANCEL")
+	assert.EqualError(t, StreamError{StreamID: 1, Code: ErrorCode(0x10)}, "stream error: stream 1: UNKNOWN_ERROR_0x10")
+
+	var se StreamError
+	assert.True(t, errors.As(error(StreamError{StreamID: 7, Code: ErrRefusedStream}), &se))
+	assert.Equal(t, uint32(7), se.StreamID)
+	assert.Equal(t, ErrRefusedStream, se.Code)
+}
@@ -0,0 +1,107 @@
+package http2
+
+import "time"
+
+// FloodLimit bounds how often a client may send a kind of frame that costs
+// us more than it costs the client. Up to Burst frames are allowed at
+// once, replenished at Rate frames per second.
+type FloodLimit struct {
+	Burst int
+	Rate  float64
+}
+
+var (
+	// defaultResetLimit is nghttp2's answer to Rapid Reset
+	// (CVE-2023-44487), which opens and immediately resets streams.
+	defaultResetLimit      = FloodLimit{Burst: 1000, Rate: 33}
+	defaultPingLimit       = FloodLimit{Burst: 100, Rate: 10}
+	defaultSettingsLimit   = FloodLimit{Burst: 100, Rate: 10}
+	defaultEmptyFrameLimit = FloodLimit{Burst: 100, Rate: 10}
+)
+
+// floodBucket is a token bucket enforcing a FloodLimit. It is only used by
+// the reader loop.
+type floodBucket struct {
+	limit  FloodLimit
+	tokens float64
+	last   time.Time
+}
+
+func newFloodBucket(limit, def FloodLimit) *floodBucket {
+	if limit.Burst <= 0 {
+		limit = def
+	}
+	return &floodBucket{limit: limit, tokens: float64(limit.Burst)}
+}
+
+// take spends a token, reporting false once the limit has been exceeded.
+func (b *floodBucket) take() bool {
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodBuckets account for the frames of a connection covered by a
+// FloodLimit.
+type floodBuckets struct {
+	resets   *floodBucket
+	pings    *floodBucket
+	settings *floodBucket
+	empty    *floodBucket
+}
+
+func (c *Connection) initFloodBuckets() {
+	c.flood = floodBuckets{
+		resets:   newFloodBucket(c.ResetLimit, defaultResetLimit),
+		pings:    newFloodBucket(c.PingLimit, defaultPingLimit),
+		settings: newFloodBucket(c.SettingsLimit, defaultSettingsLimit),
+		empty:    newFloodBucket(c.EmptyFrameLimit, defaultEmptyFrameLimit),
+	}
+}
+
+// checkFlood accounts for frame, returning ENHANCE_YOUR_CALM once the
+// client has sent too many frames of its kind.
+func (c *Connection) checkFlood(frame Frame) error {
+	var bucket *floodBucket
+	var what string
+	switch fr := frame.(type) {
+	case *RSTStreamFrame:
+		bucket, what = c.flood.resets, "RST_STREAM"
+	case *PingFrame:
+		if !fr.Ack {
+			bucket, what = c.flood.pings, "PING"
+		}
+	case *SettingsFrame:
+		if !fr.Ack {
+			bucket, what = c.flood.settings, "SETTINGS"
+		}
+	case *DataFrame:
+		if len(fr.Data) == 0 && !fr.EndStream {
+			bucket, what = c.flood.empty, "empty DATA"
+		}
+	case *HeadersFrame:
+		if len(fr.BlockFragment) == 0 {
+			bucket, what = c.flood.empty, "empty HEADERS"
+		}
+	case *ContinuationFrame:
+		if len(fr.BlockFragment) == 0 {
+			bucket, what = c.flood.empty, "empty CONTINUATION"
+		}
+	}
+
+	if bucket == nil || bucket.take() {
+		return nil
+	}
+	return connError(ErrEnhanceYourCalm, "too many %s frames", what)
+}
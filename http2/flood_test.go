@@ -0,0 +1,132 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFloodBucket(t *testing.T) {
+	b := newFloodBucket(FloodLimit{Burst: 3, Rate: 100}, defaultPingLimit)
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.take(), "within the burst")
+	}
+	assert.False(t, b.take(), "burst used up")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.take(), "replenished")
+
+	b = newFloodBucket(FloodLimit{}, defaultPingLimit)
+	assert.Equal(t, defaultPingLimit, b.limit)
+}
+
+// flood writes the frames built by next as fast as the connection takes
+// them, until it is closed or n frames have been sent.
+func flood(t *testing.T, tc *testClient, n int, next func(i int) []Frame) {
+	t.Helper()
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		for _, frame := range next(i) {
+			bs, err := frame.Encode()
+			require.NoError(t, err)
+			buf.Write(bs)
+		}
+	}
+	go tc.conn.Write(buf.Bytes())
+}
+
+func TestConnectionRapidReset(t *testing.T) {
+	tc := newTestClient(t, &Connection{})
+
+	// decoding the same block again only re-adds its entries
+	block, err := tc.encoder.Encode(requestHeaders("GET", "/"))
+	require.NoError(t, err)
+
+	flood(t, tc, 2*defaultResetLimit.Burst, func(i int) []Frame {
+		streamid := uint32(2*i + 1)
+		return []Frame{
+			&HeadersFrame{
+				Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+				EndStream:     true,
+				EndHeaders:    true,
+				BlockFragment: block,
+			},
+			&RSTStreamFrame{
+				Framed:    Framed{Header: FrameHeader{StreamID: streamid}},
+				ErrorCode: ErrCancel,
+			},
+		}
+	})
+
+	goAway := tc.expectGoAway(ErrEnhanceYourCalm)
+	assert.Contains(t, string(goAway.Opaque), "RST_STREAM")
+}
+
+func TestConnectionResetsWithinLimit(t *testing.T) {
+	tc := newTestClient(t, &Connection{ResetLimit: FloodLimit{Burst: 5, Rate: 1}})
+
+	for i := uint32(0); i < 5; i++ {
+		streamid := 2*i + 1
+		tc.writeHeaders(streamid, false, requestHeaders("POST", "/")...)
+		tc.writeFrame(&RSTStreamFrame{
+			Framed:    Framed{Header: FrameHeader{StreamID: streamid}},
+			ErrorCode: ErrCancel,
+		})
+	}
+	tc.ping()
+
+	tc.writeHeaders(11, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(11)
+}
+
+func TestConnectionPingFlood(t *testing.T) {
+	tc := newTestClient(t, &Connection{PingLimit: FloodLimit{Burst: 10, Rate: 1}})
+
+	flood(t, tc, 100, func(i int) []Frame {
+		return []Frame{&PingFrame{Opaque: []byte("flooding")}}
+	})
+
+	goAway := tc.expectGoAway(ErrEnhanceYourCalm)
+	assert.Contains(t, string(goAway.Opaque), "PING")
+}
+
+func TestConnectionSettingsFlood(t *testing.T) {
+	tc := newTestClient(t, &Connection{SettingsLimit: FloodLimit{Burst: 10, Rate: 1}})
+
+	flood(t, tc, 100, func(i int) []Frame {
+		return []Frame{&SettingsFrame{}}
+	})
+
+	goAway := tc.expectGoAway(ErrEnhanceYourCalm)
+	assert.Contains(t, string(goAway.Opaque), "SETTINGS")
+}
+
+func TestConnectionEmptyDataFlood(t *testing.T) {
+	tc := newTestClient(t, &Connection{EmptyFrameLimit: FloodLimit{Burst: 10, Rate: 1}})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	flood(t, tc, 100, func(i int) []Frame {
+		return []Frame{&DataFrame{Framed: Framed{Header: FrameHeader{StreamID: 1}}}}
+	})
+
+	goAway := tc.expectGoAway(ErrEnhanceYourCalm)
+	assert.Contains(t, string(goAway.Opaque), "empty DATA")
+}
+
+func TestConnectionEmptyHeadersFlood(t *testing.T) {
+	tc := newTestClient(t, &Connection{EmptyFrameLimit: FloodLimit{Burst: 10, Rate: 1}})
+
+	flood(t, tc, 100, func(i int) []Frame {
+		return []Frame{&HeadersFrame{
+			Framed:     Framed{Header: FrameHeader{StreamID: uint32(2*i + 1)}},
+			EndStream:  true,
+			EndHeaders: true,
+		}}
+	})
+
+	goAway := tc.expectGoAway(ErrEnhanceYourCalm)
+	assert.Contains(t, string(goAway.Opaque), "empty HEADERS")
+}
@@ -3,10 +3,8 @@ package http2
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
-	"log"
 
 	"github.com/jakegut/goh2/hpack"
 )
@@ -26,6 +24,26 @@ const (
 	FrameContinuation FrameType = 0x9
 )
 
+var frameTypeNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
 type FrameFlag uint8
 
 const (
@@ -39,30 +57,14 @@ const (
 
 	SettingsAck FrameFlag = 0x1
 
+	PushPromiseEndHeaders FrameFlag = 0x4
+	PushPromisePadded     FrameFlag = 0x8
+
 	PingAck FrameFlag = 0x1
 
 	ContinuationEndHeaders FrameFlag = 0x4
 )
 
-type ErrorCode uint8
-
-const (
-	ErrNoError            ErrorCode = 0x0
-	ErrProtocolError      ErrorCode = 0x1
-	ErrInternalError      ErrorCode = 0x2
-	ErrFlowControlError   ErrorCode = 0x3
-	ErrSettingsTimeout    ErrorCode = 0x4
-	ErrStreamClosed       ErrorCode = 0x5
-	ErrFrameSizeError     ErrorCode = 0x6
-	ErrRefusedStream      ErrorCode = 0x7
-	ErrCancel             ErrorCode = 0x8
-	ErrCompressionError   ErrorCode = 0x9
-	ErrConnectError       ErrorCode = 0xa
-	ErrEnhanceYourCalm    ErrorCode = 0xb // this goes hard af
-	ErrInadequateSecurity ErrorCode = 0xc
-	ErrHTTP11Required     ErrorCode = 0xd
-)
-
 /*
 +-----------------------------------------------+
 |                 Length (24)                   |
@@ -84,7 +86,7 @@ type FrameHeader struct {
 
 func parseHeader(r io.Reader) (FrameHeader, error) {
 	bs := make([]byte, 9)
-	_, err := r.Read(bs)
+	_, err := io.ReadFull(r, bs)
 	if err != nil {
 		return FrameHeader{}, err
 	}
@@ -103,19 +105,47 @@ func (fr FrameHeader) hasFlag(flag FrameFlag) bool {
 
 type Frame interface {
 	Header() FrameHeader
-	Decode()
+	Decode() error
 	Encode() ([]byte, error)
 }
 
+// frameTypeOf returns the type of frame, which frames built for sending
+// don't have in their header yet.
+func frameTypeOf(frame Frame) FrameType {
+	switch frame.(type) {
+	case *DataFrame:
+		return FrameData
+	case *HeadersFrame:
+		return FrameHeaders
+	case *PriorityFrame:
+		return FramePriority
+	case *RSTStreamFrame:
+		return FrameRSTStream
+	case *SettingsFrame:
+		return FrameSettings
+	case *PushPromiseFrame:
+		return FramePushPromise
+	case *PingFrame:
+		return FramePing
+	case *GoAwayFrame:
+		return FrameGoAway
+	case *WindowUpdateFrame:
+		return FrameWindowUpdate
+	case *ContinuationFrame:
+		return FrameContinuation
+	}
+	return frame.Header().Type
+}
+
 type frameParserFunc func(Framed) Frame
 
 var frameParsers = map[FrameType]frameParserFunc{
-	FrameData:    dataFrame,
-	FrameHeaders: headersFrame,
-	// FramePriority:
-	FrameRSTStream: rstStreamFrame,
-	FrameSettings:  settingsFrame,
-	// FramePushPromise
+	FrameData:         dataFrame,
+	FrameHeaders:      headersFrame,
+	FramePriority:     priorityFrame,
+	FrameRSTStream:    rstStreamFrame,
+	FrameSettings:     settingsFrame,
+	FramePushPromise:  pushPromiseFrame,
 	FramePing:         pingFrame,
 	FrameGoAway:       goAwayFrame,
 	FrameWindowUpdate: windowUpdateFrame,
@@ -127,11 +157,6 @@ type Framed struct {
 	Payload []byte
 }
 
-var ErrUnknownFrame = errors.New("frame is UNKNOWN")
-var ErrExceedsMaxFrameSize = errors.New("exceeds MAX_FRAME_SIZE")
-var ErrConnProtocolError = errors.New("PROTOCOL_ERROR")
-var ErrConnStreamError = errors.New("STREAM_ERROR")
-
 func ParseFrame(r io.Reader, maxSize uint32) (Frame, error) {
 	frame := Framed{}
 	var err error
@@ -140,11 +165,8 @@ func ParseFrame(r io.Reader, maxSize uint32) (Frame, error) {
 		return nil, err
 	}
 
-	switch frame.Header.Type {
-	case FrameHeaders, FrameData:
-		if frame.Header.Length > maxSize {
-			return nil, ErrExceedsMaxFrameSize
-		}
+	if frame.Header.Length > maxSize {
+		return nil, connError(ErrFrameSizeError, "frame of %d bytes exceeds MAX_FRAME_SIZE", frame.Header.Length)
 	}
 
 	frame.Payload = make([]byte, frame.Header.Length)
@@ -152,19 +174,37 @@ func ParseFrame(r io.Reader, maxSize uint32) (Frame, error) {
 		return nil, err
 	}
 
-	fmt.Printf("parsing %+v (read %d bytes)\n", frame.Header, len(frame.Payload))
+	if err := checkFrameStreamID(frame.Header); err != nil {
+		return nil, err
+	}
 
 	if parserFn, ok := frameParsers[frame.Header.Type]; ok {
 		f := parserFn(frame)
-		log.Printf("decoding frame: %T", f)
-		f.Decode()
+		if err := f.Decode(); err != nil {
+			return nil, err
+		}
 		return f, nil
 	} else {
-		log.Printf("unknown frame type: %d", frame.Header.Type)
 		return nil, ErrUnknownFrame
 	}
 }
 
+// checkFrameStreamID rejects control frames sent on a stream and stream
+// frames sent on the connection control stream (RFC 9113 §6).
+func checkFrameStreamID(h FrameHeader) error {
+	switch h.Type {
+	case FrameSettings, FramePing, FrameGoAway:
+		if h.StreamID != 0 {
+			return connError(ErrProtocolError, "frame type %d on stream %d", h.Type, h.StreamID)
+		}
+	case FrameData, FrameHeaders, FramePriority, FrameRSTStream, FramePushPromise, FrameContinuation:
+		if h.StreamID == 0 {
+			return connError(ErrProtocolError, "frame type %d on stream 0", h.Type)
+		}
+	}
+	return nil
+}
+
 func EncodeFrame(payload []byte, frameType FrameType, flags uint8, streamid uint32) ([]byte, error) {
 	buf := []byte{}
 
@@ -203,18 +243,26 @@ func (d *DataFrame) Header() FrameHeader {
 	return d.Framed.Header
 }
 
-func (d *DataFrame) Decode() {
+func (d *DataFrame) Decode() error {
 	bs := d.Framed.Payload
 
 	d.Padded = d.Framed.Header.hasFlag(DataPadded)
 	d.EndStream = d.Framed.Header.hasFlag(DataEndStream)
 
 	if d.Padded {
+		if len(bs) < 1 {
+			return connError(ErrFrameSizeError, "DATA frame too short for padding")
+		}
 		d.PadLength = uint8(bs[0])
 		bs = bs[1:]
 	}
 
+	if int(d.PadLength) > len(bs) {
+		return connError(ErrProtocolError, "DATA padding exceeds payload")
+	}
+
 	d.Data = bs[:len(bs)-int(d.PadLength)]
+	return nil
 }
 
 func (d *DataFrame) Encode() ([]byte, error) {
@@ -253,7 +301,7 @@ func (h *HeadersFrame) Header() FrameHeader {
 	return h.Framed.Header
 }
 
-func (h *HeadersFrame) Decode() {
+func (h *HeadersFrame) Decode() error {
 	bs := h.Framed.Payload
 
 	h.EndStream = h.Framed.Header.hasFlag(HeadersEndStream)
@@ -262,18 +310,29 @@ func (h *HeadersFrame) Decode() {
 	h.Padded = h.Framed.Header.hasFlag(HeadersPadded)
 
 	if h.Padded {
+		if len(bs) < 1 {
+			return connError(ErrFrameSizeError, "HEADERS frame too short for padding")
+		}
 		h.PadLength = bs[0]
 		bs = bs[1:]
 	}
 
 	if h.Priority {
+		if len(bs) < 5 {
+			return connError(ErrFrameSizeError, "HEADERS frame too short for priority")
+		}
 		h.ExclusiveStreamDep = (bs[0] & 0x80) == 0x80
 		h.StreamDependency = binary.BigEndian.Uint32(bs) & (1<<31 - 1)
 		h.Weight = uint8(bs[4])
-		bs = bs[4:]
+		bs = bs[5:]
+	}
+
+	if int(h.PadLength) > len(bs) {
+		return connError(ErrProtocolError, "HEADERS padding exceeds payload")
 	}
 
 	h.BlockFragment = bs[:len(bs)-int(h.PadLength)]
+	return nil
 }
 
 func (h *HeadersFrame) Encode() ([]byte, error) {
@@ -319,6 +378,55 @@ func (h *HeadersFrame) Encode() ([]byte, error) {
 	return EncodeFrame(buf.Bytes(), FrameHeaders, flags, h.Framed.Header.StreamID)
 }
 
+type PriorityFrame struct {
+	Framed Framed
+
+	StreamDependency   uint32
+	ExclusiveStreamDep bool
+	Weight             uint8
+}
+
+func priorityFrame(framed Framed) Frame {
+	return &PriorityFrame{Framed: framed}
+}
+
+func (p *PriorityFrame) Header() FrameHeader {
+	return p.Framed.Header
+}
+
+func (p *PriorityFrame) Decode() error {
+	bs := p.Framed.Payload
+	if len(bs) != 5 {
+		return StreamError{StreamID: p.Header().StreamID, Code: ErrFrameSizeError}
+	}
+
+	p.ExclusiveStreamDep = (bs[0] & 0x80) == 0x80
+	p.StreamDependency = binary.BigEndian.Uint32(bs) & (1<<31 - 1)
+	p.Weight = bs[4]
+
+	if p.StreamDependency == p.Header().StreamID {
+		return StreamError{StreamID: p.Header().StreamID, Code: ErrProtocolError}
+	}
+	return nil
+}
+
+func (p *PriorityFrame) Encode() ([]byte, error) {
+	var exclusive byte
+	if p.ExclusiveStreamDep {
+		exclusive = 1
+	}
+
+	payload := []byte{
+		(exclusive << 7) | byte(p.StreamDependency>>24),
+		byte(p.StreamDependency >> 16),
+		byte(p.StreamDependency >> 8),
+		byte(p.StreamDependency),
+		p.Weight,
+	}
+
+	return EncodeFrame(payload, FramePriority, 0, p.Framed.Header.StreamID)
+}
+
 type RSTStreamFrame struct {
 	Framed Framed
 
@@ -333,12 +441,12 @@ func (r *RSTStreamFrame) Header() FrameHeader {
 	return r.Framed.Header
 }
 
-func (r *RSTStreamFrame) Decode() {
-	code := binary.BigEndian.Uint32(r.Framed.Payload)
-	if code > uint32(ErrHTTP11Required) {
-		code = uint32(ErrInternalError)
+func (r *RSTStreamFrame) Decode() error {
+	if len(r.Framed.Payload) != 4 {
+		return connError(ErrFrameSizeError, "RST_STREAM frame must be 4 bytes, got %d", len(r.Framed.Payload))
 	}
-	r.ErrorCode = ErrorCode(code)
+	r.ErrorCode = ErrorCode(binary.BigEndian.Uint32(r.Framed.Payload))
+	return nil
 }
 
 func (r *RSTStreamFrame) Encode() ([]byte, error) {
@@ -370,7 +478,16 @@ func (s *SettingsFrame) Header() FrameHeader {
 	return s.Framed.Header
 }
 
-func (s *SettingsFrame) Decode() {
+func (s *SettingsFrame) Decode() error {
+	s.Ack = s.Framed.Header.hasFlag(SettingsAck)
+
+	if s.Ack && len(s.Framed.Payload) != 0 {
+		return connError(ErrFrameSizeError, "SETTINGS ack with non-empty payload")
+	}
+	if len(s.Framed.Payload)%6 != 0 {
+		return connError(ErrFrameSizeError, "SETTINGS payload of %d bytes is not a multiple of 6", len(s.Framed.Payload))
+	}
+
 	if s.Args == nil {
 		s.Args = make([]SettingFrameArgs, 0)
 	}
@@ -385,19 +502,14 @@ func (s *SettingsFrame) Decode() {
 		bs = bs[6:]
 	}
 
-	s.Ack = s.Framed.Header.hasFlag(SettingsAck)
+	return nil
 }
 
 func (s *SettingsFrame) Encode() ([]byte, error) {
 	payload := []byte{}
 
 	for _, arg := range s.Args {
-		p := arg.Param
-		payload = append(payload,
-			byte((p>>16)&0xff),
-			byte((p>>8)&0xff),
-			byte(p&0xff),
-		)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(arg.Param))
 		payload = binary.BigEndian.AppendUint32(payload, arg.Value)
 	}
 
@@ -409,6 +521,79 @@ func (s *SettingsFrame) Encode() ([]byte, error) {
 	return EncodeFrame(payload, FrameSettings, flags, 0)
 }
 
+type PushPromiseFrame struct {
+	Framed Framed
+
+	EndHeaders bool
+	Padded     bool
+
+	PadLength        uint8
+	PromisedStreamID uint32
+	BlockFragment    []byte
+
+	// not used directly by Encode/Decode
+	Headers []hpack.Header
+}
+
+func pushPromiseFrame(framed Framed) Frame {
+	return &PushPromiseFrame{Framed: framed}
+}
+
+func (p *PushPromiseFrame) Header() FrameHeader {
+	return p.Framed.Header
+}
+
+func (p *PushPromiseFrame) Decode() error {
+	bs := p.Framed.Payload
+
+	p.EndHeaders = p.Framed.Header.hasFlag(PushPromiseEndHeaders)
+	p.Padded = p.Framed.Header.hasFlag(PushPromisePadded)
+
+	if p.Padded {
+		if len(bs) < 1 {
+			return connError(ErrFrameSizeError, "PUSH_PROMISE frame too short for padding")
+		}
+		p.PadLength = bs[0]
+		bs = bs[1:]
+	}
+
+	if len(bs) < 4 {
+		return connError(ErrFrameSizeError, "PUSH_PROMISE frame too short")
+	}
+	p.PromisedStreamID = binary.BigEndian.Uint32(bs) & (1<<31 - 1)
+	bs = bs[4:]
+
+	if int(p.PadLength) > len(bs) {
+		return connError(ErrProtocolError, "PUSH_PROMISE padding exceeds payload")
+	}
+
+	p.BlockFragment = bs[:len(bs)-int(p.PadLength)]
+	return nil
+}
+
+func (p *PushPromiseFrame) Encode() ([]byte, error) {
+	var flags uint8
+	var buf bytes.Buffer
+
+	if p.EndHeaders {
+		flags |= uint8(PushPromiseEndHeaders)
+	}
+
+	if p.Padded {
+		flags |= uint8(PushPromisePadded)
+		buf.WriteByte(p.PadLength)
+	}
+
+	buf.Write(binary.BigEndian.AppendUint32(nil, p.PromisedStreamID))
+	buf.Write(p.BlockFragment)
+
+	if p.Padded {
+		buf.Write(make([]byte, p.PadLength))
+	}
+
+	return EncodeFrame(buf.Bytes(), FramePushPromise, flags, p.Framed.Header.StreamID)
+}
+
 type PingFrame struct {
 	Framed Framed
 
@@ -425,8 +610,13 @@ func (p *PingFrame) Header() FrameHeader {
 	return p.Framed.Header
 }
 
-func (p *PingFrame) Decode() {
+func (p *PingFrame) Decode() error {
+	if len(p.Framed.Payload) != 8 {
+		return connError(ErrFrameSizeError, "PING frame must be 8 bytes, got %d", len(p.Framed.Payload))
+	}
+	p.Ack = p.Framed.Header.hasFlag(PingAck)
 	p.Opaque = p.Framed.Payload
+	return nil
 }
 
 func (p *PingFrame) Encode() ([]byte, error) {
@@ -455,14 +645,18 @@ func (g *GoAwayFrame) Header() FrameHeader {
 	return g.Framed.Header
 }
 
-func (g *GoAwayFrame) Decode() {
+func (g *GoAwayFrame) Decode() error {
 	bs := g.Framed.Payload
+	if len(bs) < 8 {
+		return connError(ErrFrameSizeError, "GOAWAY frame too short")
+	}
 	g.LastStreamID = binary.BigEndian.Uint32(bs) & ((1 << 31) - 1)
 	g.ErrorCode = ErrorCode(binary.BigEndian.Uint32(bs[4:]))
 
 	if len(bs) > 8 {
 		g.Opaque = bs[8:]
 	}
+	return nil
 }
 
 func (g *GoAwayFrame) Encode() ([]byte, error) {
@@ -490,14 +684,24 @@ func (w *WindowUpdateFrame) Header() FrameHeader {
 	return w.Framed.Header
 }
 
-func (w *WindowUpdateFrame) Decode() {
-	w.SizeIncrement = binary.BigEndian.Uint32(w.Framed.Payload)
+func (w *WindowUpdateFrame) Decode() error {
+	if len(w.Framed.Payload) != 4 {
+		return connError(ErrFrameSizeError, "WINDOW_UPDATE frame must be 4 bytes, got %d", len(w.Framed.Payload))
+	}
+	w.SizeIncrement = binary.BigEndian.Uint32(w.Framed.Payload) & (1<<31 - 1)
+	if w.SizeIncrement == 0 {
+		if w.Header().StreamID == 0 {
+			return connError(ErrProtocolError, "WINDOW_UPDATE with zero increment")
+		}
+		return StreamError{StreamID: w.Header().StreamID, Code: ErrProtocolError}
+	}
+	return nil
 }
 
 func (w *WindowUpdateFrame) Encode() ([]byte, error) {
 	payload := binary.BigEndian.AppendUint32([]byte{}, w.SizeIncrement)
 
-	return EncodeFrame(payload, FrameWindowUpdate, 0, 0)
+	return EncodeFrame(payload, FrameWindowUpdate, 0, w.Framed.Header.StreamID)
 }
 
 type ContinuationFrame struct {
@@ -519,10 +723,11 @@ func (c *ContinuationFrame) Header() FrameHeader {
 	return c.Framed.Header
 }
 
-func (c *ContinuationFrame) Decode() {
+func (c *ContinuationFrame) Decode() error {
 	c.EndHeaders = c.Framed.Header.hasFlag(ContinuationEndHeaders)
 
 	c.BlockFragment = c.Framed.Payload
+	return nil
 }
 
 func (c *ContinuationFrame) Encode() ([]byte, error) {
@@ -0,0 +1,295 @@
+package http2
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakegut/goh2/http11"
+)
+
+// http1BufferSize is how much of a response is buffered before committing
+// to chunked encoding. Smaller responses get a Content-Length instead.
+const http1BufferSize = 4096
+
+// maxHTTP1Drain is how much of a request body the handler left unread is
+// discarded to keep the connection open for the next request.
+const maxHTTP1Drain = 256 << 10
+
+// serveHTTP11 serves plain HTTP/1.1 requests, starting with req which was
+// read while looking for the HTTP/2 preface. Requests are answered in
+// order, one at a time, which also takes care of pipelined requests.
+func (c *Connection) serveHTTP11(req *http11.HTTP11Request) {
+	w := bufio.NewWriter(c.Conn)
+	for {
+		if !c.serveHTTP11Request(w, req) {
+			return
+		}
+
+		req = &http11.HTTP11Request{}
+		if err := req.UnmarshalReaderWithLimits(c.bufreader, c.http11Limits()); err != nil {
+			c.badHTTP11Request(err)
+			return
+		}
+	}
+}
+
+func (c *Connection) http11Limits() http11.Limits {
+	return http11.Limits{
+		MaxHeaderBytes: int(c.MaxHeaderListSize),
+		MaxLineLength:  http11.DefaultLimits.MaxLineLength,
+		MaxBodySize:    c.MaxRequestBodySize,
+	}
+}
+
+// badHTTP11Request answers a request that couldn't be parsed. The
+// connection is closed afterwards as we can't tell where the next request
+// would start.
+func (c *Connection) badHTTP11Request(err error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+	c.log.Info("bad HTTP/1.1 request", "err", err)
+	if errors.Is(err, http11.ErrBadPreface) {
+		// an HTTP/2 client, which wouldn't understand a response
+		return
+	}
+
+	code := http.StatusBadRequest
+	switch {
+	case errors.Is(err, http11.ErrHeaderTooLarge):
+		code = http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, http11.ErrBodyTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, http11.ErrURITooLong):
+		code = http.StatusRequestURITooLong
+	case errors.Is(err, http11.ErrNotImplemented):
+		code = http.StatusNotImplemented
+	}
+
+	w := bufio.NewWriter(c.Conn)
+	rw := newHTTP1ResponseWriter(w, &http11.HTTP11Request{Protocol: "HTTP/1.1"}, false)
+	rw.WriteHeader(code)
+	rw.finish()
+	w.Flush()
+}
+
+func (c *Connection) serveHTTP11Request(w *bufio.Writer, h1 *http11.HTTP11Request) bool {
+	keepAlive := h1.Protocol == "HTTP/1.1" && !hasToken(h1.Headers["connection"], "close")
+	rw := newHTTP1ResponseWriter(w, h1, keepAlive)
+	rw.conn = c.Conn
+
+	req := Request{
+		Method:    h1.Method,
+		Path:      h1.Path,
+		Authority: h1.Headers["host"],
+		Headers:   map[string]string{},
+		Body:      h1.Body,
+	}
+	for name, value := range h1.Headers {
+		if name != "host" {
+			req.Headers[name] = value
+		}
+	}
+
+	if !c.handlers.call(func() {
+		start := time.Now()
+		c.Handler(rw, req)
+		c.Metrics.handlerDone(time.Since(start))
+	}) {
+		c.log.Warn("refusing request, too many handlers waiting")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if rw.aborted.Load() {
+		// the connection is closed already, and w may still be in use by
+		// a write the handler left behind
+		return false
+	}
+
+	// the next request starts after this body, unless the connection
+	// closes anyway, e.g. with a handler still reading it
+	if rw.keepAlive {
+		n, err := io.CopyN(io.Discard, h1.Body, maxHTTP1Drain+1)
+		if err != io.EOF || n > maxHTTP1Drain {
+			rw.keepAlive = false
+		}
+	}
+
+	err := rw.finish()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		c.log.Debug("writing HTTP/1.1 response failed", "err", err)
+		return false
+	}
+	return rw.keepAlive
+}
+
+// hasToken reports whether the comma separated header value contains token.
+func hasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ http.ResponseWriter = (*http1ResponseWriter)(nil)
+
+// http1ResponseWriter writes an HTTP/1.1 response. The status line and
+// headers are held back until the handler writes more than http1BufferSize
+// bytes or returns, so that short responses get a Content-Length. Longer
+// ones without a Content-Length use chunked encoding, or close the
+// connection for HTTP/1.0 clients.
+type http1ResponseWriter struct {
+	w   *bufio.Writer
+	req *http11.HTTP11Request
+
+	headers    http.Header
+	statusCode int
+
+	wroteHeader bool
+	buf         []byte
+	chunked     *http11.ChunkedWriter
+	// noBody is set for HEAD requests and statuses that can't have one.
+	noBody bool
+
+	keepAlive bool
+	// aborted is set once the response was abandoned half way, and conn
+	// closed as the only way to tell the client. It may happen while the
+	// handler is writing.
+	conn    io.Closer
+	aborted atomic.Bool
+}
+
+func newHTTP1ResponseWriter(w *bufio.Writer, req *http11.HTTP11Request, keepAlive bool) *http1ResponseWriter {
+	return &http1ResponseWriter{
+		w:          w,
+		req:        req,
+		headers:    http.Header{},
+		statusCode: http.StatusOK,
+		keepAlive:  keepAlive,
+	}
+}
+
+func (rw *http1ResponseWriter) Header() http.Header {
+	return rw.headers
+}
+
+func (rw *http1ResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.statusCode = statusCode
+}
+
+func (rw *http1ResponseWriter) Write(bs []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.buf = append(rw.buf, bs...)
+		if len(rw.buf) > http1BufferSize {
+			buf := rw.buf
+			rw.buf = nil
+			if err := rw.writeHeader(-1); err != nil {
+				return 0, err
+			}
+			if _, err := rw.writeBody(buf); err != nil {
+				return 0, err
+			}
+		}
+		return len(bs), nil
+	}
+	return rw.writeBody(bs)
+}
+
+func (rw *http1ResponseWriter) writeBody(bs []byte) (int, error) {
+	if rw.noBody || len(bs) == 0 {
+		return len(bs), nil
+	}
+	if rw.chunked != nil {
+		return rw.chunked.Write(bs)
+	}
+	return rw.w.Write(bs)
+}
+
+// writeHeader sends the status line and headers. contentLength is the
+// length of the complete body, or -1 if it isn't known yet.
+func (rw *http1ResponseWriter) writeHeader(contentLength int) error {
+	rw.wroteHeader = true
+	code := rw.statusCode
+	rw.noBody = rw.req.Method == "HEAD" || code/100 == 1 || code == http.StatusNoContent || code == http.StatusNotModified
+
+	if rw.headers.Get("content-type") == "" && contentLength != 0 {
+		rw.headers.Set("content-type", "text/plain; charset=utf-8")
+	}
+	if rw.headers.Get("date") == "" {
+		rw.headers.Set("date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	switch {
+	case rw.headers.Get("content-length") != "":
+	case contentLength >= 0:
+		if code != http.StatusNoContent && code != http.StatusNotModified {
+			rw.headers.Set("content-length", strconv.Itoa(contentLength))
+		}
+	case rw.noBody:
+	case rw.req.Protocol == "HTTP/1.1":
+		rw.chunked = http11.NewChunkedWriter(rw.w)
+		rw.headers.Set("transfer-encoding", "chunked")
+	default:
+		// HTTP/1.0 clients read until the connection closes
+		rw.keepAlive = false
+	}
+
+	if !rw.keepAlive {
+		rw.headers.Set("connection", "close")
+	}
+
+	resp := http11.Response{StatusCode: code, Fields: rw.headers}
+	_, err := resp.WriteTo(rw.w)
+	return err
+}
+
+// resetStream abandons the response. There is no stream to reset, so the
+// connection is closed instead, failing any write in progress.
+func (rw *http1ResponseWriter) resetStream(code ErrorCode) {
+	rw.aborted.Store(true)
+	if rw.conn != nil {
+		rw.conn.Close()
+	}
+}
+
+// abandonBody closes the connection after the response, as a handler
+// that ran out of time may still be reading the request body.
+func (rw *http1ResponseWriter) abandonBody() {
+	rw.keepAlive = false
+}
+
+// finish completes the response once the handler has returned.
+func (rw *http1ResponseWriter) finish() error {
+	if !rw.wroteHeader {
+		buf := rw.buf
+		rw.buf = nil
+		contentLength := len(buf)
+		if rw.req.Method == "HEAD" && contentLength == 0 {
+			// a handler leaving out the body of a HEAD response says
+			// nothing of how long the GET one would be
+			contentLength = -1
+		}
+		if err := rw.writeHeader(contentLength); err != nil {
+			return err
+		}
+		_, err := rw.writeBody(buf)
+		return err
+	}
+	if rw.chunked != nil {
+		return rw.chunked.Close()
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakegut/goh2/http11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gohttp2 "golang.org/x/net/http2"
+)
+
+// newHTTP1TestConn serves a Connection over a net.Pipe, returning the
+// client end and a reader for the responses.
+func newHTTP1TestConn(t *testing.T, handler HandlerFunc) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	c := &Connection{Conn: server, Handler: handler}
+	handled := make(chan struct{})
+	go func() {
+		c.Handle()
+		close(handled)
+	}()
+
+	t.Cleanup(func() {
+		client.Close()
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Errorf("connection did not shut down")
+		}
+	})
+	return client, bufio.NewReader(client)
+}
+
+func writeRequests(t *testing.T, conn net.Conn, requests ...string) {
+	t.Helper()
+	go func() {
+		conn.Write([]byte(strings.Join(requests, "")))
+	}()
+}
+
+func readResponse(t *testing.T, r *bufio.Reader, method string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(r, &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func echoHandler(w http.ResponseWriter, r Request) {
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s %s %s x-test=%s body=%s", r.Method, r.Authority, r.Path, r.Headers["x-test"], body)
+}
+
+func TestHTTP1KeepAlive(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+
+	for i := 0; i < 3; i++ {
+		writeRequests(t, conn, fmt.Sprintf("GET /%d HTTP/1.1\r\nHost: example.com\r\nX-Test: %d\r\n\r\n", i, i))
+		resp, body := readResponse(t, r, "GET")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("GET example.com /%d x-test=%d body=", i, i), body)
+		assert.Equal(t, int64(len(body)), resp.ContentLength)
+		assert.False(t, resp.Close)
+	}
+}
+
+func TestHTTP1Pipelining(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+
+	writeRequests(t, conn,
+		"POST /a HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+		"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET /c HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	)
+
+	_, body := readResponse(t, r, "POST")
+	assert.Equal(t, "POST example.com /a x-test= body=hello", body)
+	_, body = readResponse(t, r, "GET")
+	assert.Equal(t, "GET example.com /b x-test= body=", body)
+	resp, body := readResponse(t, r, "GET")
+	assert.Equal(t, "GET example.com /c x-test= body=", body)
+	assert.True(t, resp.Close)
+
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err, "connection closed")
+}
+
+func TestHTTP1ChunkedResponse(t *testing.T) {
+	large := strings.Repeat("0123456789", 1000)
+	conn, r := newHTTP1TestConn(t, func(w http.ResponseWriter, r Request) {
+		for i := 0; i < 10; i++ {
+			io.WriteString(w, large[i*1000:(i+1)*1000])
+		}
+	})
+
+	writeRequests(t, conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, body := readResponse(t, r, "GET")
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, large, body)
+
+	// the connection is still usable
+	writeRequests(t, conn, "HEAD / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, body = readResponse(t, r, "HEAD")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+}
+
+func TestHTTP1Head(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, func(w http.ResponseWriter, r Request) {
+		switch r.Path {
+		case "/written":
+			io.WriteString(w, "hello")
+		case "/declared":
+			w.Header().Set("Content-Length", "42")
+		}
+	})
+
+	for _, tt := range []struct {
+		path          string
+		contentLength int64
+	}{
+		{"/written", 5},
+		{"/declared", 42},
+		// nothing written tells nothing of the GET response
+		{"/skipped", -1},
+	} {
+		writeRequests(t, conn, "HEAD "+tt.path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, body := readResponse(t, r, "HEAD")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, tt.path)
+		assert.Equal(t, tt.contentLength, resp.ContentLength, tt.path)
+		assert.Empty(t, body, tt.path)
+		assert.False(t, resp.Close, tt.path)
+	}
+}
+
+func TestHTTP1ChunkedRequest(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+
+	writeRequests(t, conn,
+		"POST /a HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n2\r\nlo\r\n0\r\nX-Sum: 1\r\n\r\n",
+		"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	)
+	_, body := readResponse(t, r, "POST")
+	assert.Equal(t, "POST example.com /a x-test= body=hello", body)
+	_, body = readResponse(t, r, "GET")
+	assert.Equal(t, "GET example.com /b x-test= body=", body)
+}
+
+func TestHTTP1UnreadBody(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, func(w http.ResponseWriter, r Request) {
+		io.WriteString(w, "ignored")
+	})
+
+	// small bodies are discarded to keep the connection
+	writeRequests(t, conn,
+		"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	)
+	resp, _ := readResponse(t, r, "POST")
+	assert.False(t, resp.Close)
+	resp, _ = readResponse(t, r, "GET")
+	assert.False(t, resp.Close)
+
+	// larger ones aren't worth reading
+	large := strings.Repeat("a", maxHTTP1Drain+1)
+	writeRequests(t, conn, fmt.Sprintf("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n%s", len(large), large))
+	resp, _ = readResponse(t, r, "POST")
+	assert.True(t, resp.Close)
+}
+
+func TestHTTP1BodyTooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Connection{Conn: server, Handler: echoHandler, MaxRequestBodySize: 4}
+	go c.Handle()
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	writeRequests(t, client, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	resp, _ := readResponse(t, r, "POST")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
+
+func TestHTTP1HeaderTooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Connection{Conn: server, Handler: echoHandler, MaxHeaderListSize: 64}
+	go c.Handle()
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	writeRequests(t, client, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Test: "+strings.Repeat("a", 64)+"\r\n\r\n")
+	resp, _ := readResponse(t, r, "GET")
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+}
+
+func TestHTTP1ExplicitContentLength(t *testing.T) {
+	large := strings.Repeat("a", 3*http1BufferSize)
+	conn, r := newHTTP1TestConn(t, func(w http.ResponseWriter, r Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(large)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, large)
+	})
+
+	writeRequests(t, conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, body := readResponse(t, r, "GET")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.Equal(t, int64(len(large)), resp.ContentLength)
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, large, body)
+}
+
+func TestHTTP1NoContent(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, func(w http.ResponseWriter, r Request) {
+		w.WriteHeader(http.StatusNoContent)
+		io.WriteString(w, "dropped")
+	})
+
+	writeRequests(t, conn, "DELETE /x HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, body := readResponse(t, r, "DELETE")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+}
+
+func TestHTTP10(t *testing.T) {
+	large := strings.Repeat("a", 2*http1BufferSize)
+	conn, r := newHTTP1TestConn(t, func(w http.ResponseWriter, r Request) {
+		io.WriteString(w, large)
+	})
+
+	// no chunked encoding, the body ends with the connection
+	writeRequests(t, conn, "GET / HTTP/1.0\r\n\r\n")
+	resp, body := readResponse(t, r, "GET")
+	assert.Empty(t, resp.TransferEncoding)
+	assert.True(t, resp.Close)
+	assert.Equal(t, large, body)
+}
+
+func TestHTTP1BadRequest(t *testing.T) {
+	conn, r := newHTTP1TestConn(t, echoHandler)
+
+	writeRequests(t, conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "NONSENSE\r\n\r\n")
+	resp, _ := readResponse(t, r, "GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = readResponse(t, r, "GET")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
+
+// TestHTTP1AndHTTP2 serves HTTP/1.1 and HTTP/2 clients on one listener.
+func TestHTTP1AndHTTP2(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := &Connection{Conn: conn, Handler: echoHandler}
+			go c.Handle()
+		}
+	}()
+
+	h1 := &http.Client{Transport: &http.Transport{}}
+	h2 := &http.Client{Transport: &gohttp2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	defer h1.CloseIdleConnections()
+	defer h2.CloseIdleConnections()
+
+	url := "http://" + listener.Addr().String()
+	for _, client := range []*http.Client{h1, h2, h1} {
+		req, err := http.NewRequest("POST", url+"/upload", strings.NewReader("payload"))
+		require.NoError(t, err)
+		req.Header.Set("X-Test", "yes")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("POST %s /upload x-test=yes body=payload", listener.Addr()), string(body), resp.Proto)
+	}
+}
+
+func TestHTTP1BadRequestStatus(t *testing.T) {
+	tests := []struct {
+		request string
+		code    int
+	}{
+		{"BREW /pot HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusNotImplemented},
+		{"POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", http.StatusNotImplemented},
+		{"GET /" + strings.Repeat("a", 16<<10) + " HTTP/1.1\r\n\r\n", http.StatusRequestURITooLong},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n folded\r\n\r\n", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		conn, r := newHTTP1TestConn(t, echoHandler)
+		writeRequests(t, conn, tt.request)
+		resp, _ := readResponse(t, r, "GET")
+		assert.Equal(t, tt.code, resp.StatusCode)
+		assert.True(t, resp.Close)
+	}
+}
+
+// failingWriter fails every write, like a connection the client has gone
+// away from.
+type failingWriter struct{}
+
+func (failingWriter) Write(bs []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestHTTP1ResponseWriteErrors(t *testing.T) {
+	for _, protocol := range []string{"HTTP/1.1", "HTTP/1.0"} {
+		t.Run(protocol, func(t *testing.T) {
+			w := bufio.NewWriterSize(failingWriter{}, 16)
+			rw := newHTTP1ResponseWriter(w, &http11.HTTP11Request{Method: "GET", Protocol: protocol}, true)
+
+			// buffered until it outgrows http1BufferSize
+			n, err := rw.Write([]byte("hello"))
+			assert.Equal(t, 5, n)
+			assert.NoError(t, err)
+
+			_, err = rw.Write(make([]byte, http1BufferSize))
+			assert.ErrorIs(t, err, io.ErrClosedPipe)
+			_, err = rw.Write([]byte("more"))
+			assert.ErrorIs(t, err, io.ErrClosedPipe)
+			if protocol == "HTTP/1.1" {
+				// the last chunk
+				assert.ErrorIs(t, rw.finish(), io.ErrClosedPipe)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package http2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const defaultPingTimeout = 15 * time.Second
+
+var (
+	errNotHTTP2    = errors.New("http2: connection is not speaking HTTP/2")
+	errConnClosed  = errors.New("http2: connection closed")
+	errPingTimeout = errors.New("http2: client did not acknowledge PING")
+)
+
+// Ping sends a PING frame and waits for the client to acknowledge it,
+// returning the round trip time.
+func (c *Connection) Ping(ctx context.Context) (time.Duration, error) {
+	c.pingMu.Lock()
+	if c.pings == nil {
+		c.pingMu.Unlock()
+		return 0, errNotHTTP2
+	}
+	c.pingSeq++
+	var opaque [8]byte
+	binary.BigEndian.PutUint64(opaque[:], c.pingSeq)
+	ack := make(chan struct{})
+	c.pings[opaque] = ack
+	c.pingMu.Unlock()
+
+	defer func() {
+		c.pingMu.Lock()
+		delete(c.pings, opaque)
+		c.pingMu.Unlock()
+	}()
+
+	start := time.Now()
+	if !c.queueFrame(&PingFrame{Opaque: opaque[:]}) {
+		return 0, errConnClosed
+	}
+
+	select {
+	case <-ack:
+		return time.Since(start), nil
+	case <-c.done:
+		return 0, errConnClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (c *Connection) handlePingAck(fr *PingFrame) {
+	var opaque [8]byte
+	copy(opaque[:], fr.Opaque)
+
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	if ack, ok := c.pings[opaque]; ok {
+		close(ack)
+		delete(c.pings, opaque)
+	}
+}
+
+// queueFrame is writeFrame for goroutines other than the reader, giving up
+// once the connection has shut down.
+func (c *Connection) queueFrame(frame Frame) bool {
+	select {
+	case c.streamEvents <- StreamOutgoingFrameEvent{Frame: frame}:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// startKeepalive enables Ping and, if IdleTimeout or ReadIdleTimeout are
+// set, watches the connection once it speaks HTTP/2.
+func (c *Connection) startKeepalive(ctx context.Context) {
+	c.pingMu.Lock()
+	c.pings = map[[8]byte]chan struct{}{}
+	c.pingMu.Unlock()
+
+	c.streamMu.Lock()
+	c.idleSince = time.Now()
+	c.streamMu.Unlock()
+	c.lastRead.Store(time.Now().UnixNano())
+
+	if c.IdleTimeout <= 0 && c.ReadIdleTimeout <= 0 {
+		return
+	}
+	c.writerWG.Add(1)
+	go c.keepalive(ctx)
+}
+
+// keepalive ends the connection with GOAWAY once it has been idle for
+// IdleTimeout, and checks on the client with a PING whenever nothing has
+// been read for ReadIdleTimeout.
+func (c *Connection) keepalive(ctx context.Context) {
+	defer c.writerWG.Done()
+
+	for {
+		now := time.Now()
+		var wait time.Duration
+
+		if c.IdleTimeout > 0 {
+			wait = c.IdleTimeout
+			if idle, since := c.idleTime(); idle {
+				wait = since.Add(c.IdleTimeout).Sub(now)
+				if wait <= 0 {
+					c.stop(connError(ErrNoError, "idle for %s", c.IdleTimeout))
+					return
+				}
+			}
+		}
+
+		if c.ReadIdleTimeout > 0 {
+			lastRead := time.Unix(0, c.lastRead.Load())
+			untilPing := lastRead.Add(c.ReadIdleTimeout).Sub(now)
+			if untilPing <= 0 {
+				if !c.checkAlive(ctx) {
+					return
+				}
+				continue
+			}
+			if wait <= 0 || untilPing < wait {
+				wait = untilPing
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-c.idleChanged:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// checkAlive pings the client, stopping the connection if the PING isn't
+// acknowledged within PingTimeout.
+func (c *Connection) checkAlive(ctx context.Context) bool {
+	timeout := c.PingTimeout
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rtt, err := c.Ping(pingCtx)
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		c.log.Warn("client did not answer PING", "err", err)
+		c.stop(errPingTimeout)
+		return false
+	}
+	c.log.Debug("client answered PING", "rtt", rtt)
+	return true
+}
+
+// idleTime reports whether the connection has no open streams, and since
+// when.
+func (c *Connection) idleTime() (bool, time.Time) {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	return len(c.streams) == 0, c.idleSince
+}
+
+// stop ends the connection from outside the reader loop, which returns
+// err in place of whatever its pending read fails with.
+func (c *Connection) stop(err error) {
+	c.stopMu.Lock()
+	if c.stopErr == nil {
+		c.stopErr = err
+	}
+	c.stopMu.Unlock()
+
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+func (c *Connection) stopped() error {
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+	return c.stopErr
+}
+
+// clearReadDeadline lifts a read deadline, unless stop has set one since.
+func (c *Connection) clearReadDeadline() {
+	c.Conn.SetReadDeadline(time.Time{})
+	if c.stopped() != nil {
+		c.Conn.SetReadDeadline(time.Now())
+	}
+}
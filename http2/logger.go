@@ -0,0 +1,62 @@
+package http2
+
+import "sync/atomic"
+
+// Logger receives diagnostics as a message followed by alternating keys
+// and values, the way *slog.Logger takes them, which satisfies it.
+// Records carry the connection and stream they concern as "conn" and
+// "stream", and where it applies the frame type as "frame", the error code
+// as "code" and the error as "err".
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger is used when no Logger is set, keeping the server silent.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// argsLogger adds args to every record logged through it.
+type argsLogger struct {
+	l    Logger
+	args []interface{}
+}
+
+func withArgs(l Logger, args ...interface{}) Logger {
+	if _, ok := l.(nopLogger); ok {
+		return l
+	}
+	if al, ok := l.(argsLogger); ok {
+		return argsLogger{l: al.l, args: al.with(args)}
+	}
+	return argsLogger{l: l, args: args}
+}
+
+func (l argsLogger) with(args []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(l.args)+len(args))
+	return append(append(all, l.args...), args...)
+}
+
+func (l argsLogger) Debug(msg string, args ...interface{}) { l.l.Debug(msg, l.with(args)...) }
+func (l argsLogger) Info(msg string, args ...interface{})  { l.l.Info(msg, l.with(args)...) }
+func (l argsLogger) Warn(msg string, args ...interface{})  { l.l.Warn(msg, l.with(args)...) }
+func (l argsLogger) Error(msg string, args ...interface{}) { l.l.Error(msg, l.with(args)...) }
+
+// connIDs numbers connections for the "conn" field of their records.
+var connIDs atomic.Uint64
+
+// initLogger sets up the logger of a connection about to be served.
+func (c *Connection) initLogger() {
+	c.id = connIDs.Add(1)
+	var l Logger = nopLogger{}
+	if c.Logger != nil {
+		l = c.Logger
+	}
+	c.log = withArgs(l, "conn", c.id)
+}
@@ -0,0 +1,90 @@
+package http2
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ Logger = (*slog.Logger)(nil)
+
+// syncBuffer is a bytes.Buffer safe to read while the connection logs.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(bs []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(bs)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConnectionLogger(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := &Connection{Logger: logger}
+	tc := newTestClient(t, c)
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(1)
+	tc.writeData(3, false, []byte("idle stream"))
+	tc.expectGoAway(ErrProtocolError)
+
+	logged := out.String()
+	connField := "conn=" + slogValue(c.id)
+	var sawStream, sawGoAway bool
+	for _, line := range strings.Split(strings.TrimSpace(logged), "\n") {
+		assert.Contains(t, line, connField, "every record names the connection")
+		if strings.Contains(line, "stream=1") && strings.Contains(line, "frame=HEADERS") {
+			sawStream = true
+		}
+		if strings.Contains(line, "level=WARN") && strings.Contains(line, "code=PROTOCOL_ERROR") {
+			sawGoAway = true
+		}
+	}
+	assert.True(t, sawStream, "HEADERS frame of stream 1 logged:\n%s", logged)
+	assert.True(t, sawGoAway, "GOAWAY logged as a warning:\n%s", logged)
+}
+
+func TestConnectionLoggerLevels(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	tc := newTestClient(t, &Connection{
+		Logger: logger,
+		Handler: func(w http.ResponseWriter, r Request) {
+			w.Write([]byte("quiet"))
+		},
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(1)
+
+	// frames are only logged at debug level
+	assert.NotContains(t, out.String(), "frame=")
+	assert.Contains(t, out.String(), "serving connection")
+}
+
+func TestWithArgs(t *testing.T) {
+	assert.Equal(t, nopLogger{}, withArgs(nopLogger{}, "conn", 1), "silent loggers stay silent")
+
+	var out syncBuffer
+	l := withArgs(withArgs(slog.New(slog.NewTextHandler(&out, nil)), "conn", 1), "stream", 3)
+	l.Info("hello", "frame", FrameData)
+	assert.Contains(t, out.String(), `msg=hello conn=1 stream=3 frame=DATA`)
+}
+
+func slogValue(v uint64) string {
+	return slog.Uint64Value(v).String()
+}
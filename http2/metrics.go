@@ -0,0 +1,319 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakegut/goh2/hpack"
+)
+
+// handlerBuckets are the upper bounds of the handler latency histogram in
+// seconds, the Prometheus client defaults.
+var handlerBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counters, gauges and a histogram over every connection
+// it is set on, served in the Prometheus text format by ServeHTTP. The zero
+// value is ready to use, and a single Metrics is usually shared by all the
+// connections of a process, e.g. through Server.
+//
+// Flow control stalls are only counted for the windows we grant clients.
+// Responses are sent without regard for the client's windows, so sending
+// never waits on them and there is nothing to measure.
+type Metrics struct {
+	activeConns   atomic.Int64
+	activeStreams atomic.Int64
+
+	framesRead    [frameTypeCount + 1]atomic.Uint64
+	framesWritten [frameTypeCount + 1]atomic.Uint64
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+
+	// the HPACK tables are indexed by whether they are the encoder's
+	tableSize    [2]atomic.Int64
+	plainBytes   [2]atomic.Uint64
+	encodedBytes [2]atomic.Uint64
+
+	// the receive windows are indexed by whether they are a stream's
+	flowStalls [2]atomic.Uint64
+
+	handlerCounts [len(handlerBuckets) + 1]atomic.Uint64
+	handlerNanos  atomic.Int64
+
+	closedMu sync.Mutex
+	closed   map[streamClose]uint64
+}
+
+// frameTypeCount is the number of frame types defined by RFC 9113, the
+// frame counters keeping one more for frames of unknown type.
+const frameTypeCount = int(FrameContinuation) + 1
+
+// streamClose is how a stream ended: the state it was in when it closed
+// and the error code that closed it.
+type streamClose struct {
+	state StreamState
+	code  ErrorCode
+}
+
+type streamCloseCount struct {
+	streamClose
+	count uint64
+}
+
+func (m *Metrics) connOpened() {
+	if m != nil {
+		m.activeConns.Add(1)
+	}
+}
+
+// connClosed drops a connection, along with its HPACK tables, from the
+// gauges.
+func (m *Metrics) connClosed(decoderTable, encoderTable hpackTableSize) {
+	if m == nil {
+		return
+	}
+	m.activeConns.Add(-1)
+	m.tableSize[0].Add(-int64(decoderTable.size))
+	m.tableSize[1].Add(-int64(encoderTable.size))
+}
+
+func (m *Metrics) streamOpened() {
+	if m != nil {
+		m.activeStreams.Add(1)
+	}
+}
+
+func (m *Metrics) streamClosed(state StreamState, code ErrorCode) {
+	if m == nil {
+		return
+	}
+	m.activeStreams.Add(-1)
+	m.closedMu.Lock()
+	defer m.closedMu.Unlock()
+	if m.closed == nil {
+		m.closed = map[streamClose]uint64{}
+	}
+	m.closed[streamClose{state, code}]++
+}
+
+func frameIndex(t FrameType) int {
+	if int(t) < frameTypeCount {
+		return int(t)
+	}
+	return frameTypeCount
+}
+
+func (m *Metrics) frameRead(t FrameType) {
+	if m != nil {
+		m.framesRead[frameIndex(t)].Add(1)
+	}
+}
+
+func (m *Metrics) frameWritten(t FrameType) {
+	if m != nil {
+		m.framesWritten[frameIndex(t)].Add(1)
+	}
+}
+
+// headerBlock accounts for a header list of plain bytes, counting names
+// and values, compressed into a block of encoded bytes.
+func (m *Metrics) headerBlock(encoder bool, plain, encoded int) {
+	if m != nil {
+		m.plainBytes[boolInt(encoder)].Add(uint64(plain))
+		m.encodedBytes[boolInt(encoder)].Add(uint64(encoded))
+	}
+}
+
+// headerListSize is the size of headers without HPACK, counting names and
+// values.
+func headerListSize(headers []hpack.Header) int {
+	size := 0
+	for _, header := range headers {
+		size += len(header.Name) + len(header.Value)
+	}
+	return size
+}
+
+func (m *Metrics) hpackTableResized(encoder bool, delta int) {
+	if m != nil {
+		m.tableSize[boolInt(encoder)].Add(int64(delta))
+	}
+}
+
+// flowControlStall counts a receive window used up by the client, which
+// has to wait for the body to be read before it can send more.
+func (m *Metrics) flowControlStall(stream bool) {
+	if m != nil {
+		m.flowStalls[boolInt(stream)].Add(1)
+	}
+}
+
+func (m *Metrics) handlerDone(d time.Duration) {
+	if m == nil {
+		return
+	}
+	i := sort.SearchFloat64s(handlerBuckets[:], d.Seconds())
+	m.handlerCounts[i].Add(1)
+	m.handlerNanos.Add(int64(d))
+}
+
+// meteredConn counts the bytes going over a connection.
+type meteredConn struct {
+	net.Conn
+	m *Metrics
+}
+
+func (c meteredConn) Read(bs []byte) (int, error) {
+	n, err := c.Conn.Read(bs)
+	c.m.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+func (c meteredConn) Write(bs []byte) (int, error) {
+	n, err := c.Conn.Write(bs)
+	c.m.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.serve(w)
+}
+
+// Handler returns a HandlerFunc serving the metrics like ServeHTTP, for
+// exposing them from a Connection or Server of this package.
+func (m *Metrics) Handler() HandlerFunc {
+	return func(w http.ResponseWriter, r Request) {
+		m.serve(w)
+	}
+}
+
+func (m *Metrics) serve(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition
+// format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	metricHeader(&buf, "goh2_connections_active", "gauge", "Connections being served.")
+	fmt.Fprintf(&buf, "goh2_connections_active %d\n", m.activeConns.Load())
+
+	metricHeader(&buf, "goh2_streams_active", "gauge", "Streams not yet closed.")
+	fmt.Fprintf(&buf, "goh2_streams_active %d\n", m.activeStreams.Load())
+
+	metricHeader(&buf, "goh2_streams_closed_total", "counter", "Streams closed, by the state they closed in and the error code that closed them.")
+	for _, c := range m.streamCloses() {
+		fmt.Fprintf(&buf, "goh2_streams_closed_total{state=%q,code=%q} %d\n", stateLabel(c.state), c.code, c.count)
+	}
+
+	metricHeader(&buf, "goh2_frames_read_total", "counter", "Frames read, by type.")
+	writeFrameCounts(&buf, "goh2_frames_read_total", &m.framesRead)
+	metricHeader(&buf, "goh2_frames_written_total", "counter", "Frames written, by type.")
+	writeFrameCounts(&buf, "goh2_frames_written_total", &m.framesWritten)
+
+	metricHeader(&buf, "goh2_read_bytes_total", "counter", "Bytes read from connections.")
+	fmt.Fprintf(&buf, "goh2_read_bytes_total %d\n", m.bytesRead.Load())
+	metricHeader(&buf, "goh2_written_bytes_total", "counter", "Bytes written to connections.")
+	fmt.Fprintf(&buf, "goh2_written_bytes_total %d\n", m.bytesWritten.Load())
+
+	tables := [2]string{"decoder", "encoder"}
+	metricHeader(&buf, "goh2_hpack_dynamic_table_size_bytes", "gauge", "Size of the entries in the HPACK dynamic tables of all connections.")
+	for i, table := range tables {
+		fmt.Fprintf(&buf, "goh2_hpack_dynamic_table_size_bytes{table=%q} %d\n", table, m.tableSize[i].Load())
+	}
+	metricHeader(&buf, "goh2_hpack_header_bytes_total", "counter", "Bytes of header names and values decoded or encoded.")
+	for i, table := range tables {
+		fmt.Fprintf(&buf, "goh2_hpack_header_bytes_total{table=%q} %d\n", table, m.plainBytes[i].Load())
+	}
+	metricHeader(&buf, "goh2_hpack_block_bytes_total", "counter", "Bytes of header blocks decoded or encoded.")
+	for i, table := range tables {
+		fmt.Fprintf(&buf, "goh2_hpack_block_bytes_total{table=%q} %d\n", table, m.encodedBytes[i].Load())
+	}
+	metricHeader(&buf, "goh2_hpack_compression_ratio", "gauge", "Bytes of header blocks per byte of header names and values.")
+	for i, table := range tables {
+		ratio := math.NaN()
+		if plain := m.plainBytes[i].Load(); plain > 0 {
+			ratio = float64(m.encodedBytes[i].Load()) / float64(plain)
+		}
+		fmt.Fprintf(&buf, "goh2_hpack_compression_ratio{table=%q} %s\n", table, formatFloat(ratio))
+	}
+
+	metricHeader(&buf, "goh2_flow_control_stalls_total", "counter", "Times a client used up a receive window, leaving it waiting for the request body to be read.")
+	for i, window := range [2]string{"connection", "stream"} {
+		fmt.Fprintf(&buf, "goh2_flow_control_stalls_total{window=%q} %d\n", window, m.flowStalls[i].Load())
+	}
+
+	metricHeader(&buf, "goh2_handler_duration_seconds", "histogram", "Time handlers took to return.")
+	var count uint64
+	for i, le := range handlerBuckets {
+		count += m.handlerCounts[i].Load()
+		fmt.Fprintf(&buf, "goh2_handler_duration_seconds_bucket{le=%q} %d\n", formatFloat(le), count)
+	}
+	count += m.handlerCounts[len(handlerBuckets)].Load()
+	fmt.Fprintf(&buf, "goh2_handler_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(&buf, "goh2_handler_duration_seconds_sum %s\n", formatFloat(time.Duration(m.handlerNanos.Load()).Seconds()))
+	fmt.Fprintf(&buf, "goh2_handler_duration_seconds_count %d\n", count)
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// streamCloses returns how many streams ended each way so far, in a
+// stable order.
+func (m *Metrics) streamCloses() []streamCloseCount {
+	m.closedMu.Lock()
+	closes := make([]streamCloseCount, 0, len(m.closed))
+	for c, count := range m.closed {
+		closes = append(closes, streamCloseCount{c, count})
+	}
+	m.closedMu.Unlock()
+	sort.Slice(closes, func(i, j int) bool {
+		if closes[i].state != closes[j].state {
+			return closes[i].state < closes[j].state
+		}
+		return closes[i].code < closes[j].code
+	})
+	return closes
+}
+
+func metricHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeFrameCounts(buf *bytes.Buffer, name string, counts *[frameTypeCount + 1]atomic.Uint64) {
+	for i := range counts {
+		label := "UNKNOWN"
+		if i < frameTypeCount {
+			label = FrameType(i).String()
+		}
+		fmt.Fprintf(buf, "%s{type=%q} %d\n", name, label, counts[i].Load())
+	}
+}
+
+// stateLabel turns a stream state such as "half closed (remote)" into a
+// label value such as "half_closed_remote".
+func stateLabel(state StreamState) string {
+	return strings.NewReplacer(" (", "_", ")", "", " ", "_").Replace(string(state))
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
@@ -0,0 +1,184 @@
+package http2
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape parses the samples m exposes, keyed by name and labels.
+func scrape(t *testing.T, m *Metrics) map[string]float64 {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	require.NoError(t, err)
+
+	samples := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err, line)
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+// expectSamples waits for the samples of m to reach want, as streams and
+// handlers finish after their responses have been read.
+func expectSamples(t *testing.T, m *Metrics, want map[string]float64) {
+	t.Helper()
+	var samples map[string]float64
+	ok := assert.Eventually(t, func() bool {
+		samples = scrape(t, m)
+		for name, value := range want {
+			if samples[name] != value {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	if !ok {
+		for name, value := range want {
+			assert.Equal(t, value, samples[name], name)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := &Metrics{}
+	tc := newTestClient(t, &Connection{
+		Metrics: m,
+		Handler: func(w http.ResponseWriter, r Request) {
+			if r.Method == "GET" {
+				time.Sleep(30 * time.Millisecond)
+			}
+			io.Copy(io.Discard, r.Body)
+		},
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(1)
+	tc.writeHeaders(3, false, requestHeaders("POST", "/")...)
+	tc.writeFrame(&RSTStreamFrame{
+		Framed:    Framed{Header: FrameHeader{StreamID: 3}},
+		ErrorCode: ErrCancel,
+	})
+	// a frame of unknown type
+	tc.writeRaw([]byte{0, 0, 0, 0xff, 0, 0, 0, 0, 0})
+	tc.ping()
+
+	expectSamples(t, m, map[string]float64{
+		`goh2_connections_active`: 1,
+		`goh2_streams_active`:     0,
+		`goh2_streams_closed_total{state="half_closed_remote",code="NO_ERROR"}`: 1,
+		`goh2_streams_closed_total{state="open",code="CANCEL"}`:                 1,
+		`goh2_frames_read_total{type="HEADERS"}`:                                2,
+		`goh2_frames_read_total{type="RST_STREAM"}`:                             1,
+		`goh2_frames_read_total{type="UNKNOWN"}`:                                1,
+		`goh2_frames_written_total{type="HEADERS"}`:                             1,
+		`goh2_frames_written_total{type="PING"}`:                                1,
+	})
+
+	samples := scrape(t, m)
+	// the handler of the reset stream may not have got to run
+	assert.Equal(t, samples[`goh2_handler_duration_seconds_count`], samples[`goh2_handler_duration_seconds_bucket{le="+Inf"}`])
+	assert.GreaterOrEqual(t, samples[`goh2_handler_duration_seconds_count`], 1.0)
+	assert.GreaterOrEqual(t, samples[`goh2_handler_duration_seconds_sum`], 0.03)
+	assert.Greater(t, samples[`goh2_read_bytes_total`], float64(len(ClientPreface)))
+	assert.Greater(t, samples[`goh2_written_bytes_total`], 0.0)
+	assert.Greater(t, samples[`goh2_hpack_dynamic_table_size_bytes{table="decoder"}`], 0.0)
+	assert.Greater(t, samples[`goh2_hpack_dynamic_table_size_bytes{table="encoder"}`], 0.0)
+	for _, table := range []string{"decoder", "encoder"} {
+		plain := samples[`goh2_hpack_header_bytes_total{table="`+table+`"}`]
+		encoded := samples[`goh2_hpack_block_bytes_total{table="`+table+`"}`]
+		assert.Greater(t, plain, 0.0)
+		assert.Equal(t, encoded/plain, samples[`goh2_hpack_compression_ratio{table="`+table+`"}`])
+	}
+
+	// a closed connection takes its HPACK tables along
+	tc.conn.Close()
+	expectSamples(t, m, map[string]float64{
+		`goh2_connections_active`:                              0,
+		`goh2_hpack_dynamic_table_size_bytes{table="decoder"}`: 0,
+		`goh2_hpack_dynamic_table_size_bytes{table="encoder"}`: 0,
+	})
+}
+
+func TestMetricsAbandonedStreams(t *testing.T) {
+	m := &Metrics{}
+	tc := newTestClient(t, &Connection{Metrics: m})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeData(3, false, []byte("idle stream"))
+	tc.expectGoAway(ErrProtocolError)
+
+	expectSamples(t, m, map[string]float64{
+		`goh2_streams_active`: 0,
+		`goh2_streams_closed_total{state="open",code="PROTOCOL_ERROR"}`: 1,
+	})
+}
+
+func TestMetricsFlowControlStalls(t *testing.T) {
+	m := &Metrics{}
+	release := make(chan struct{})
+	defer close(release)
+	tc := newTestClient(t, &Connection{
+		Metrics: m,
+		Handler: func(w http.ResponseWriter, r Request) {
+			<-release
+		},
+	})
+
+	// the handler doesn't read, so a window's worth leaves the client
+	// unable to send more
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeBody(1, initialWindowSize)
+	tc.ping()
+
+	expectSamples(t, m, map[string]float64{
+		`goh2_flow_control_stalls_total{window="connection"}`: 1,
+		`goh2_flow_control_stalls_total{window="stream"}`:     1,
+	})
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := &Metrics{}
+	m.handlerDone(30 * time.Millisecond)
+	m.handlerDone(2 * time.Second)
+	m.handlerDone(time.Minute)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# HELP goh2_handler_duration_seconds Time handlers took to return.\n" +
+			"# TYPE goh2_handler_duration_seconds histogram\n",
+		`goh2_handler_duration_seconds_bucket{le="0.025"} 0` + "\n",
+		`goh2_handler_duration_seconds_bucket{le="0.05"} 1` + "\n",
+		`goh2_handler_duration_seconds_bucket{le="2.5"} 2` + "\n",
+		`goh2_handler_duration_seconds_bucket{le="10"} 2` + "\n",
+		`goh2_handler_duration_seconds_bucket{le="+Inf"} 3` + "\n",
+		"goh2_handler_duration_seconds_sum 62.03\n",
+		"goh2_handler_duration_seconds_count 3\n",
+		// nothing compressed yet
+		`goh2_hpack_compression_ratio{table="decoder"} NaN` + "\n",
+		`goh2_frames_read_total{type="WINDOW_UPDATE"} 0` + "\n",
+		`goh2_flow_control_stalls_total{window="stream"} 0` + "\n",
+	} {
+		assert.Contains(t, body, want)
+	}
+}
@@ -0,0 +1,196 @@
+package http2
+
+import (
+	"net"
+	"sync"
+)
+
+// Server serves connections accepted from a listener, each with a
+// Connection of its own. Handlers of all its connections share a single
+// cap on how many run at once.
+type Server struct {
+	Handler HandlerFunc
+
+	// MaxConcurrentHandlers caps the handlers running at once across all
+	// connections. Requests beyond it wait for a handler to finish, in the
+	// order they arrived. Zero means no limit.
+	MaxConcurrentHandlers int
+
+	// MaxQueuedHandlers bounds how many requests may wait for a handler
+	// while MaxConcurrentHandlers are running. Requests beyond it are
+	// refused: HTTP/2 streams with REFUSED_STREAM, so the client may retry
+	// them, and HTTP/1.1 requests with a 503 response. Defaults to 1024.
+	MaxQueuedHandlers int
+
+	// Logger is the Logger of every connection.
+	Logger Logger
+
+	// Metrics, if set, collects the metrics of every connection.
+	Metrics *Metrics
+
+	// ConfigureConnection, if set, is called with every connection before
+	// it is served, e.g. to set its timeouts and limits.
+	ConfigureConnection func(c *Connection)
+
+	poolOnce sync.Once
+	pool     *handlerPool
+}
+
+// Serve accepts connections on l and serves each in its own goroutine,
+// until accepting fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves conn, returning once it has been closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	c := &Connection{
+		Conn:    conn,
+		Handler: s.Handler,
+		Logger:  s.Logger,
+		Metrics: s.Metrics,
+	}
+	if s.ConfigureConnection != nil {
+		s.ConfigureConnection(c)
+	}
+	c.handlers = s.handlerPool()
+	c.Handle()
+}
+
+func (s *Server) handlerPool() *handlerPool {
+	s.poolOnce.Do(func() {
+		if s.MaxConcurrentHandlers > 0 {
+			maxQueue := s.MaxQueuedHandlers
+			if maxQueue <= 0 {
+				maxQueue = defaultMaxQueuedHandlers
+			}
+			s.pool = &handlerPool{max: s.MaxConcurrentHandlers, maxQueue: maxQueue}
+		}
+	})
+	return s.pool
+}
+
+const defaultMaxQueuedHandlers = 1024
+
+// handlerPool runs handlers on at most max goroutines, queuing up to
+// maxQueue more in arrival order. Each goroutine carries on with the next
+// queued handler once its own has finished. A nil pool runs every handler
+// right away in a goroutine of its own.
+type handlerPool struct {
+	max int
+	// maxQueue of zero queues without limit.
+	maxQueue int
+
+	mu      sync.Mutex
+	running int
+	queue   []*handlerJob
+}
+
+type handlerJob struct {
+	// connDone is the done channel of the connection the job belongs to.
+	connDone <-chan struct{}
+	run      func()
+	// drop is called in place of run if the connection closes while the
+	// job is queued.
+	drop func()
+}
+
+// submit runs job, or queues it if every goroutine is busy. It reports
+// false, without running or dropping job, if the queue is full.
+func (p *handlerPool) submit(job *handlerJob) bool {
+	if p == nil {
+		go job.run()
+		return true
+	}
+
+	p.mu.Lock()
+	if p.running < p.max {
+		p.running++
+		p.mu.Unlock()
+		go p.work(job)
+		return true
+	}
+	if p.maxQueue > 0 && len(p.queue) >= p.maxQueue {
+		p.mu.Unlock()
+		return false
+	}
+	p.queue = append(p.queue, job)
+	p.mu.Unlock()
+	return true
+}
+
+func (p *handlerPool) work(job *handlerJob) {
+	for job != nil {
+		job.run()
+		job = p.next()
+	}
+}
+
+// next takes the oldest queued job, or retires the calling goroutine if
+// there is none.
+func (p *handlerPool) next() *handlerJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		p.running--
+		return nil
+	}
+	job := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return job
+}
+
+// call runs fn through the pool, returning once it has. It reports false
+// if the queue was full and fn never ran.
+func (p *handlerPool) call(fn func()) bool {
+	if p == nil {
+		fn()
+		return true
+	}
+	done := make(chan struct{})
+	if !p.submit(&handlerJob{
+		run: func() {
+			defer close(done)
+			fn()
+		},
+		drop: func() { close(done) },
+	}) {
+		return false
+	}
+	<-done
+	return true
+}
+
+// cancel drops the queued jobs of the connection closed by connDone.
+func (p *handlerPool) cancel(connDone <-chan struct{}) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	var dropped []*handlerJob
+	kept := p.queue[:0]
+	for _, job := range p.queue {
+		if job.connDone == connDone {
+			dropped = append(dropped, job)
+		} else {
+			kept = append(kept, job)
+		}
+	}
+	for i := len(kept); i < len(p.queue); i++ {
+		p.queue[i] = nil
+	}
+	p.queue = kept
+	p.mu.Unlock()
+
+	for _, job := range dropped {
+		job.drop()
+	}
+}
@@ -0,0 +1,249 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerPool(t *testing.T) {
+	p := &handlerPool{max: 2}
+	release := make(chan struct{})
+	started := make(chan int, 5)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		i := i
+		wg.Add(1)
+		p.submit(&handlerJob{
+			run: func() {
+				defer wg.Done()
+				started <- i
+				<-release
+			},
+		})
+	}
+
+	assert.ElementsMatch(t, []int{0, 1}, []int{<-started, <-started})
+	select {
+	case i := <-started:
+		t.Fatalf("job %d started beyond the limit", i)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	wg.Wait()
+	// the rest in the order they were queued
+	assert.Equal(t, []int{2, 3, 4}, []int{<-started, <-started, <-started})
+}
+
+func TestHandlerPoolCancel(t *testing.T) {
+	p := &handlerPool{max: 1}
+	release := make(chan struct{})
+	p.submit(&handlerJob{run: func() { <-release }})
+
+	done := make(chan struct{})
+	dropped := make(chan struct{})
+	p.submit(&handlerJob{
+		connDone: done,
+		run:      func() { t.Error("job of a closed connection ran") },
+		drop:     func() { close(dropped) },
+	})
+
+	close(done)
+	p.cancel(done)
+	<-dropped
+	close(release)
+}
+
+func TestHandlerPoolQueueFull(t *testing.T) {
+	p := &handlerPool{max: 1, maxQueue: 1}
+	release := make(chan struct{})
+	defer close(release)
+
+	assert.True(t, p.submit(&handlerJob{run: func() { <-release }}))
+	assert.True(t, p.submit(&handlerJob{run: func() {}}))
+	assert.False(t, p.submit(&handlerJob{run: func() { t.Error("job beyond the queue ran") }}))
+	assert.False(t, p.call(func() { t.Error("call beyond the queue ran") }))
+}
+
+func TestConnectionRefusesStreamsBeyondQueue(t *testing.T) {
+	release := make(chan struct{})
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			<-release
+			fmt.Fprint(w, r.Path)
+		},
+		handlers: &handlerPool{max: 1, maxQueue: 1},
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/running")...)
+	tc.writeHeaders(3, true, requestHeaders("GET", "/queued")...)
+	tc.writeHeaders(5, true, requestHeaders("GET", "/refused")...)
+	tc.expectRSTStream(5, ErrRefusedStream)
+
+	close(release)
+	_, body := tc.expectResponse(1)
+	assert.Equal(t, "/running", string(body))
+	_, body = tc.expectResponse(3)
+	assert.Equal(t, "/queued", string(body))
+}
+
+func TestHTTP1RefusedBeyondQueue(t *testing.T) {
+	p := &handlerPool{max: 1, maxQueue: 1}
+	release := make(chan struct{})
+	defer close(release)
+	p.submit(&handlerJob{run: func() { <-release }})
+	p.submit(&handlerJob{run: func() {}})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &Connection{Conn: server, Handler: echoHandler, handlers: p}
+	go c.Handle()
+
+	writeRequests(t, client, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, _ := readResponse(t, bufio.NewReader(client), "GET")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestConnectionQueuedStreamReset(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	c := &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			atomic.AddInt32(&calls, 1)
+			if r.Path == "/block" {
+				<-release
+			}
+			fmt.Fprint(w, r.Path)
+		},
+		handlers: &handlerPool{max: 1},
+	}
+	tc := newTestClient(t, c)
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/block")...)
+	tc.writeHeaders(3, true, requestHeaders("GET", "/reset")...)
+	tc.writeHeaders(5, true, requestHeaders("GET", "/queued")...)
+	tc.writeFrame(&RSTStreamFrame{
+		Framed:    Framed{Header: FrameHeader{StreamID: 3}},
+		ErrorCode: ErrCancel,
+	})
+	// the reader carries on while every handler slot is taken
+	tc.ping()
+
+	close(release)
+	_, body := tc.expectResponse(1)
+	assert.Equal(t, "/block", string(body))
+	_, body = tc.expectResponse(5)
+	assert.Equal(t, "/queued", string(body))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "the reset stream's handler never ran")
+}
+
+func TestServerMaxConcurrentHandlers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	var running, most int32
+	srv := &Server{
+		MaxConcurrentHandlers: 2,
+		Handler: func(w http.ResponseWriter, r Request) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			fmt.Fprint(w, "ok")
+		},
+	}
+	go srv.Serve(l)
+
+	// two clients, so two connections share the limit
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		tr := &Transport{}
+		defer tr.CloseIdleConnections()
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				resp, err := tr.RoundTrip(req)
+				if assert.NoError(t, err) {
+					resp.Body.Close()
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&most))
+}
+
+func BenchmarkConnectionConcurrentStreams(b *testing.B) {
+	const streams = 2000
+
+	for _, max := range []int{0, 64} {
+		b.Run(fmt.Sprintf("handlers=%d", max), func(b *testing.B) {
+			c := &Connection{
+				Handler: func(w http.ResponseWriter, r Request) {
+					time.Sleep(time.Millisecond)
+					fmt.Fprint(w, "ok")
+				},
+				MaxConcurrentStreams: streams,
+			}
+			if max > 0 {
+				c.handlers = &handlerPool{max: max}
+			}
+			tc := newTestClient(b, c)
+
+			block, err := tc.encoder.Encode(requestHeaders("GET", "/"))
+			require.NoError(b, err)
+			streamid := uint32(1)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// every stream is opened before the first response is read
+				var buf bytes.Buffer
+				for j := 0; j < streams; j++ {
+					bs, _ := (&HeadersFrame{
+						Framed:        Framed{Header: FrameHeader{StreamID: streamid}},
+						EndStream:     true,
+						EndHeaders:    true,
+						BlockFragment: block,
+					}).Encode()
+					buf.Write(bs)
+					streamid += 2
+				}
+				go tc.conn.Write(buf.Bytes())
+
+				for done := 0; done < streams; {
+					frame := tc.readFrame()
+					if frame == nil {
+						b.Fatal("connection closed")
+					}
+					if fr, ok := frame.(*DataFrame); ok && fr.EndStream {
+						done++
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*streams)/b.Elapsed().Seconds(), "streams/s")
+		})
+	}
+}
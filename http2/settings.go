@@ -1,8 +1,11 @@
 package http2
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
-type SettingsParam uint8
+type SettingsParam uint16
 
 const (
 	SettingsHeaderTableSize      SettingsParam = 0x1
@@ -13,6 +16,22 @@ const (
 	SettingsMaxHeaderListSize    SettingsParam = 0x6
 )
 
+var settingsParamNames = map[SettingsParam]string{
+	SettingsHeaderTableSize:      "SETTINGS_HEADER_TABLE_SIZE",
+	SettingsEnablePush:           "SETTINGS_ENABLE_PUSH",
+	SettingsMaxConcurrentStreams: "SETTINGS_MAX_CONCURRENT_STREAMS",
+	SettingsInitialWindowSize:    "SETTINGS_INITIAL_WINDOW_SIZE",
+	SettingsMaxFrameSize:         "SETTINGS_MAX_FRAME_SIZE",
+	SettingsMaxHeaderListSize:    "SETTINGS_MAX_HEADER_LIST_SIZE",
+}
+
+func (p SettingsParam) String() string {
+	if name, ok := settingsParamNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_SETTING_0x%x", uint16(p))
+}
+
 type ConnectionSettings struct {
 	HeaderTableSize      uint32
 	EnablePush           bool
@@ -33,28 +52,44 @@ func NewSettings() *ConnectionSettings {
 	}
 }
 
-func (s *ConnectionSettings) SetValue(param SettingsParam, value uint32) {
+func (s *ConnectionSettings) SetValue(param SettingsParam, value uint32) error {
 	switch param {
 	case SettingsHeaderTableSize:
 		s.HeaderTableSize = value
 	case SettingsEnablePush:
+		if value > 1 {
+			return connError(ErrProtocolError, "invalid SETTINGS_ENABLE_PUSH value %d", value)
+		}
 		s.EnablePush = value == 1
 	case SettingsMaxConcurrentStreams:
 		s.MaxConcurrentStreams = value
 	case SettingsInitialWindowSize:
+		if value > 1<<31-1 {
+			return connError(ErrFlowControlError, "invalid SETTINGS_INITIAL_WINDOW_SIZE value %d", value)
+		}
 		s.InitialWindowSize = value
 	case SettingsMaxFrameSize:
+		if value < 1<<14 || value > 1<<24-1 {
+			return connError(ErrProtocolError, "invalid SETTINGS_MAX_FRAME_SIZE value %d", value)
+		}
 		s.MaxFrameSize = value
 	case SettingsMaxHeaderListSize:
 		s.MaxHeaderListSize = &value
 	}
+	return nil
 }
 
-func (s *ConnectionSettings) DecodePayload(bs []byte) {
+func (s *ConnectionSettings) DecodePayload(bs []byte) error {
+	if len(bs)%6 != 0 {
+		return connError(ErrFrameSizeError, "settings payload of %d bytes is not a multiple of 6", len(bs))
+	}
 	for len(bs) > 0 {
 		ident := binary.BigEndian.Uint16(bs[0:])
 		value := binary.BigEndian.Uint32(bs[2:])
-		s.SetValue(SettingsParam(ident), value)
+		if err := s.SetValue(SettingsParam(ident), value); err != nil {
+			return err
+		}
 		bs = bs[6:]
 	}
+	return nil
 }
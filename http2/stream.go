@@ -2,12 +2,14 @@ package http2
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jakegut/goh2/hpack"
@@ -62,10 +64,102 @@ var (
 	StreamStateReservedLocal    StreamState = "reserved (local)"
 	StreamStateHalfClosedRemote StreamState = "half closed (remote)"
 
-	StreamStateReservedRemoteStreamState StreamState = "reserved (local)"
-	StreamStateHalfClosedLocal           StreamState = "half closed (local)"
+	StreamStateReservedRemote  StreamState = "reserved (remote)"
+	StreamStateHalfClosedLocal StreamState = "half closed (local)"
 )
 
+// StreamTrigger is something sent or received on a stream that may move it
+// to another state. A frame carrying END_STREAM is applied as two triggers:
+// the frame itself followed by SendEndStream or RecvEndStream.
+type StreamTrigger int
+
+const (
+	SendHeaders StreamTrigger = iota
+	RecvHeaders
+	SendPushPromise
+	RecvPushPromise
+	SendData
+	RecvData
+	SendEndStream
+	RecvEndStream
+	SendReset
+	RecvReset
+)
+
+var streamTriggerNames = [...]string{
+	SendHeaders:     "send H",
+	RecvHeaders:     "recv H",
+	SendPushPromise: "send PP",
+	RecvPushPromise: "recv PP",
+	SendData:        "send DATA",
+	RecvData:        "recv DATA",
+	SendEndStream:   "send ES",
+	RecvEndStream:   "recv ES",
+	SendReset:       "send R",
+	RecvReset:       "recv R",
+}
+
+func (t StreamTrigger) String() string {
+	if int(t) < len(streamTriggerNames) {
+		return streamTriggerNames[t]
+	}
+	return fmt.Sprintf("StreamTrigger(%d)", int(t))
+}
+
+// streamTransitions encodes the diagram above, plus the frames that are
+// allowed without changing state (e.g. DATA while open). Triggers missing
+// for a state are not allowed in it.
+var streamTransitions = map[StreamState]map[StreamTrigger]StreamState{
+	StreamStateIdle: {
+		SendHeaders:     StreamStateOpen,
+		RecvHeaders:     StreamStateOpen,
+		SendPushPromise: StreamStateReservedLocal,
+		RecvPushPromise: StreamStateReservedRemote,
+	},
+	StreamStateReservedLocal: {
+		SendHeaders: StreamStateHalfClosedRemote,
+		SendReset:   StreamStateClosed,
+		RecvReset:   StreamStateClosed,
+	},
+	StreamStateReservedRemote: {
+		RecvHeaders: StreamStateHalfClosedLocal,
+		SendReset:   StreamStateClosed,
+		RecvReset:   StreamStateClosed,
+	},
+	StreamStateOpen: {
+		SendHeaders:   StreamStateOpen,
+		RecvHeaders:   StreamStateOpen,
+		SendData:      StreamStateOpen,
+		RecvData:      StreamStateOpen,
+		SendEndStream: StreamStateHalfClosedLocal,
+		RecvEndStream: StreamStateHalfClosedRemote,
+		SendReset:     StreamStateClosed,
+		RecvReset:     StreamStateClosed,
+	},
+	StreamStateHalfClosedLocal: {
+		RecvHeaders:   StreamStateHalfClosedLocal,
+		RecvData:      StreamStateHalfClosedLocal,
+		RecvEndStream: StreamStateClosed,
+		SendReset:     StreamStateClosed,
+		RecvReset:     StreamStateClosed,
+	},
+	StreamStateHalfClosedRemote: {
+		SendHeaders:   StreamStateHalfClosedRemote,
+		SendData:      StreamStateHalfClosedRemote,
+		SendEndStream: StreamStateClosed,
+		SendReset:     StreamStateClosed,
+		RecvReset:     StreamStateClosed,
+	},
+	StreamStateClosed: {},
+}
+
+// NextStreamState returns the state a stream in state from moves to when
+// trigger happens, and false if trigger isn't allowed in that state.
+func NextStreamState(from StreamState, trigger StreamTrigger) (StreamState, bool) {
+	to, ok := streamTransitions[from][trigger]
+	return to, ok
+}
+
 type Request struct {
 	Method    string
 	Path      string
@@ -78,26 +172,78 @@ type Request struct {
 
 type HandlerFunc func(http.ResponseWriter, Request)
 
+// StreamTimeouts bounds how long a stream may take. Zero means no limit.
+type StreamTimeouts struct {
+	// ReadBody is how long the client has to send the request body once
+	// the request headers have arrived.
+	ReadBody time.Duration
+
+	// Write is how long the response may take, from the request headers
+	// arriving until the response has been sent.
+	Write time.Duration
+}
+
+var errStreamReset = errors.New("http2: stream reset")
+
 type Stream struct {
 	id uint32
 
-	state StreamState
+	// mu guards state, the timers and handlerStarted. It is held by the
+	// reader loop while handling a frame, and by whichever goroutine
+	// finishes or resets the stream. Nothing waits on the connection
+	// writer while holding it: frames and credit for the writer are queued
+	// in pending and pendingCredit, and sent by unlock.
+	mu            sync.Mutex
+	state         StreamState
+	pending       []StreamEvent
+	pendingCredit int
 
 	reqHeaders map[string]hpack.Header
 
-	incomingQueue <-chan Frame
 	outgoingQueue chan<- StreamEvent
+	connDone      <-chan struct{}
+
+	// resetSent is set once the stream has sent RST_STREAM, and resetting
+	// closed along with it, failing a write waiting on the writer.
+	resetSent atomic.Bool
+	resetting chan struct{}
+	// closed is set once the stream reaches the closed state or sends
+	// RST_STREAM, after which nothing more may be written for it. writeMu
+	// keeps frames from being queued after our RST_STREAM.
+	closed  atomic.Bool
+	writeMu sync.Mutex
+	// timedOut is set once the response took longer than timeouts.Write.
+	timedOut atomic.Bool
+
+	timeouts   StreamTimeouts
+	readTimer  *time.Timer
+	writeTimer *time.Timer
 
 	reqbuf *StreamReader
 	resbuf *StreamWriter
 
-	handler     HandlerFunc
-	handlerDone chan struct{}
-
-	handlerDoer sync.Once
-	handlerWg   sync.WaitGroup
-
-	log func(msg string, args ...interface{})
+	// recvWindow is how much DATA the client may still send on the
+	// stream, and recvUnacked how much the handler has read since the last
+	// WINDOW_UPDATE. recvHeld is the DATA charged to the connection window
+	// and not yet handed back with returnConnWindow.
+	recvWindow       int
+	recvUnacked      int
+	recvHeld         int
+	returnConnWindow func(n int)
+
+	handler HandlerFunc
+	// handlers runs the handler, or a goroutine of its own if nil.
+	handlers       *handlerPool
+	handlerStarted bool
+	// handlerWG is the connection's count of handlers not yet finished.
+	handlerWG *sync.WaitGroup
+
+	// code is the error code the stream is reset with, if it is.
+	code ErrorCode
+
+	log     Logger
+	trace   *ConnectionTrace
+	metrics *Metrics
 }
 
 type StreamEvent interface {
@@ -118,68 +264,141 @@ type StreamOutgoingFrameEvent struct {
 
 func (s StreamOutgoingFrameEvent) streamID() uint32 { return s.StreamID }
 
-func NewStream(id uint32, outgoing chan<- StreamEvent, handler HandlerFunc, wg *sync.WaitGroup) chan Frame {
-	incomingQueue := make(chan Frame)
-	s := &Stream{
+// NewStream returns an idle stream. Frames are handed to it by the reader
+// loop with deliver; the handler runs once the request headers have
+// arrived, counted by wg until it has finished.
+func NewStream(id uint32, outgoing chan<- StreamEvent, handler HandlerFunc, timeouts StreamTimeouts, connDone <-chan struct{}, wg *sync.WaitGroup) *Stream {
+	return &Stream{
 		state:         StreamStateIdle,
 		id:            id,
 		reqHeaders:    map[string]hpack.Header{},
-		incomingQueue: incomingQueue,
 		outgoingQueue: outgoing,
+		connDone:      connDone,
+		timeouts:      timeouts,
 		reqbuf:        NewStreamReader(),
+		resetting:     make(chan struct{}),
+		recvWindow:    initialWindowSize,
 		handler:       handler,
-		log: func(msg string, args ...interface{}) {
-			msg = fmt.Sprintf("[stream %02d]\t", id) + msg
-			log.Printf(msg, args...)
-		},
-		handlerDone: make(chan struct{}),
+		handlerWG:     wg,
+		log:           nopLogger{},
+	}
+}
+
+// deliver handles frame on the stream, reporting false if the stream has
+// already closed. It never waits on the handler.
+func (s *Stream) deliver(frame Frame) bool {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.state == StreamStateClosed {
+		return false
 	}
+	s.handleFrame(frame)
+	return true
+}
 
-	wg.Add(1)
-	go func() {
-		s.handleFrames()
-		s.handlerWg.Wait()
-		wg.Done()
-	}()
+// finishResponse ends the response once the handler has returned, unless
+// the stream was reset meanwhile.
+func (s *Stream) finishResponse() {
+	s.mu.Lock()
+	closed := s.state == StreamStateClosed
+	s.unlock()
+	if closed {
+		return
+	}
+	s.log.Debug("handler finished", "status", s.resbuf.statusCode)
+	// writeFrame drops the last frames if the stream is reset meanwhile
+	err := s.resbuf.sendData(true)
 
-	return incomingQueue
+	s.mu.Lock()
+	defer s.unlock()
+	if err != nil || s.state == StreamStateClosed {
+		return
+	}
+	s.apply(SendEndStream)
+	stopTimer(&s.writeTimer)
+	s.closeIfDone()
 }
 
-func (s *Stream) handleFrames() {
-	s.log("starting")
-	for s.state != StreamStateClosed {
-		select {
-		case frame := <-s.incomingQueue:
-			if _, ok := frame.(*RSTStreamFrame); ok {
-				s.transition(StreamStateClosed)
-				continue
-			}
-			s.log("handling %T in %s", frame, string(s.state))
-			switch s.state {
-			case StreamStateIdle:
-				s.handleIdle(frame)
-			case StreamStateOpen:
-				s.handlerDoer.Do(s.goHandle)
-				s.handleOpen(frame)
-			case StreamStateHalfClosedRemote:
-				s.handleHalfClosedRemote(frame)
-			default:
-				s.log("unhanded state: %q", string(s.state))
-			}
-		case <-s.handlerDone:
-			s.log("statuscode: %d", s.resbuf.statusCode)
-			s.resbuf.sendData(true)
-			s.transition(StreamStateClosed)
-		}
+// connClosed abandons the stream along with its connection, closed with
+// a GOAWAY carrying code.
+func (s *Stream) connClosed(code ErrorCode) {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.state == StreamStateClosed {
+		return
 	}
-	s.log("closing stream")
+	s.log.Debug("abandoning stream with its connection")
+	s.reqbuf.CloseWithError(errConnClosed)
+	s.trace.streamStateChange(s.id, s.state, StreamStateClosed)
+	s.metrics.streamClosed(s.state, code)
+	s.state = StreamStateClosed
+	s.stopTimers()
 }
 
-func (s *Stream) goHandle() {
-	s.log("go handle")
+// startTimers starts the clocks on the request body and the response once
+// the request headers have arrived.
+func (s *Stream) startTimers(endStream bool) {
+	if s.timeouts.ReadBody > 0 && !endStream {
+		s.readTimer = time.AfterFunc(s.timeouts.ReadBody, s.readTimedOut)
+	}
+	if s.timeouts.Write > 0 {
+		s.writeTimer = time.AfterFunc(s.timeouts.Write, s.writeTimedOut)
+	}
+}
+
+func (s *Stream) stopTimers() {
+	stopTimer(&s.readTimer)
+	stopTimer(&s.writeTimer)
+}
+
+func stopTimer(t **time.Timer) {
+	if *t != nil {
+		(*t).Stop()
+		*t = nil
+	}
+}
+
+func (s *Stream) readTimedOut() {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.readTimer == nil || s.state == StreamStateClosed {
+		// stopped meanwhile
+		return
+	}
+	s.log.Info("request body timed out", "code", ErrCancel)
+	s.readTimer = nil
+	s.reqbuf.CloseWithError(os.ErrDeadlineExceeded)
+	s.reset(ErrCancel)
+}
+
+func (s *Stream) writeTimedOut() {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.writeTimer == nil || s.state == StreamStateClosed {
+		return
+	}
+	s.log.Info("response timed out", "code", ErrCancel)
+	s.writeTimer = nil
+	s.timedOut.Store(true)
+	s.reqbuf.CloseWithError(os.ErrDeadlineExceeded)
+	s.reset(ErrCancel)
+}
+
+// requestReset resets the stream with code on behalf of the handler, after
+// which its returning is ignored.
+func (s *Stream) requestReset(code ErrorCode) {
+	s.mu.Lock()
+	defer s.unlock()
+	if s.state != StreamStateClosed {
+		s.reset(code)
+	}
+}
+
+// startHandler hands the request to the handler pool.
+func (s *Stream) startHandler() {
 	req := Request{Headers: make(map[string]string)}
 	s.resbuf = NewStreamWriter(s.id, s.writeFrame)
-	s.handlerWg.Add(1)
+	s.resbuf.reset = s.requestReset
 	for _, header := range s.reqHeaders {
 		switch header.Name {
 		case ":method":
@@ -193,113 +412,323 @@ func (s *Stream) goHandle() {
 		}
 	}
 
-	req.Body = s.reqbuf
-
-	go func() {
-		s.log("firing off handler")
-		s.handler(s.resbuf, req)
-		s.handlerDone <- struct{}{}
-		s.handlerWg.Done()
-	}()
+	req.Body = streamBody{s}
+
+	s.handlerWG.Add(1)
+	queued := s.handlers.submit(&handlerJob{
+		connDone: s.connDone,
+		run: func() {
+			defer s.handlerWG.Done()
+			defer s.discardBody()
+			if s.closed.Load() {
+				// reset while waiting its turn
+				return
+			}
+			s.log.Debug("running handler")
+			start := time.Now()
+			s.handler(s.resbuf, req)
+			s.metrics.handlerDone(time.Since(start))
+			s.finishResponse()
+		},
+		drop: s.handlerWG.Done,
+	})
+	if !queued {
+		s.log.Warn("refusing stream, too many handlers waiting")
+		s.handlerWG.Done()
+		s.reset(ErrRefusedStream)
+	}
 }
 
-func (s *Stream) handleIdle(frame Frame) {
+func (s *Stream) handleFrame(frame Frame) {
 	switch fr := frame.(type) {
+	case *RSTStreamFrame:
+		s.code = fr.ErrorCode
+		s.reqbuf.EOF()
+		s.apply(RecvReset)
 	case *HeadersFrame:
-		s.log("headers in idle")
-		for _, header := range fr.Headers {
-			s.log("[%s: %s]", header.Name, header.Value)
-			s.reqHeaders[header.Name] = header
+		first := s.state == StreamStateIdle
+		if !s.apply(RecvHeaders) {
+			s.streamClosedErr()
+			return
+		}
+		if first {
+			for _, header := range fr.Headers {
+				s.reqHeaders[header.Name] = header
+			}
+			s.startTimers(fr.EndStream)
+			if !s.handlerStarted {
+				s.handlerStarted = true
+				s.startHandler()
+			}
+		} else if !fr.EndStream {
+			// trailers must end the stream
+			s.reset(ErrProtocolError)
+			return
 		}
-		s.transition(StreamStateOpen)
-		s.handlerDoer.Do(s.goHandle)
 		if fr.EndStream {
-			s.reqbuf.EOF()
-			s.transition(StreamStateHalfClosedRemote)
+			s.recvEndStream()
 		}
-	default:
-		s.log("unhandled frame in idle state")
-	}
-}
-
-func (s *Stream) handleOpen(frame Frame) {
-	switch fr := frame.(type) {
 	case *DataFrame:
-		s.reqbuf.Write(fr.Data)
+		size := len(fr.Framed.Payload)
+		s.recvHeld += size
+		if !s.apply(RecvData) {
+			s.streamClosedErr()
+			s.returnWindow(size)
+			return
+		}
+		if size > s.recvWindow {
+			s.reset(ErrFlowControlError)
+			s.returnWindow(size)
+			return
+		}
+		s.recvWindow -= size
+		if size > 0 && s.recvWindow == 0 {
+			s.metrics.flowControlStall(true)
+		}
+		buffered := 0
+		if s.state != StreamStateHalfClosedLocal {
+			s.reqbuf.Write(fr.Data)
+			buffered = len(fr.Data)
+		}
 		if fr.EndStream {
-			s.reqbuf.EOF()
-			s.transition(StreamStateHalfClosedRemote)
+			s.recvEndStream()
 		}
-	default:
-		s.log("unhandled frame in open state")
+		// padding, and data after the response, is never read
+		s.returnWindow(size - buffered)
 	}
+	s.closeIfDone()
 }
 
-func (s *Stream) handleHalfClosedRemote(frame Frame) {
-	switch frame.(type) {
-	default:
-		s.streamClosedErr()
+// returnWindow acknowledges n bytes of DATA the stream is done with, to
+// the connection and, while the client may still send on it, to the
+// stream. WINDOW_UPDATE frames are only sent once half a window is due.
+// Called with s.mu held, the credit going out once unlock releases it.
+func (s *Stream) returnWindow(n int) {
+	if n > s.recvHeld {
+		// the body of an h2c upgrade never counted against any window
+		n = s.recvHeld
+	}
+	if n <= 0 {
+		return
+	}
+	s.recvHeld -= n
+	s.pendingCredit += n
+
+	if s.closed.Load() || (s.state != StreamStateOpen && s.state != StreamStateHalfClosedLocal) {
+		return
+	}
+	s.recvUnacked += n
+	if s.recvUnacked >= initialWindowSize/2 {
+		s.queueEvent(StreamOutgoingFrameEvent{
+			Frame: &WindowUpdateFrame{
+				Framed:        Framed{Header: FrameHeader{StreamID: s.id}},
+				SizeIncrement: uint32(s.recvUnacked),
+			},
+			StreamID: s.id,
+		})
+		s.recvWindow += s.recvUnacked
+		s.recvUnacked = 0
 	}
 }
 
+// discardBody hands back the credit of whatever the handler left unread
+// once it has returned, as nothing will read it anymore. Reads left behind
+// by the handler, e.g. after TimeoutHandler gave up on it, are woken up.
+func (s *Stream) discardBody() {
+	s.mu.Lock()
+	defer s.unlock()
+	s.reqbuf.CloseWithError(http.ErrBodyReadAfterClose)
+	s.returnWindow(s.recvHeld)
+}
+
+func (s *Stream) recvEndStream() {
+	s.reqbuf.EOF()
+	s.apply(RecvEndStream)
+	stopTimer(&s.readTimer)
+}
+
+// closeIfDone stops the timers of a stream that has closed.
+func (s *Stream) closeIfDone() {
+	if s.state == StreamStateClosed {
+		s.stopTimers()
+	}
+}
+
+// apply moves the stream along the transition for trigger, reporting false
+// and leaving the state alone if trigger isn't allowed in the current state.
+func (s *Stream) apply(trigger StreamTrigger) bool {
+	to, ok := NextStreamState(s.state, trigger)
+	if !ok {
+		s.log.Debug("transition not allowed", "trigger", trigger, "state", s.state)
+		return false
+	}
+	if to != s.state {
+		s.transition(to)
+	}
+	return true
+}
+
 func (s *Stream) streamClosedErr() {
-	s.writeFrame(&RSTStreamFrame{
-		Framed: Framed{
-			Header: FrameHeader{
-				StreamID: s.id,
+	s.reset(ErrStreamClosed)
+}
+
+func (s *Stream) reset(code ErrorCode) {
+	if !s.resetSent.Swap(true) {
+		close(s.resetting)
+	}
+	s.code = code
+	s.writeMu.Lock()
+	s.queueEvent(StreamOutgoingFrameEvent{
+		Frame: &RSTStreamFrame{
+			Framed: Framed{
+				Header: FrameHeader{
+					StreamID: s.id,
+				},
 			},
+			ErrorCode: code,
 		},
-		ErrorCode: ErrStreamClosed,
+		StreamID: s.id,
 	})
-	s.transition(StreamStateClosed)
+	s.closed.Store(true)
+	s.writeMu.Unlock()
+	s.reqbuf.EOF()
+	s.apply(SendReset)
+	s.closeIfDone()
 }
 
-func (s *Stream) writeFrame(frame Frame) {
-	s.outgoingQueue <- StreamOutgoingFrameEvent{
-		Frame:    frame,
-		StreamID: s.id,
+func (s *Stream) writeFrame(frame Frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.closed.Load() {
+		// a handler still writing after the stream was reset
+		return s.resetErr()
+	}
+	select {
+	case s.outgoingQueue <- StreamOutgoingFrameEvent{Frame: frame, StreamID: s.id}:
+		return nil
+	case <-s.connDone:
+		return errConnClosed
+	case <-s.resetting:
+		return s.resetErr()
+	}
+}
+
+// resetErr is what writes to a stream fail with once it has been reset.
+func (s *Stream) resetErr() error {
+	if s.timedOut.Load() {
+		return os.ErrDeadlineExceeded
+	}
+	return errStreamReset
+}
+
+// queueEvent queues ev for the connection writer, to be sent by unlock.
+// Called with s.mu held.
+func (s *Stream) queueEvent(ev StreamEvent) {
+	s.pending = append(s.pending, ev)
+}
+
+// unlock releases s.mu, then sends what was queued for the connection
+// writer while it was held. The reader loop delivering frames to the
+// stream so never waits behind another goroutine blocked on the writer.
+func (s *Stream) unlock() {
+	pending, credit := s.pending, s.pendingCredit
+	s.pending, s.pendingCredit = nil, 0
+	s.mu.Unlock()
+
+	if credit > 0 && s.returnConnWindow != nil {
+		s.returnConnWindow(credit)
+	}
+	for _, ev := range pending {
+		s.sendEvent(ev)
+	}
+}
+
+// sendEvent hands ev to the connection writer, dropping it and reporting
+// false if the connection has already shut down.
+func (s *Stream) sendEvent(ev StreamEvent) bool {
+	select {
+	case s.outgoingQueue <- ev:
+		return true
+	case <-s.connDone:
+		return false
 	}
 }
 
 func (s *Stream) transition(to StreamState) {
-	s.log("transitioning to %s", string(to))
+	s.log.Debug("stream state changed", "from", s.state, "to", to)
+	s.trace.streamStateChange(s.id, s.state, to)
+	if to == StreamStateClosed {
+		s.metrics.streamClosed(s.state, s.code)
+	}
 	s.state = to
-	s.outgoingQueue <- StreamTransitionEvent{
+	if to == StreamStateClosed {
+		s.closed.Store(true)
+	}
+	s.queueEvent(StreamTransitionEvent{
 		ToState:  to,
 		StreamID: s.id,
+	})
+}
+
+// streamBody is a request body, handing flow control credit back to the
+// client as it is read.
+type streamBody struct {
+	s *Stream
+}
+
+func (b streamBody) Read(bs []byte) (int, error) {
+	n, err := b.s.reqbuf.Read(bs)
+	if n > 0 {
+		b.s.mu.Lock()
+		b.s.returnWindow(n)
+		b.s.unlock()
 	}
-	s.log("transitioned to %s", string(to))
+	return n, err
 }
 
 var _ io.ReadWriter = (*StreamReader)(nil)
 
+// StreamReader buffers a request body between the reader loop and the
+// handler, blocking reads until data, the end of the body or an error
+// arrives.
 type StreamReader struct {
 	rbuf *bytes.Buffer
 
-	mu sync.Mutex
+	mu   sync.Mutex
+	cond *sync.Cond
 
 	eof bool
+	// err is returned in place of io.EOF once the buffer is drained.
+	err error
 }
 
 func NewStreamReader() *StreamReader {
-	return &StreamReader{
+	s := &StreamReader{
 		rbuf: bytes.NewBuffer(nil),
 	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
 }
 
 func (s *StreamReader) Read(bs []byte) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	n, _ := s.rbuf.Read(bs)
-	if s.eof && s.rbuf.Len() == 0 {
-		return n, io.EOF
+	for s.rbuf.Len() == 0 && !s.eof {
+		s.cond.Wait()
 	}
-	return n, nil
+	if s.rbuf.Len() > 0 {
+		return s.rbuf.Read(bs)
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, io.EOF
 }
 
 func (s *StreamReader) Write(bs []byte) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.cond.Signal()
 	return s.rbuf.Write(bs)
 }
 
@@ -307,6 +736,19 @@ func (s *StreamReader) EOF() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.eof = true
+	s.cond.Broadcast()
+}
+
+// CloseWithError ends the body early, reads failing with err once what was
+// already received has been read.
+func (s *StreamReader) CloseWithError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.eof = true
+	s.cond.Broadcast()
 }
 
 var _ http.ResponseWriter = (*StreamWriter)(nil)
@@ -318,14 +760,16 @@ type StreamWriter struct {
 
 	sentHeaders bool
 
-	frameWriter func(Frame)
+	frameWriter func(Frame) error
+	// reset, if set, resets the stream from the handler.
+	reset func(ErrorCode)
 
 	wbuf *bytes.Buffer
 
 	closed bool
 }
 
-func NewStreamWriter(streamid uint32, frameWriter func(Frame)) *StreamWriter {
+func NewStreamWriter(streamid uint32, frameWriter func(Frame) error) *StreamWriter {
 	return &StreamWriter{
 		headers:     map[string][]string{},
 		statusCode:  200,
@@ -347,12 +791,21 @@ func (s *StreamWriter) Write(bs []byte) (int, error) {
 	}
 
 	for s.wbuf.Len() > 4096 {
-		s.sendData(false)
+		if err := s.sendData(false); err != nil {
+			return 0, err
+		}
 	}
 
 	return n, nil
 }
 
+// resetStream abandons the response, resetting the stream with code.
+func (s *StreamWriter) resetStream(code ErrorCode) {
+	if s.reset != nil {
+		s.reset(code)
+	}
+}
+
 func (s *StreamWriter) WriteHeader(statusCode int) {
 	s.statusCode = statusCode
 }
@@ -370,7 +823,7 @@ func (s *StreamWriter) setDefaultHeaders() {
 	}
 }
 
-func (s *StreamWriter) sendData(closing bool) {
+func (s *StreamWriter) sendData(closing bool) error {
 	if !s.sentHeaders {
 		s.setDefaultHeaders()
 		headers := []hpack.Header{hpack.NewHeader(":status", fmt.Sprintf("%d", s.statusCode))}
@@ -390,7 +843,9 @@ func (s *StreamWriter) sendData(closing bool) {
 			EndHeaders: true,
 			Headers:    headers,
 		}
-		s.frameWriter(&headerFrame)
+		if err := s.frameWriter(&headerFrame); err != nil {
+			return err
+		}
 		s.sentHeaders = true
 	}
 
@@ -408,5 +863,5 @@ func (s *StreamWriter) sendData(closing bool) {
 		EndStream: closing,
 	}
 
-	s.frameWriter(&dataFrame)
+	return s.frameWriter(&dataFrame)
 }
@@ -0,0 +1,247 @@
+package http2
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextStreamState(t *testing.T) {
+	tests := []struct {
+		from    StreamState
+		trigger StreamTrigger
+		to      StreamState
+		ok      bool
+	}{
+		{StreamStateIdle, RecvHeaders, StreamStateOpen, true},
+		{StreamStateIdle, SendHeaders, StreamStateOpen, true},
+		{StreamStateIdle, SendPushPromise, StreamStateReservedLocal, true},
+		{StreamStateIdle, RecvPushPromise, StreamStateReservedRemote, true},
+		{StreamStateIdle, RecvData, "", false},
+		{StreamStateIdle, RecvReset, "", false},
+		{StreamStateIdle, SendEndStream, "", false},
+
+		{StreamStateReservedLocal, SendHeaders, StreamStateHalfClosedRemote, true},
+		{StreamStateReservedLocal, SendReset, StreamStateClosed, true},
+		{StreamStateReservedLocal, RecvReset, StreamStateClosed, true},
+		{StreamStateReservedLocal, RecvHeaders, "", false},
+		{StreamStateReservedLocal, SendData, "", false},
+
+		{StreamStateReservedRemote, RecvHeaders, StreamStateHalfClosedLocal, true},
+		{StreamStateReservedRemote, SendReset, StreamStateClosed, true},
+		{StreamStateReservedRemote, RecvReset, StreamStateClosed, true},
+		{StreamStateReservedRemote, SendHeaders, "", false},
+		{StreamStateReservedRemote, RecvData, "", false},
+
+		{StreamStateOpen, RecvData, StreamStateOpen, true},
+		{StreamStateOpen, SendData, StreamStateOpen, true},
+		{StreamStateOpen, SendHeaders, StreamStateOpen, true},
+		{StreamStateOpen, RecvEndStream, StreamStateHalfClosedRemote, true},
+		{StreamStateOpen, SendEndStream, StreamStateHalfClosedLocal, true},
+		{StreamStateOpen, SendReset, StreamStateClosed, true},
+		{StreamStateOpen, RecvReset, StreamStateClosed, true},
+		{StreamStateOpen, RecvPushPromise, "", false},
+
+		{StreamStateHalfClosedLocal, RecvData, StreamStateHalfClosedLocal, true},
+		{StreamStateHalfClosedLocal, RecvHeaders, StreamStateHalfClosedLocal, true},
+		{StreamStateHalfClosedLocal, RecvEndStream, StreamStateClosed, true},
+		{StreamStateHalfClosedLocal, SendReset, StreamStateClosed, true},
+		{StreamStateHalfClosedLocal, SendData, "", false},
+		{StreamStateHalfClosedLocal, SendEndStream, "", false},
+
+		{StreamStateHalfClosedRemote, SendData, StreamStateHalfClosedRemote, true},
+		{StreamStateHalfClosedRemote, SendEndStream, StreamStateClosed, true},
+		{StreamStateHalfClosedRemote, RecvReset, StreamStateClosed, true},
+		{StreamStateHalfClosedRemote, RecvData, "", false},
+		{StreamStateHalfClosedRemote, RecvHeaders, "", false},
+		{StreamStateHalfClosedRemote, RecvEndStream, "", false},
+
+		{StreamStateClosed, RecvData, "", false},
+		{StreamStateClosed, SendReset, "", false},
+		{StreamStateClosed, RecvReset, "", false},
+	}
+
+	for _, tt := range tests {
+		to, ok := NextStreamState(tt.from, tt.trigger)
+		assert.Equal(t, tt.ok, ok, "%s on %s", tt.trigger, tt.from)
+		assert.Equal(t, tt.to, to, "%s on %s", tt.trigger, tt.from)
+	}
+}
+
+func TestStreamHalfClosedLocal(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			// respond without reading the request body
+			w.Write([]byte("early"))
+		},
+	})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	_, body := tc.expectResponse(1)
+	assert.Equal(t, "early", string(body))
+
+	// the stream is half-closed (local) so the rest of the body is accepted
+	tc.writeData(1, false, []byte("still "))
+	tc.writeData(1, true, []byte("sending"))
+	tc.ping()
+
+	tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(3)
+}
+
+func TestStreamHalfClosedRemoteRejectsData(t *testing.T) {
+	release := make(chan struct{})
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			<-release
+		},
+	})
+	defer close(release)
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.writeData(1, false, []byte("after END_STREAM"))
+	tc.expectRSTStream(1, ErrStreamClosed)
+}
+
+func TestStreamTrailersMustEndStream(t *testing.T) {
+	tc := newTestClient(t, &Connection{})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.expectRSTStream(1, ErrProtocolError)
+}
+
+func TestStreamReadBodyTimeout(t *testing.T) {
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	tc := newTestClient(t, &Connection{
+		ReadBodyTimeout: 100 * time.Millisecond,
+		Handler: func(w http.ResponseWriter, r Request) {
+			body, err := io.ReadAll(r.Body)
+			results <- result{string(body), err}
+		},
+	})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/")...)
+	tc.writeData(1, false, []byte("partial"))
+	tc.expectRSTStream(1, ErrCancel)
+	res := <-results
+	assert.Equal(t, "partial", res.body)
+	assert.ErrorIs(t, res.err, os.ErrDeadlineExceeded)
+
+	// a body sent in time isn't affected
+	tc.writeHeaders(3, false, requestHeaders("POST", "/")...)
+	tc.writeData(3, true, []byte("complete"))
+	tc.expectResponse(3)
+	res = <-results
+	assert.Equal(t, "complete", res.body)
+	assert.NoError(t, res.err)
+}
+
+func TestStreamWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	tc := newTestClient(t, &Connection{
+		WriteTimeout: 20 * time.Millisecond,
+		Handler: func(w http.ResponseWriter, r Request) {
+			if r.Path == "/slow" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			_, err := w.Write(make([]byte, 8192))
+			errs <- err
+		},
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/slow")...)
+	tc.expectRSTStream(1, ErrCancel)
+	assert.ErrorIs(t, <-errs, os.ErrDeadlineExceeded)
+
+	tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+	_, body := tc.expectResponse(3)
+	assert.Len(t, body, 8192)
+	assert.NoError(t, <-errs)
+}
+
+func TestStreamFinishDoesNotBlockReader(t *testing.T) {
+	finish := make(chan struct{})
+	write := make(chan struct{})
+	read := make(chan string, 1)
+	tc := newTestClient(t, &Connection{
+		Handler: func(w http.ResponseWriter, r Request) {
+			switch r.Path {
+			case "/finish":
+				<-finish
+			case "/write":
+				<-write
+				// more than the client reads, leaving the writer stuck
+				w.Write(make([]byte, 1<<20))
+			case "/read":
+				body := make([]byte, 4)
+				io.ReadFull(r.Body, body)
+				read <- string(body)
+			}
+		},
+	})
+
+	tc.writeHeaders(1, false, requestHeaders("POST", "/finish")...)
+	tc.writeHeaders(3, false, requestHeaders("POST", "/read")...)
+	tc.writeHeaders(5, true, requestHeaders("GET", "/write")...)
+	tc.ping()
+	close(write)
+	time.Sleep(20 * time.Millisecond)
+	// the final flush of stream 1 waits on the writer
+	close(finish)
+	time.Sleep(20 * time.Millisecond)
+
+	// which must not keep the reader from delivering to stream 1, and on
+	// to other streams
+	tc.writeData(1, false, []byte("late"))
+	tc.writeData(3, false, []byte("body"))
+	select {
+	case body := <-read:
+		assert.Equal(t, "body", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request body never arrived")
+	}
+}
+
+func TestStreamReaderBlocks(t *testing.T) {
+	r := NewStreamReader()
+	type result struct {
+		data string
+		err  error
+	}
+	reads := make(chan result)
+	read := func() {
+		bs := make([]byte, 16)
+		n, err := r.Read(bs)
+		reads <- result{string(bs[:n]), err}
+	}
+
+	go read()
+	select {
+	case res := <-reads:
+		t.Fatalf("read returned %+v with nothing buffered", res)
+	case <-time.After(20 * time.Millisecond):
+	}
+	r.Write([]byte("hello"))
+	assert.Equal(t, result{"hello", nil}, <-reads)
+
+	go read()
+	r.EOF()
+	assert.Equal(t, result{"", io.EOF}, <-reads)
+
+	r = NewStreamReader()
+	r.Write([]byte("partial"))
+	go read()
+	assert.Equal(t, result{"partial", nil}, <-reads)
+	go read()
+	r.CloseWithError(os.ErrDeadlineExceeded)
+	assert.Equal(t, result{"", os.ErrDeadlineExceeded}, <-reads)
+}
@@ -0,0 +1,187 @@
+package http2
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamResetter is implemented by the response writers handed to
+// handlers, letting a response that can't be finished be abandoned.
+type streamResetter interface {
+	resetStream(code ErrorCode)
+}
+
+var (
+	_ streamResetter = (*StreamWriter)(nil)
+	_ streamResetter = (*http1ResponseWriter)(nil)
+)
+
+// bodyAbandoner is implemented by response writers whose request body
+// can't be read past after the response while a handler still reads it,
+// so that the connection is closed after the response instead.
+type bodyAbandoner interface {
+	abandonBody()
+}
+
+var _ bodyAbandoner = (*http1ResponseWriter)(nil)
+
+// TimeoutHandler runs h with a budget of dt. If h hasn't returned by then,
+// a 503 response with msg is sent in its place, or, if h has already
+// started writing its response, the stream is reset with CANCEL, which
+// also cuts off a write h is blocked in. From then on, h's writes and
+// reads of the request body fail with http.ErrHandlerTimeout.
+func TimeoutHandler(h HandlerFunc, dt time.Duration, msg string) HandlerFunc {
+	return func(w http.ResponseWriter, r Request) {
+		tw := &timeoutWriter{
+			w:          w,
+			headers:    http.Header{},
+			statusCode: http.StatusOK,
+		}
+		if r.Body != nil {
+			r.Body = &timeoutBody{r: r.Body, tw: tw}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			h(tw, r)
+			close(done)
+		}()
+
+		timer := time.NewTimer(dt)
+		defer timer.Stop()
+		select {
+		case <-done:
+			tw.finish()
+		case <-timer.C:
+			tw.timeout(msg)
+		}
+	}
+}
+
+// timeoutWriter passes a response through to w until the handler runs out
+// of time. The headers are kept apart from w's until the first write, so
+// that a 503 can still be sent if the handler hasn't written anything.
+type timeoutWriter struct {
+	w http.ResponseWriter
+
+	// mu guards the fields below, and is never held while w or the body
+	// may block, so the handler running out of time is never held up.
+	// Nothing is passed on to w once timedOut is set.
+	mu          sync.Mutex
+	headers     http.Header
+	statusCode  int
+	wroteHeader bool
+	timedOut    bool
+	// reading counts the reads of the request body in progress.
+	reading int
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.headers
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.wroteHeader {
+		tw.statusCode = statusCode
+	}
+}
+
+func (tw *timeoutWriter) Write(bs []byte) (int, error) {
+	tw.mu.Lock()
+	if tw.timedOut {
+		tw.mu.Unlock()
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked()
+	}
+	tw.mu.Unlock()
+
+	n, err := tw.w.Write(bs)
+	if tw.isTimedOut() {
+		// including writes cut off by the timeout
+		err = http.ErrHandlerTimeout
+	}
+	return n, err
+}
+
+func (tw *timeoutWriter) isTimedOut() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.timedOut
+}
+
+func (tw *timeoutWriter) writeHeaderLocked() {
+	tw.wroteHeader = true
+	for name, values := range tw.headers {
+		tw.w.Header()[name] = values
+	}
+	tw.w.WriteHeader(tw.statusCode)
+}
+
+// finish passes on the headers of a handler that returned without writing
+// a body.
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked()
+	}
+}
+
+// timeout answers in place of the handler, or abandons the response it
+// started. Writes only ever reach w after the headers, so a handler that
+// hasn't written any can't be using w, and a write it is blocked in is
+// failed by the reset. Reads of the request body in progress are left to
+// the connection to cut off.
+func (tw *timeoutWriter) timeout(msg string) {
+	tw.mu.Lock()
+	tw.timedOut = true
+	wroteHeader, reading := tw.wroteHeader, tw.reading > 0
+	tw.mu.Unlock()
+
+	if wroteHeader {
+		if rs, ok := tw.w.(streamResetter); ok {
+			rs.resetStream(ErrCancel)
+		}
+		return
+	}
+	if ba, ok := tw.w.(bodyAbandoner); ok && reading {
+		ba.abandonBody()
+	}
+	tw.w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(tw.w, msg)
+}
+
+// timeoutBody cuts a handler off from the request body once it has timed
+// out, as the body belongs to the connection again after that.
+type timeoutBody struct {
+	r  io.Reader
+	tw *timeoutWriter
+}
+
+func (b *timeoutBody) Read(bs []byte) (int, error) {
+	tw := b.tw
+	tw.mu.Lock()
+	if tw.timedOut {
+		tw.mu.Unlock()
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.reading++
+	tw.mu.Unlock()
+
+	n, err := b.r.Read(bs)
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.reading--
+	if tw.timedOut {
+		// whatever was read belongs to the connection now
+		return 0, http.ErrHandlerTimeout
+	}
+	return n, err
+}
@@ -0,0 +1,149 @@
+package http2
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	tc := newTestClient(t, &Connection{
+		Handler: TimeoutHandler(func(w http.ResponseWriter, r Request) {
+			w.Header().Set("x-test", "yes")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, "in time")
+		}, time.Second, "too slow"),
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	headers, body := tc.expectResponse(1)
+	assert.Equal(t, "201", headerValue(headers, ":status"))
+	assert.Equal(t, "yes", headerValue(headers, "x-test"))
+	assert.Equal(t, "in time", string(body))
+}
+
+func TestTimeoutHandlerServiceUnavailable(t *testing.T) {
+	errs := make(chan error, 1)
+	release := make(chan struct{})
+	tc := newTestClient(t, &Connection{
+		Handler: TimeoutHandler(func(w http.ResponseWriter, r Request) {
+			w.Header().Set("x-test", "yes")
+			<-release
+			_, err := fmt.Fprint(w, "too late")
+			errs <- err
+		}, 20*time.Millisecond, "too slow"),
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	headers, body := tc.expectResponse(1)
+	assert.Equal(t, "503", headerValue(headers, ":status"))
+	assert.Empty(t, headerValue(headers, "x-test"))
+	assert.Equal(t, "too slow", string(body))
+
+	close(release)
+	assert.Equal(t, http.ErrHandlerTimeout, <-errs)
+}
+
+func TestTimeoutHandlerResetsStartedResponse(t *testing.T) {
+	release := make(chan struct{})
+	tc := newTestClient(t, &Connection{
+		Handler: TimeoutHandler(func(w http.ResponseWriter, r Request) {
+			fmt.Fprint(w, "started")
+			<-release
+		}, 20*time.Millisecond, "too slow"),
+	})
+	defer close(release)
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectRSTStream(1, ErrCancel)
+
+	// the connection carries on
+	tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+	tc.expectRSTStream(3, ErrCancel)
+}
+
+func TestTimeoutHandlerCutsOffBlockedWrite(t *testing.T) {
+	errs := make(chan error, 1)
+	tc := newTestClient(t, &Connection{
+		Handler: TimeoutHandler(func(w http.ResponseWriter, r Request) {
+			// more than the client reads, so the write blocks
+			_, err := w.Write(make([]byte, 1<<20))
+			errs <- err
+		}, 20*time.Millisecond, "too slow"),
+	})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	select {
+	case err := <-errs:
+		assert.Equal(t, http.ErrHandlerTimeout, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not cut off")
+	}
+}
+
+func TestTimeoutHandlerHTTP1(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	conn, r := newHTTP1TestConn(t, TimeoutHandler(func(w http.ResponseWriter, r Request) {
+		if r.Path == "/started" {
+			fmt.Fprint(w, "started")
+		}
+		<-release
+	}, 20*time.Millisecond, "too slow"))
+
+	writeRequests(t, conn,
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET /started HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	)
+	resp, body := readResponse(t, r, "GET")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "too slow", body)
+
+	// an abandoned response closes the connection
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestTimeoutHandlerCutsOffBlockedWriteHTTP1(t *testing.T) {
+	errs := make(chan error, 1)
+	conn, _ := newHTTP1TestConn(t, TimeoutHandler(func(w http.ResponseWriter, r Request) {
+		// the response is never read, so the write blocks
+		_, err := w.Write(make([]byte, 1<<20))
+		errs <- err
+	}, 20*time.Millisecond, "too slow"))
+
+	writeRequests(t, conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	select {
+	case err := <-errs:
+		assert.Equal(t, http.ErrHandlerTimeout, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not cut off")
+	}
+	// the connection was closed to cut it off
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestTimeoutHandlerSlowBodyHTTP1(t *testing.T) {
+	errs := make(chan error, 1)
+	conn, r := newHTTP1TestConn(t, TimeoutHandler(func(w http.ResponseWriter, r Request) {
+		_, err := io.ReadAll(r.Body)
+		errs <- err
+	}, 100*time.Millisecond, "too slow"))
+
+	// the body never arrives in full
+	writeRequests(t, conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\nabc")
+	resp, body := readResponse(t, r, "POST")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "too slow", body)
+	// the handler is still reading the body, so the connection can't be
+	// used for another request
+	assert.True(t, resp.Close)
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, http.ErrHandlerTimeout, <-errs)
+}
@@ -0,0 +1,279 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakegut/goh2/hpack"
+)
+
+// ConnectionTrace is told what goes over a connection, for debugging and
+// observability. Any of its callbacks may be nil. They are called from the
+// goroutines reading frames, writing them and running handlers, possibly
+// at the same time, and hold those up until they return.
+type ConnectionTrace struct {
+	// OnFrameRead is called with every frame read, as it arrived. Header
+	// blocks are decoded after it returns.
+	OnFrameRead func(frame Frame)
+
+	// OnHeadersRead is called with the fields of every header block read,
+	// once it has been decoded. Blocks over MaxHeaderListSize aren't
+	// reported, as they are never decoded in full.
+	OnHeadersRead func(streamid uint32, headers []hpack.Header)
+
+	// OnFrameWritten is called with every frame once it has been written.
+	OnFrameWritten func(frame Frame)
+
+	// OnStreamStateChange is called whenever a stream moves to another
+	// state, including streams abandoned with their connection.
+	OnStreamStateChange func(streamid uint32, from, to StreamState)
+
+	// OnSettingsChanged is called with the client's settings once a
+	// SETTINGS frame from it, or the HTTP2-Settings of an h2c upgrade, has
+	// been applied.
+	OnSettingsChanged func(settings ConnectionSettings)
+
+	// OnGoAway is called with every GOAWAY frame, sent telling whether we
+	// sent it or the client did.
+	OnGoAway func(frame *GoAwayFrame, sent bool)
+
+	// OnHPACKTableChange is called whenever a header block or a table size
+	// update changes the size of an HPACK dynamic table.
+	OnHPACKTableChange func(change HPACKTableChange)
+}
+
+// HPACKTableChange describes an HPACK dynamic table after it has changed.
+type HPACKTableChange struct {
+	// Encoder is set for the table compressing our header blocks, and
+	// unset for the one decompressing the client's.
+	Encoder bool
+
+	// Size is the size of the entries in the table and MaxSize the size
+	// it may grow to, as counted by RFC 7541 §4.1.
+	Size    int
+	MaxSize int
+}
+
+func (t *ConnectionTrace) frameRead(frame Frame) {
+	if t != nil && t.OnFrameRead != nil {
+		t.OnFrameRead(frame)
+	}
+}
+
+func (t *ConnectionTrace) headersRead(streamid uint32, headers []hpack.Header) {
+	if t != nil && t.OnHeadersRead != nil {
+		t.OnHeadersRead(streamid, headers)
+	}
+}
+
+func (t *ConnectionTrace) frameWritten(frame Frame) {
+	if t != nil && t.OnFrameWritten != nil {
+		t.OnFrameWritten(frame)
+	}
+}
+
+func (t *ConnectionTrace) streamStateChange(streamid uint32, from, to StreamState) {
+	if t != nil && t.OnStreamStateChange != nil {
+		t.OnStreamStateChange(streamid, from, to)
+	}
+}
+
+func (t *ConnectionTrace) settingsChanged(settings *ConnectionSettings) {
+	if t != nil && t.OnSettingsChanged != nil {
+		t.OnSettingsChanged(*settings)
+	}
+}
+
+func (t *ConnectionTrace) goAway(frame *GoAwayFrame, sent bool) {
+	if t != nil && t.OnGoAway != nil {
+		t.OnGoAway(frame, sent)
+	}
+}
+
+// hpackTableSize is the last size of an HPACK dynamic table reported to
+// OnHPACKTableChange.
+type hpackTableSize struct {
+	size, maxSize int
+}
+
+// initHPACKTables notes the size of the fresh HPACK tables, so only
+// changes to them are reported.
+func (c *Connection) initHPACKTables() {
+	size, maxSize := c.hpackDecoder.DynamicTableSize()
+	c.decoderTable = hpackTableSize{size, maxSize}
+	size, maxSize = c.hpackEncoder.DynamicTableSize()
+	c.encoderTable = hpackTableSize{size, maxSize}
+}
+
+// noteHPACKTable reports the table of the HPACK encoder, or else the
+// decoder, to Trace and Metrics if it changed since it was last reported.
+// The encoder is only noted by the writer, and the decoder by the reader
+// loop.
+func (c *Connection) noteHPACKTable(encoder bool) {
+	traced := c.Trace != nil && c.Trace.OnHPACKTableChange != nil
+	if !traced && c.Metrics == nil {
+		return
+	}
+	last := &c.decoderTable
+	size, maxSize := c.hpackDecoder.DynamicTableSize()
+	if encoder {
+		last = &c.encoderTable
+		size, maxSize = c.hpackEncoder.DynamicTableSize()
+	}
+	if *last == (hpackTableSize{size, maxSize}) {
+		return
+	}
+	c.Metrics.hpackTableResized(encoder, size-last.size)
+	*last = hpackTableSize{size, maxSize}
+	if !traced {
+		return
+	}
+	c.Trace.OnHPACKTableChange(HPACKTableChange{
+		Encoder: encoder,
+		Size:    size,
+		MaxSize: maxSize,
+	})
+}
+
+// NewTextTrace returns a ConnectionTrace writing every frame read or
+// written to w, the way nghttp -v shows them:
+//
+//	[  0.001] recv HEADERS frame <length=16, flags=0x05, stream_id=1>
+//	          ; END_STREAM | END_HEADERS
+//	[  0.001] recv (stream_id=1) :method: GET
+//	[  0.001] recv (stream_id=1) :path: /
+//	[  0.002] send HEADERS frame <length=14, flags=0x04, stream_id=1>
+//	          ; END_HEADERS
+//	          :status: 200
+//	          content-type: text/plain; charset=utf-8
+//
+// Times are seconds since the trace was created. The header fields we
+// receive follow the frames carrying them, as they are only decoded once
+// the whole block has arrived. Each frame, and each header block, is
+// written with a single Write.
+func NewTextTrace(w io.Writer) *ConnectionTrace {
+	t := &textTrace{w: w, start: time.Now()}
+	return &ConnectionTrace{
+		OnFrameRead:    func(frame Frame) { t.frame("recv", frame, frame.Header()) },
+		OnHeadersRead:  t.headersRead,
+		OnFrameWritten: t.frameWritten,
+	}
+}
+
+type textTrace struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+// frameWritten traces a frame we sent, whose header is only filled in as
+// it is encoded.
+func (t *textTrace) frameWritten(frame Frame) {
+	bs, err := frame.Encode()
+	if err != nil {
+		return
+	}
+	header, err := parseHeader(bytes.NewReader(bs))
+	if err != nil {
+		return
+	}
+	t.frame("send", frame, header)
+}
+
+func (t *textTrace) headersRead(streamid uint32, headers []hpack.Header) {
+	var buf bytes.Buffer
+	elapsed := time.Since(t.start).Seconds()
+	for _, field := range headers {
+		fmt.Fprintf(&buf, "[%7.3f] recv (stream_id=%d) %s: %s\n", elapsed, streamid, field.Name, field.Value)
+	}
+	t.write(buf.Bytes())
+}
+
+// textTraceIndent lines up the details of a frame with its type.
+const textTraceIndent = "          "
+
+// frameFlagNames names the flags of each frame type, in the order
+// nghttp lists them.
+var frameFlagNames = map[FrameType][]struct {
+	flag FrameFlag
+	name string
+}{
+	FrameData:         {{DataEndStream, "END_STREAM"}, {DataPadded, "PADDED"}},
+	FrameHeaders:      {{HeadersEndStream, "END_STREAM"}, {HeadersEndHeaders, "END_HEADERS"}, {HeadersPadded, "PADDED"}, {HeadersPriority, "PRIORITY"}},
+	FrameSettings:     {{SettingsAck, "ACK"}},
+	FramePushPromise:  {{PushPromiseEndHeaders, "END_HEADERS"}, {PushPromisePadded, "PADDED"}},
+	FramePing:         {{PingAck, "ACK"}},
+	FrameContinuation: {{ContinuationEndHeaders, "END_HEADERS"}},
+}
+
+func (t *textTrace) frame(direction string, frame Frame, header FrameHeader) {
+	var buf bytes.Buffer
+	elapsed := time.Since(t.start).Seconds()
+	fmt.Fprintf(&buf, "[%7.3f] %s %s frame <length=%d, flags=0x%02x, stream_id=%d>\n",
+		elapsed, direction, frameTypeOf(frame), header.Length, header.Flags, header.StreamID)
+
+	var flags []string
+	for _, f := range frameFlagNames[frameTypeOf(frame)] {
+		if header.hasFlag(f.flag) {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) > 0 {
+		line(&buf, "; %s", strings.Join(flags, " | "))
+	}
+
+	switch fr := frame.(type) {
+	case *HeadersFrame:
+		if header.hasFlag(HeadersPadded) {
+			line(&buf, "(padlen=%d)", fr.PadLength)
+		}
+		if header.hasFlag(HeadersPriority) {
+			line(&buf, "(dep_stream_id=%d, weight=%d, exclusive=%d)", fr.StreamDependency, int(fr.Weight)+1, boolInt(fr.ExclusiveStreamDep))
+		}
+		for _, field := range fr.Headers {
+			line(&buf, "%s: %s", field.Name, field.Value)
+		}
+	case *PriorityFrame:
+		line(&buf, "(dep_stream_id=%d, weight=%d, exclusive=%d)", fr.StreamDependency, int(fr.Weight)+1, boolInt(fr.ExclusiveStreamDep))
+	case *RSTStreamFrame:
+		line(&buf, "(error_code=%s(0x%02x))", fr.ErrorCode, uint32(fr.ErrorCode))
+	case *SettingsFrame:
+		line(&buf, "(niv=%d)", len(fr.Args))
+		for _, arg := range fr.Args {
+			line(&buf, "[%s(0x%02x):%d]", arg.Param, uint16(arg.Param), arg.Value)
+		}
+	case *PushPromiseFrame:
+		line(&buf, "(promised_stream_id=%d)", fr.PromisedStreamID)
+	case *PingFrame:
+		line(&buf, "(opaque_data=%x)", fr.Opaque)
+	case *GoAwayFrame:
+		line(&buf, "(last_stream_id=%d, error_code=%s(0x%02x), opaque_data(%d)=[%s])",
+			fr.LastStreamID, fr.ErrorCode, uint32(fr.ErrorCode), len(fr.Opaque), fr.Opaque)
+	case *WindowUpdateFrame:
+		line(&buf, "(window_size_increment=%d)", fr.SizeIncrement)
+	}
+	t.write(buf.Bytes())
+}
+
+func (t *textTrace) write(bs []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Write(bs)
+}
+
+func line(buf *bytes.Buffer, format string, args ...interface{}) {
+	buf.WriteString(textTraceIndent)
+	fmt.Fprintf(buf, format, args...)
+	buf.WriteByte('\n')
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package http2
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jakegut/goh2/hpack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// traceRecorder records what a ConnectionTrace is told, as one line per
+// call.
+type traceRecorder struct {
+	mu     sync.Mutex
+	events []string
+	// sentGoAway is closed once our GOAWAY has been traced.
+	sentGoAway chan struct{}
+}
+
+func newTraceRecorder() (*traceRecorder, *ConnectionTrace) {
+	r := &traceRecorder{sentGoAway: make(chan struct{})}
+	return r, &ConnectionTrace{
+		OnFrameRead: func(frame Frame) {
+			r.record("read %s %d", frameTypeOf(frame), frame.Header().StreamID)
+		},
+		OnHeadersRead: func(streamid uint32, headers []hpack.Header) {
+			r.record("headers %d %s", streamid, headerValue(headers, ":path"))
+		},
+		OnFrameWritten: func(frame Frame) {
+			r.record("wrote %s %d", frameTypeOf(frame), frame.Header().StreamID)
+		},
+		OnStreamStateChange: func(streamid uint32, from, to StreamState) {
+			r.record("stream %d %s -> %s", streamid, from, to)
+		},
+		OnSettingsChanged: func(settings ConnectionSettings) {
+			r.record("settings header_table_size=%d", settings.HeaderTableSize)
+		},
+		OnGoAway: func(frame *GoAwayFrame, sent bool) {
+			r.record("goaway sent=%t %s", sent, frame.ErrorCode)
+			if sent {
+				close(r.sentGoAway)
+			}
+		},
+		OnHPACKTableChange: func(change HPACKTableChange) {
+			r.record("hpack encoder=%t max=%d", change.Encoder, change.MaxSize)
+		},
+	}
+}
+
+func (r *traceRecorder) record(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *traceRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestConnectionTrace(t *testing.T) {
+	r, trace := newTraceRecorder()
+	tc := newTestClient(t, &Connection{Trace: trace})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(1)
+	tc.writeFrame(&SettingsFrame{Args: []SettingFrameArgs{{Param: SettingsHeaderTableSize, Value: 1024}}})
+	tc.writeFrame(&GoAwayFrame{LastStreamID: 0, ErrorCode: ErrNoError})
+	// a response after the table size change makes the encoder use it
+	tc.writeHeaders(3, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(3)
+	tc.writeData(5, false, []byte("idle stream"))
+	tc.expectGoAway(ErrProtocolError)
+	<-r.sentGoAway
+
+	events := r.recorded()
+	for _, want := range []string{
+		"wrote SETTINGS 0",
+		"read SETTINGS 0",
+		"read HEADERS 1",
+		"headers 1 /",
+		"hpack encoder=false max=4096",
+		"stream 1 idle -> open",
+		"stream 1 open -> half closed (remote)",
+		"wrote HEADERS 1",
+		"hpack encoder=true max=4096",
+		"wrote DATA 1",
+		"stream 1 half closed (remote) -> closed",
+		"settings header_table_size=1024",
+		"goaway sent=false NO_ERROR",
+		"hpack encoder=true max=1024",
+		"read DATA 5",
+		"wrote GOAWAY 0",
+		"goaway sent=true PROTOCOL_ERROR",
+	} {
+		assert.Contains(t, events, want)
+	}
+	assert.Less(t, index(events, "stream 1 idle -> open"), index(events, "stream 1 open -> half closed (remote)"))
+	assert.Less(t, index(events, "read HEADERS 1"), index(events, "headers 1 /"))
+	assert.Less(t, index(events, "headers 1 /"), index(events, "stream 1 idle -> open"))
+}
+
+func index(events []string, event string) int {
+	for i, e := range events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestTextTrace(t *testing.T) {
+	var out syncBuffer
+	tc := newTestClient(t, &Connection{Trace: NewTextTrace(&out)})
+
+	tc.writeHeaders(1, true, requestHeaders("GET", "/")...)
+	tc.expectResponse(1)
+	tc.ping()
+	// the writer traces a frame after writing it, so the first PING ack
+	// is only known to be traced once the second has arrived
+	tc.ping()
+
+	trace := out.String()
+	for _, want := range []string{
+		"send SETTINGS frame <length=12, flags=0x00, stream_id=0>\n" +
+			"          (niv=2)\n" +
+			"          [SETTINGS_MAX_CONCURRENT_STREAMS(0x03):100]\n" +
+			"          [SETTINGS_MAX_HEADER_LIST_SIZE(0x06):65536]\n",
+		"recv SETTINGS frame <length=0, flags=0x00, stream_id=0>\n" +
+			"          (niv=0)\n",
+		"recv HEADERS frame <length=",
+		"flags=0x05, stream_id=1>\n" +
+			"          ; END_STREAM | END_HEADERS\n",
+		"] recv (stream_id=1) :method: GET\n",
+		"] recv (stream_id=1) :path: /\n",
+		"send HEADERS frame <length=",
+		"flags=0x04, stream_id=1>\n" +
+			"          ; END_HEADERS\n" +
+			"          :status: 200\n",
+		"send DATA frame <length=0, flags=0x01, stream_id=1>\n" +
+			"          ; END_STREAM\n",
+		"recv PING frame <length=8, flags=0x00, stream_id=0>\n",
+		"send PING frame <length=8, flags=0x01, stream_id=0>\n" +
+			"          ; ACK\n",
+	} {
+		assert.Contains(t, trace, want)
+	}
+
+	frameLine := regexp.MustCompile(`^\[ *\d+\.\d{3}\] ((recv|send) [A-Z_]+ frame <|recv \(stream_id=\d+\) \S+: )`)
+	for _, l := range strings.Split(strings.TrimSpace(trace), "\n") {
+		if !strings.HasPrefix(l, textTraceIndent) {
+			require.Regexp(t, frameLine, l)
+		}
+	}
+}
+
+func TestTextTraceGoAway(t *testing.T) {
+	var out syncBuffer
+	trace := NewTextTrace(&out)
+	trace.OnFrameWritten(&GoAwayFrame{LastStreamID: 3, ErrorCode: ErrEnhanceYourCalm, Opaque: []byte("too many PING frames")})
+	trace.OnFrameWritten(&RSTStreamFrame{Framed: Framed{Header: FrameHeader{StreamID: 5}}, ErrorCode: ErrCancel})
+
+	assert.Contains(t, out.String(), "] send GOAWAY frame <length=28, flags=0x00, stream_id=0>\n"+
+		"          (last_stream_id=3, error_code=ENHANCE_YOUR_CALM(0x0b), opaque_data(20)=[too many PING frames])\n")
+	assert.Contains(t, out.String(), "] send RST_STREAM frame <length=4, flags=0x00, stream_id=5>\n"+
+		"          (error_code=CANCEL(0x08))\n")
+}
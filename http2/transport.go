@@ -0,0 +1,354 @@
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakegut/goh2/http11"
+)
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// Transport is an http.RoundTripper speaking HTTP/2 over cleartext TCP.
+// Requests to the same authority share a connection, multiplexed as
+// separate streams.
+type Transport struct {
+	// DialContext opens connections. Defaults to net.Dialer.DialContext.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Upgrade starts connections with an HTTP/1.1 request upgrading to h2c
+	// (RFC 7540 §3.2) instead of assuming the server speaks HTTP/2. If the
+	// server declines, the response comes back over HTTP/1.1.
+	Upgrade bool
+
+	// MaxHeaderListSize is advertised as SETTINGS_MAX_HEADER_LIST_SIZE and
+	// bounds response headers. Defaults to 64KiB.
+	MaxHeaderListSize uint32
+
+	// HealthCheckAfter is how long a connection may sit idle before it is
+	// pinged ahead of being reused. Zero disables the check.
+	HealthCheckAfter time.Duration
+
+	// PingTimeout bounds how long a health check waits for the PING to be
+	// acknowledged. Defaults to 15 seconds.
+	PingTimeout time.Duration
+
+	poolOnce sync.Once
+	connPool *clientConnPool
+}
+
+// maxRetries bounds how often a request refused by the server, or turned
+// away by a connection that was closing, is retried on another connection.
+// Requests finding a connection full are retried regardless, as each retry
+// finds room on another connection or dials one.
+const maxRetries = 5
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("http2: request has no URL")
+	}
+	if req.URL.Scheme != "http" {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("http2: unsupported scheme %q", req.URL.Scheme)
+	}
+	addr := authorityAddr(req.URL)
+
+	for retries := 0; ; {
+		cc := t.pool().available(req.Context(), addr)
+		if cc == nil && t.Upgrade {
+			return t.upgrade(req, addr)
+		}
+		if cc == nil {
+			var err error
+			cc, err = t.pool().dial(req.Context(), addr)
+			if err != nil {
+				closeRequestBody(req)
+				return nil, err
+			}
+		}
+
+		resp, err := cc.RoundTrip(req)
+		if err == errClientConnFull {
+			if err := req.Context().Err(); err != nil {
+				closeRequestBody(req)
+				return nil, err
+			}
+			continue
+		}
+		if err == errClientConnUnusable {
+			if retries < maxRetries {
+				// nothing was sent, so the request goes out as it is
+				retries++
+				continue
+			}
+			closeRequestBody(req)
+		}
+		if err == errStreamRefused && retries < maxRetries {
+			if req, err = rewindRequest(req); err == nil {
+				retries++
+				continue
+			}
+		}
+		return resp, err
+	}
+}
+
+// rewindRequest returns req ready to be sent again, which needs GetBody
+// for requests with a body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errStreamRefused
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	rewound := req.Clone(req.Context())
+	rewound.Body = body
+	return rewound, nil
+}
+
+// NewClientConn starts an HTTP/2 connection with prior knowledge over
+// conn. It isn't added to the pool used by RoundTrip.
+func (t *Transport) NewClientConn(conn net.Conn) (*ClientConn, error) {
+	cc := newClientConn(conn, t.maxHeaderListSize())
+	if err := cc.start(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// CloseIdleConnections closes pooled connections with no requests in
+// flight.
+func (t *Transport) CloseIdleConnections() {
+	t.pool().closeIdle()
+}
+
+func (t *Transport) pool() *clientConnPool {
+	t.poolOnce.Do(func() {
+		t.connPool = &clientConnPool{t: t}
+	})
+	return t.connPool
+}
+
+func (t *Transport) pingTimeout() time.Duration {
+	if t.PingTimeout <= 0 {
+		return 15 * time.Second
+	}
+	return t.PingTimeout
+}
+
+func (t *Transport) maxHeaderListSize() uint32 {
+	if t.MaxHeaderListSize == 0 {
+		return defaultMaxHeaderListSize
+	}
+	return t.MaxHeaderListSize
+}
+
+func (t *Transport) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if t.DialContext != nil {
+		return t.DialContext(ctx, "tcp", addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// newPooledConn wraps conn in a ClientConn leaving the pool once closed.
+func (t *Transport) newPooledConn(conn net.Conn, addr string) *ClientConn {
+	cc := newClientConn(conn, t.maxHeaderListSize())
+	cc.onClose = func(cc *ClientConn) {
+		t.pool().remove(addr, cc)
+	}
+	return cc
+}
+
+func (t *Transport) dialClientConn(ctx context.Context, addr string) (*ClientConn, error) {
+	conn, err := t.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	cc := t.newPooledConn(conn, addr)
+	if err := cc.start(); err != nil {
+		return nil, err
+	}
+	if err := cc.awaitSettings(ctx); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// upgrade sends req as the HTTP/1.1 request upgrading a new connection to
+// h2c. Its response arrives on stream 1 once the server has switched.
+func (t *Transport) upgrade(req *http.Request, addr string) (*http.Response, error) {
+	conn, err := t.dial(req.Context(), addr)
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	cc := t.newPooledConn(conn, addr)
+
+	resp, err := cc.upgrade(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+
+	cs := cc.upgradedStream(req)
+	if err := cc.start(); err != nil {
+		cs.abort(err)
+		return nil, err
+	}
+	// only now can other requests share the connection
+	t.pool().add(addr, cc)
+	go cs.watchContext(req.Context())
+	return cs.awaitResponse(req.Context())
+}
+
+// upgrade writes req as an HTTP/1.1 upgrade request and reads the response.
+// Unless the server switches protocols, that's the response to req, which
+// owns the connection from then on.
+func (cc *ClientConn) upgrade(req *http.Request) (*http.Response, error) {
+	defer closeRequestBody(req)
+
+	h1, chunked, err := upgradeRequest(req, cc.initialSettings())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cc.conn.Write(h1.Marshal()); err != nil {
+		return nil, err
+	}
+	if err := writeUpgradeBody(cc.conn, req, chunked); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(cc.bufreader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &connClosingBody{ReadCloser: resp.Body, conn: cc.conn}
+		return resp, nil
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "h2c") {
+		return nil, fmt.Errorf("http2: server switched to %q instead of h2c", resp.Header.Get("Upgrade"))
+	}
+	return resp, nil
+}
+
+// upgradedStream sets up stream 1, which the upgrade request opened and
+// half closed.
+func (cc *ClientConn) upgradedStream(req *http.Request) *clientStream {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cs := cc.newStreamLocked(req)
+	cs.apply(SendHeaders)
+	cs.apply(SendEndStream)
+	return cs
+}
+
+// upgradeRequest builds the HTTP/1.1 request for req, asking to upgrade
+// with settings. It reports whether the body has to be sent chunked.
+func upgradeRequest(req *http.Request, settings *SettingsFrame) (http11.HTTP11Request, bool, error) {
+	frame, err := settings.Encode()
+	if err != nil {
+		return http11.HTTP11Request{}, false, err
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	h1 := http11.HTTP11Request{
+		Method:   method,
+		Path:     req.URL.RequestURI(),
+		Protocol: "HTTP/1.1",
+		Headers:  map[string]string{},
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "host", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "content-length", "http2-settings":
+			continue
+		}
+		h1.Headers[name] = strings.Join(values, ", ")
+	}
+	h1.Headers["host"] = host
+	h1.Headers["connection"] = "Upgrade, HTTP2-Settings"
+	h1.Headers["upgrade"] = "h2c"
+	// the payload of the SETTINGS frame, without its frame header
+	h1.Headers["http2-settings"] = base64.RawURLEncoding.EncodeToString(frame[9:])
+
+	chunked := false
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	switch {
+	case hasBody && req.ContentLength > 0:
+		h1.Headers["content-length"] = strconv.FormatInt(req.ContentLength, 10)
+	case hasBody:
+		h1.Headers["transfer-encoding"] = "chunked"
+		chunked = true
+	case method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch:
+		h1.Headers["content-length"] = "0"
+	}
+	return h1, chunked, nil
+}
+
+func writeUpgradeBody(w io.Writer, req *http.Request, chunked bool) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if !chunked {
+		_, err := io.CopyN(w, req.Body, req.ContentLength)
+		return err
+	}
+
+	cw := http11.NewChunkedWriter(w)
+	if _, err := io.Copy(cw, req.Body); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// connClosingBody closes the connection along with the body of an HTTP/1.1
+// response, as the connection isn't reused.
+type connClosingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connClosingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// authorityAddr returns host:port for u, defaulting to port 80.
+func authorityAddr(u *url.URL) string {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,442 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gohttp2 "golang.org/x/net/http2"
+	gohpack "golang.org/x/net/http2/hpack"
+)
+
+// newTestTransport returns a Transport whose connections are served by a
+// Connection with handler over a net.Pipe, and a count of its dials.
+func newTestTransport(t *testing.T, handler HandlerFunc) (*Transport, *int32) {
+	t.Helper()
+
+	var dials int32
+	var mu sync.Mutex
+	var clients []net.Conn
+	var handled []chan struct{}
+
+	tr := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			server, client := net.Pipe()
+			c := &Connection{Conn: server, Handler: handler}
+			done := make(chan struct{})
+			go func() {
+				c.Handle()
+				close(done)
+			}()
+
+			mu.Lock()
+			defer mu.Unlock()
+			clients = append(clients, client)
+			handled = append(handled, done)
+			return client, nil
+		},
+	}
+
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		mu.Lock()
+		defer mu.Unlock()
+		for i, client := range clients {
+			client.Close()
+			select {
+			case <-handled[i]:
+			case <-time.After(5 * time.Second):
+				t.Errorf("connection did not shut down")
+			}
+		}
+	})
+	return tr, &dials
+}
+
+func roundTrip(t *testing.T, tr http.RoundTripper, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func newRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	return req
+}
+
+func bodyEchoHandler(w http.ResponseWriter, r Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Write(body)
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	tr, dials := newTestTransport(t, echoHandler)
+
+	for i := 0; i < 3; i++ {
+		req := newRequest(t, "GET", fmt.Sprintf("http://example.com/%d", i), nil)
+		req.Header.Set("X-Test", fmt.Sprint(i))
+		req.Header.Set("Connection", "keep-alive")
+
+		resp, body := roundTrip(t, tr, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, fmt.Sprintf("GET example.com /%d x-test=%d body=", i, i), body)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(dials))
+}
+
+func TestTransportUnsupportedScheme(t *testing.T) {
+	tr, dials := newTestTransport(t, echoHandler)
+
+	_, err := tr.RoundTrip(newRequest(t, "GET", "https://example.com/", nil))
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(dials))
+}
+
+func TestTransportMultiplexing(t *testing.T) {
+	const n = 10
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	release := make(chan struct{})
+
+	tr, dials := newTestTransport(t, func(w http.ResponseWriter, r Request) {
+		if r.Path != "/warmup" {
+			// every request has to be in flight at once to get past here
+			arrived.Done()
+			<-release
+		}
+		fmt.Fprint(w, r.Path)
+	})
+	roundTrip(t, tr, newRequest(t, "GET", "http://example.com/warmup", nil))
+
+	go func() {
+		arrived.Wait()
+		close(release)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := tr.RoundTrip(newRequest(t, "GET", fmt.Sprintf("http://example.com/%d", i), nil))
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("/%d", i), string(body))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(dials))
+}
+
+func TestTransportRequestBody(t *testing.T) {
+	tr, _ := newTestTransport(t, bodyEchoHandler)
+
+	// well past the initial flow control windows
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+
+	t.Run("known length", func(t *testing.T) {
+		req := newRequest(t, "POST", "http://example.com/", bytes.NewReader(payload))
+		_, body := roundTrip(t, tr, req)
+		assert.Equal(t, len(payload), len(body))
+		assert.True(t, bytes.Equal(payload, []byte(body)))
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go func() {
+			for i := 0; i < len(payload); i += 10000 {
+				end := i + 10000
+				if end > len(payload) {
+					end = len(payload)
+				}
+				pw.Write(payload[i:end])
+			}
+			pw.Close()
+		}()
+
+		req := newRequest(t, "POST", "http://example.com/", pr)
+		_, body := roundTrip(t, tr, req)
+		assert.Equal(t, len(payload), len(body))
+		assert.True(t, bytes.Equal(payload, []byte(body)))
+	})
+}
+
+func TestTransportUpgrade(t *testing.T) {
+	tr, dials := newTestTransport(t, echoHandler)
+	tr.Upgrade = true
+
+	req := newRequest(t, "POST", "http://example.com/up", strings.NewReader("hello"))
+	req.Header.Set("X-Test", "1")
+	resp, body := roundTrip(t, tr, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "POST example.com /up x-test=1 body=hello", body)
+
+	// later requests go over HTTP/2 on the same connection
+	resp, body = roundTrip(t, tr, newRequest(t, "GET", "http://example.com/next", nil))
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "GET example.com /next x-test= body=", body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(dials))
+}
+
+func TestTransportUpgradeChunkedBody(t *testing.T) {
+	tr, _ := newTestTransport(t, echoHandler)
+	tr.Upgrade = true
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hel"))
+		pw.Write([]byte("lo"))
+		pw.Close()
+	}()
+
+	resp, body := roundTrip(t, tr, newRequest(t, "PUT", "http://example.com/", pr))
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "PUT example.com / x-test= body=hello", body)
+}
+
+func TestTransportCancel(t *testing.T) {
+	release := make(chan struct{})
+	tr, dials := newTestTransport(t, func(w http.ResponseWriter, r Request) {
+		if r.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprint(w, r.Path)
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newRequest(t, "GET", "http://example.com/slow", nil).WithContext(ctx)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTrip(req)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not canceled")
+	}
+
+	// the connection survives the reset stream
+	_, body := roundTrip(t, tr, newRequest(t, "GET", "http://example.com/fast", nil))
+	assert.Equal(t, "/fast", body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(dials))
+}
+
+// serveFake runs serve with a framer for the server end of a client
+// connection once the client preface has been read.
+func serveFake(server net.Conn, serve func(framer *gohttp2.Framer)) {
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(server, preface); err != nil || string(preface) != ClientPreface {
+		server.Close()
+		return
+	}
+	serve(gohttp2.NewFramer(server, server))
+	// keep reading so the client never blocks writing
+	io.Copy(io.Discard, server)
+}
+
+// newFakeServer returns a ClientConn to a fake server sending empty
+// SETTINGS and then running serve.
+func newFakeServer(t *testing.T, serve func(framer *gohttp2.Framer)) *ClientConn {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+
+	go serveFake(server, func(framer *gohttp2.Framer) {
+		framer.WriteSettings()
+		serve(framer)
+	})
+
+	cc, err := (&Transport{}).NewClientConn(client)
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+func encodeHeaders(fields ...string) []byte {
+	var buf bytes.Buffer
+	enc := gohpack.NewEncoder(&buf)
+	for i := 0; i+1 < len(fields); i += 2 {
+		enc.WriteField(gohpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return buf.Bytes()
+}
+
+// awaitHeaders reads frames until the HEADERS opening streamid.
+func awaitHeaders(framer *gohttp2.Framer, streamid uint32) bool {
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return false
+		}
+		if fr, ok := frame.(*gohttp2.HeadersFrame); ok && fr.StreamID == streamid {
+			return true
+		}
+	}
+}
+
+func TestTransportTrailers(t *testing.T) {
+	cc := newFakeServer(t, func(framer *gohttp2.Framer) {
+		if !awaitHeaders(framer, 1) {
+			return
+		}
+		framer.WriteHeaders(gohttp2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaders(":status", "200", "trailer", "x-checksum"),
+			EndHeaders:    true,
+		})
+		framer.WriteData(1, false, []byte("hello"))
+		framer.WriteHeaders(gohttp2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaders("x-checksum", "abc123"),
+			EndHeaders:    true,
+			EndStream:     true,
+		})
+	})
+
+	resp, err := cc.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	require.NoError(t, err)
+
+	// trailers are only complete once the body has been read
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestTransportInterimResponse(t *testing.T) {
+	cc := newFakeServer(t, func(framer *gohttp2.Framer) {
+		if !awaitHeaders(framer, 1) {
+			return
+		}
+		framer.WriteHeaders(gohttp2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaders(":status", "103", "link", "</style.css>"),
+			EndHeaders:    true,
+		})
+		framer.WriteHeaders(gohttp2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaders(":status", "204"),
+			EndHeaders:    true,
+			EndStream:     true,
+		})
+	})
+
+	resp, err := cc.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Link"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestTransportStreamReset(t *testing.T) {
+	cc := newFakeServer(t, func(framer *gohttp2.Framer) {
+		if !awaitHeaders(framer, 1) {
+			return
+		}
+		framer.WriteRSTStream(1, gohttp2.ErrCodeInternal)
+	})
+
+	_, err := cc.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	assert.Equal(t, StreamError{StreamID: 1, Code: ErrInternalError}, err)
+}
+
+func TestTransportStreamErrorInsideHeaderBlock(t *testing.T) {
+	cc := newFakeServer(t, func(framer *gohttp2.Framer) {
+		if !awaitHeaders(framer, 1) {
+			return
+		}
+		block := encodeHeaders(":status", "200")
+		framer.WriteHeaders(gohttp2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: block[:1],
+		})
+		framer.AllowIllegalWrites = true
+		framer.WriteWindowUpdate(1, 0)
+	})
+
+	_, err := cc.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	var connErr ConnectionError
+	require.True(t, errors.As(err, &connErr), "got %v", err)
+	assert.Equal(t, ErrProtocolError, connErr.Code)
+}
+
+func TestTransportFlowControlError(t *testing.T) {
+	goAway := make(chan *gohttp2.GoAwayFrame, 1)
+	cc := newFakeServer(t, func(framer *gohttp2.Framer) {
+		if !awaitHeaders(framer, 1) {
+			return
+		}
+		framer.WriteHeaders(gohttp2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaders(":status", "200"),
+			EndHeaders:    true,
+		})
+		// the data alone fits the stream window, but not with its padding
+		data, pad := make([]byte, 16000), make([]byte, 255)
+		for sent := 0; sent <= transportStreamWindow; sent += 1 + len(data) + len(pad) {
+			if framer.WriteDataPadded(1, false, data, pad) != nil {
+				return
+			}
+		}
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if fr, ok := frame.(*gohttp2.GoAwayFrame); ok {
+				goAway <- fr
+				return
+			}
+		}
+	})
+
+	resp, err := cc.RoundTrip(newRequest(t, "GET", "http://example.com/", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	select {
+	case fr := <-goAway:
+		assert.Equal(t, gohttp2.ErrCodeFlowControl, fr.ErrCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no GOAWAY")
+	}
+	_, err = io.ReadAll(resp.Body)
+	var connErr ConnectionError
+	require.True(t, errors.As(err, &connErr), "got %v", err)
+	assert.Equal(t, ErrFlowControlError, connErr.Code)
+}
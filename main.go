@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"time"
@@ -48,7 +49,8 @@ func main() {
 		}
 		log.Printf("accepted from %s", conn.RemoteAddr().String())
 		c := &http2.Connection{
-			Conn: conn,
+			Conn:   conn,
+			Logger: slog.Default(),
 			Handler: func(w http.ResponseWriter, r http2.Request) {
 				time.Sleep(time.Second)
 				fmt.Fprintf(w, "Hello, %v, method: %v\n", r.Authority, r.Method)
@@ -0,0 +1,357 @@
+package qpack
+
+import "github.com/jakegut/goh2/hpack"
+
+type blockedSection struct {
+	streamID uint64
+	ric      int
+	data     []byte
+}
+
+// Decoder decodes field sections for one HTTP/3 connection. It consumes the
+// peer's encoder stream and produces instructions for our decoder stream.
+type Decoder struct {
+	table *dynamicTable
+
+	// maxCapacity and maxBlocked are the SETTINGS_QPACK_MAX_TABLE_CAPACITY
+	// and SETTINGS_QPACK_BLOCKED_STREAMS we advertise.
+	maxCapacity int
+	maxBlocked  int
+
+	blocked []blockedSection
+
+	// encoderBuf holds the start of an instruction split across writes.
+	encoderBuf []byte
+	// decoderStream holds instructions not yet taken by DecoderStream.
+	decoderStream []byte
+	// knownReceived is the insert count the encoder has been told about.
+	knownReceived int
+}
+
+func NewDecoder(maxCapacity, maxBlocked int) *Decoder {
+	return &Decoder{
+		table:       newDynamicTable(),
+		maxCapacity: maxCapacity,
+		maxBlocked:  maxBlocked,
+	}
+}
+
+// DecoderStream returns the instructions to send on the decoder stream,
+// acknowledging any inserts not covered by a Section Acknowledgment yet.
+func (d *Decoder) DecoderStream() []byte {
+	if n := d.table.insertCount() - d.knownReceived; n > 0 {
+		d.decoderStream = hpack.AppendInt(d.decoderStream, 0x00, 6, n)
+		d.knownReceived += n
+	}
+	instructions := d.decoderStream
+	d.decoderStream = nil
+	return instructions
+}
+
+// CancelStream drops any blocked field sections of a stream that was reset
+// or abandoned, and tells the encoder their references are gone.
+func (d *Decoder) CancelStream(streamID uint64) {
+	blocked := d.blocked[:0]
+	for _, section := range d.blocked {
+		if section.streamID != streamID {
+			blocked = append(blocked, section)
+		}
+	}
+	d.blocked = blocked
+	d.decoderStream = hpack.AppendInt(d.decoderStream, 0x40, 6, int(streamID))
+}
+
+// WriteEncoderStream processes encoder stream instructions, which may be
+// split at any point. It returns the blocked field sections that could be
+// decoded with the new entries. Any error is a connection error.
+func (d *Decoder) WriteEncoderStream(p []byte) ([]Section, error) {
+	bs := p
+	if len(d.encoderBuf) > 0 {
+		d.encoderBuf = append(d.encoderBuf, p...)
+		bs = d.encoderBuf
+	}
+
+	for len(bs) > 0 {
+		rest, err := d.encoderInstruction(bs)
+		if err == hpack.ErrTruncated {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		bs = rest
+	}
+
+	// keep the incomplete instruction, which is either the tail of
+	// d.encoderBuf or part of p, which belongs to the caller
+	if len(d.encoderBuf) > 0 {
+		d.encoderBuf = d.encoderBuf[:copy(d.encoderBuf, bs)]
+	} else {
+		d.encoderBuf = append(d.encoderBuf, bs...)
+	}
+
+	return d.unblock()
+}
+
+func (d *Decoder) unblock() ([]Section, error) {
+	var sections []Section
+	blocked := d.blocked[:0]
+	for _, section := range d.blocked {
+		if section.ric > d.table.insertCount() {
+			blocked = append(blocked, section)
+			continue
+		}
+		headers, err := d.decodeFieldLines(section.streamID, section.ric, section.data)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, Section{StreamID: section.streamID, Headers: headers})
+	}
+	d.blocked = blocked
+	return sections, nil
+}
+
+// encoderInstruction applies a single instruction. Nothing changes unless
+// the whole instruction is in bs.
+func (d *Decoder) encoderInstruction(bs []byte) ([]byte, error) {
+	var err error
+	switch first := bs[0]; {
+	case first&0x80 != 0: // insert with name reference
+		var index int
+		var value string
+		index, bs, err = hpack.ReadInt(bs, 6)
+		if err != nil {
+			return nil, streamError(err, ErrEncoderStream)
+		}
+		value, bs, err = hpack.ReadString(bs, 7)
+		if err != nil {
+			return nil, streamError(err, ErrEncoderStream)
+		}
+
+		var name hpack.Header
+		if first&0x40 != 0 {
+			if index >= len(staticTable) {
+				return nil, ErrEncoderStream
+			}
+			name = staticTable[index]
+		} else {
+			var ok bool
+			name, ok = d.table.get(d.table.insertCount() - 1 - index)
+			if !ok {
+				return nil, ErrEncoderStream
+			}
+		}
+		return bs, d.insert(hpack.Header{Name: name.Name, Value: value})
+	case first&0xc0 == 0x40: // insert with literal name
+		var name, value string
+		name, bs, err = hpack.ReadString(bs, 5)
+		if err != nil {
+			return nil, streamError(err, ErrEncoderStream)
+		}
+		value, bs, err = hpack.ReadString(bs, 7)
+		if err != nil {
+			return nil, streamError(err, ErrEncoderStream)
+		}
+		return bs, d.insert(hpack.Header{Name: name, Value: value})
+	case first&0xe0 == 0x20: // set dynamic table capacity
+		var capacity int
+		capacity, bs, err = hpack.ReadInt(bs, 5)
+		if err != nil {
+			return nil, streamError(err, ErrEncoderStream)
+		}
+		if capacity > d.maxCapacity {
+			return nil, ErrEncoderStream
+		}
+		d.table.capacity = capacity
+		d.table.evictTo(capacity)
+		return bs, nil
+	default: // duplicate
+		var index int
+		index, bs, err = hpack.ReadInt(bs, 5)
+		if err != nil {
+			return nil, streamError(err, ErrEncoderStream)
+		}
+		header, ok := d.table.get(d.table.insertCount() - 1 - index)
+		if !ok {
+			return nil, ErrEncoderStream
+		}
+		return bs, d.insert(header)
+	}
+}
+
+func (d *Decoder) insert(header hpack.Header) error {
+	if header.Size() > d.table.capacity {
+		return ErrEncoderStream
+	}
+	d.table.evictTo(d.table.capacity - header.Size())
+	d.table.insert(header)
+	return nil
+}
+
+// streamError keeps ErrTruncated, which just means more input is needed,
+// and turns anything else into the given QPACK error.
+func streamError(err, qpackErr error) error {
+	if err == hpack.ErrTruncated {
+		return err
+	}
+	return qpackErr
+}
+
+// DecodeFieldSection decodes the encoded field section of a HEADERS frame.
+// If the section references entries that haven't arrived on the encoder
+// stream yet, it is kept and ErrBlocked is returned. Any other error is a
+// connection error.
+func (d *Decoder) DecodeFieldSection(streamID uint64, bs []byte) ([]hpack.Header, error) {
+	encoded, rest, err := hpack.ReadInt(bs, 8)
+	if err != nil {
+		return nil, ErrDecompressionFailed
+	}
+	ric, err := decodeRequiredInsertCount(encoded, d.maxCapacity, d.table.insertCount())
+	if err != nil {
+		return nil, err
+	}
+
+	if ric > d.table.insertCount() {
+		if !d.isBlocked(streamID) && d.blockedStreams() >= d.maxBlocked {
+			return nil, ErrDecompressionFailed
+		}
+		d.blocked = append(d.blocked, blockedSection{
+			streamID: streamID,
+			ric:      ric,
+			data:     append([]byte(nil), rest...),
+		})
+		return nil, ErrBlocked
+	}
+
+	return d.decodeFieldLines(streamID, ric, rest)
+}
+
+func (d *Decoder) isBlocked(streamID uint64) bool {
+	for _, section := range d.blocked {
+		if section.streamID == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Decoder) blockedStreams() int {
+	streams := map[uint64]bool{}
+	for _, section := range d.blocked {
+		streams[section.streamID] = true
+	}
+	return len(streams)
+}
+
+// decodeFieldLines decodes a field section after the Required Insert Count,
+// acknowledging it if it references the dynamic table.
+func (d *Decoder) decodeFieldLines(streamID uint64, ric int, bs []byte) ([]hpack.Header, error) {
+	if len(bs) == 0 {
+		return nil, ErrDecompressionFailed
+	}
+	sign := bs[0]&0x80 != 0
+	deltaBase, bs, err := hpack.ReadInt(bs, 7)
+	if err != nil {
+		return nil, ErrDecompressionFailed
+	}
+	base := ric + deltaBase
+	if sign {
+		base = ric - deltaBase - 1
+		if base < 0 {
+			return nil, ErrDecompressionFailed
+		}
+	}
+
+	// dynamic returns the entry at abs, which the section may only reference
+	// below its Required Insert Count
+	dynamic := func(abs int) (hpack.Header, error) {
+		if abs < 0 || abs >= ric {
+			return hpack.Header{}, ErrDecompressionFailed
+		}
+		header, ok := d.table.get(abs)
+		if !ok {
+			return hpack.Header{}, ErrDecompressionFailed
+		}
+		return header, nil
+	}
+	static := func(index int) (hpack.Header, error) {
+		if index >= len(staticTable) {
+			return hpack.Header{}, ErrDecompressionFailed
+		}
+		return staticTable[index], nil
+	}
+
+	headers := []hpack.Header{}
+	for len(bs) > 0 {
+		var header hpack.Header
+		var index int
+		var err error
+		literal, neverIndex := true, false
+
+		switch first := bs[0]; {
+		case first&0x80 != 0: // indexed field line
+			literal = false
+			index, bs, err = hpack.ReadInt(bs, 6)
+			if err != nil {
+				return nil, ErrDecompressionFailed
+			}
+			if first&0x40 != 0 {
+				header, err = static(index)
+			} else {
+				header, err = dynamic(base - 1 - index)
+			}
+		case first&0xf0 == 0x10: // indexed field line with post-base index
+			literal = false
+			index, bs, err = hpack.ReadInt(bs, 4)
+			if err != nil {
+				return nil, ErrDecompressionFailed
+			}
+			header, err = dynamic(base + index)
+		case first&0xc0 == 0x40: // literal field line with name reference
+			neverIndex = first&0x20 != 0
+			index, bs, err = hpack.ReadInt(bs, 4)
+			if err != nil {
+				return nil, ErrDecompressionFailed
+			}
+			if first&0x10 != 0 {
+				header, err = static(index)
+			} else {
+				header, err = dynamic(base - 1 - index)
+			}
+		case first&0xe0 == 0x20: // literal field line with literal name
+			neverIndex = first&0x10 != 0
+			header.Name, bs, err = hpack.ReadString(bs, 3)
+		default: // literal field line with post-base name reference
+			neverIndex = first&0x08 != 0
+			index, bs, err = hpack.ReadInt(bs, 3)
+			if err != nil {
+				return nil, ErrDecompressionFailed
+			}
+			header, err = dynamic(base + index)
+		}
+		if err != nil {
+			return nil, ErrDecompressionFailed
+		}
+
+		if literal {
+			var value string
+			value, bs, err = hpack.ReadString(bs, 7)
+			if err != nil {
+				return nil, ErrDecompressionFailed
+			}
+			header = hpack.Header{Name: header.Name, Value: value}
+			if neverIndex {
+				header = hpack.NewSensitiveHeader(header.Name, value)
+			}
+		}
+		headers = append(headers, header)
+	}
+
+	if ric > 0 {
+		d.decoderStream = hpack.AppendInt(d.decoderStream, 0x80, 7, int(streamID))
+		if ric > d.knownReceived {
+			d.knownReceived = ric
+		}
+	}
+	return headers, nil
+}
@@ -0,0 +1,150 @@
+package qpack
+
+import (
+	"testing"
+
+	"github.com/jakegut/goh2/hpack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dynamicEntries lists the decoder's dynamic table, oldest first.
+func dynamicEntries(table *dynamicTable) []hpack.Header {
+	var headers []hpack.Header
+	for _, entry := range table.entries {
+		headers = append(headers, entry.header)
+	}
+	return headers
+}
+
+var (
+	authority   = hpack.Header{Name: ":authority", Value: "www.example.com"}
+	samplePath  = hpack.Header{Name: ":path", Value: "/sample/path"}
+	customKey   = hpack.Header{Name: "custom-key", Value: "custom-value"}
+	customKey2  = hpack.Header{Name: "custom-key", Value: "custom-value2"}
+	rootPath    = hpack.Header{Name: ":path", Value: "/"}
+	indexPath   = hpack.Header{Name: ":path", Value: "/index.html"}
+	maxCapacity = 220
+)
+
+// TestDecoderAppendixB follows the examples of RFC 9204 Appendix B.
+func TestDecoderAppendixB(t *testing.T) {
+	decoder := NewDecoder(maxCapacity, 16)
+
+	// B.1 literal field line with name reference
+	headers, err := decoder.DecodeFieldSection(0, dehex(t, "0000 510b 2f69 6e64 6578 2e68 746d 6c"))
+	require.NoError(t, err)
+	assert.Equal(t, []hpack.Header{indexPath}, headers)
+	assert.Empty(t, decoder.DecoderStream())
+
+	// B.2 dynamic table
+	sections, err := decoder.WriteEncoderStream(dehex(t, "3fbd01"+
+		"c00f 7777 772e 6578 616d 706c 652e 636f 6d"+
+		"c10c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Empty(t, sections)
+	assert.Equal(t, []hpack.Header{authority, samplePath}, dynamicEntries(decoder.table))
+	assert.Equal(t, 106, decoder.table.size)
+
+	headers, err = decoder.DecodeFieldSection(4, dehex(t, "0381 10 11"))
+	require.NoError(t, err)
+	assert.Equal(t, []hpack.Header{authority, samplePath}, headers)
+	assert.Equal(t, dehex(t, "84"), decoder.DecoderStream())
+
+	// B.3 speculative insert
+	sections, err = decoder.WriteEncoderStream(dehex(t, "4a63 7573 746f 6d2d 6b65 790c 6375 7374 6f6d 2d76 616c 7565"))
+	require.NoError(t, err)
+	assert.Empty(t, sections)
+	assert.Equal(t, 160, decoder.table.size)
+	assert.Equal(t, dehex(t, "01"), decoder.DecoderStream())
+
+	// B.4 duplicate instruction, stream cancellation: the field section
+	// arrives before the duplicate it references
+	_, err = decoder.DecodeFieldSection(8, dehex(t, "0500 80 c1 81"))
+	assert.ErrorIs(t, err, ErrBlocked)
+	decoder.CancelStream(8)
+	assert.Equal(t, dehex(t, "48"), decoder.DecoderStream())
+
+	sections, err = decoder.WriteEncoderStream(dehex(t, "02"))
+	require.NoError(t, err)
+	assert.Empty(t, sections, "cancelled section")
+	assert.Equal(t, []hpack.Header{authority, samplePath, customKey, authority}, dynamicEntries(decoder.table))
+	assert.Equal(t, 217, decoder.table.size)
+
+	// B.5 dynamic table insert, eviction
+	sections, err = decoder.WriteEncoderStream(dehex(t, "810d 6375 7374 6f6d 2d76 616c 7565 32"))
+	require.NoError(t, err)
+	assert.Empty(t, sections)
+	assert.Equal(t, []hpack.Header{samplePath, customKey, authority, customKey2}, dynamicEntries(decoder.table))
+	assert.Equal(t, 215, decoder.table.size)
+	// both the duplicate and the new entry are acknowledged at once
+	assert.Equal(t, dehex(t, "02"), decoder.DecoderStream())
+}
+
+func TestDecoderUnblocksSections(t *testing.T) {
+	decoder := NewDecoder(maxCapacity, 16)
+	encoderStream := dehex(t, "3fbd01"+
+		"c00f 7777 772e 6578 616d 706c 652e 636f 6d"+
+		"c10c 2f73 616d 706c 652f 7061 7468")
+
+	_, err := decoder.DecodeFieldSection(4, dehex(t, "0381 10 11"))
+	assert.ErrorIs(t, err, ErrBlocked)
+
+	// the encoder stream may be split anywhere
+	sections, err := decoder.WriteEncoderStream(encoderStream[:20])
+	require.NoError(t, err)
+	assert.Empty(t, sections)
+	assert.Equal(t, 1, decoder.table.insertCount())
+
+	sections, err = decoder.WriteEncoderStream(encoderStream[20:])
+	require.NoError(t, err)
+	assert.Equal(t, []Section{{StreamID: 4, Headers: []hpack.Header{authority, samplePath}}}, sections)
+	assert.Equal(t, dehex(t, "84"), decoder.DecoderStream())
+}
+
+func TestDecoderBlockedStreamsLimit(t *testing.T) {
+	decoder := NewDecoder(maxCapacity, 1)
+
+	_, err := decoder.DecodeFieldSection(4, dehex(t, "0381 10 11"))
+	assert.ErrorIs(t, err, ErrBlocked)
+	// the same stream may block again
+	_, err = decoder.DecodeFieldSection(4, dehex(t, "0381 10 11"))
+	assert.ErrorIs(t, err, ErrBlocked)
+	_, err = decoder.DecodeFieldSection(8, dehex(t, "0381 10 11"))
+	assert.ErrorIs(t, err, ErrDecompressionFailed)
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		encoderStream string
+		section       string
+		err           error
+	}{
+		{name: "capacity above maximum", encoderStream: "3fbe01", err: ErrEncoderStream},
+		{name: "entry larger than capacity", encoderStream: "3f01 c00f 7777 772e 6578 616d 706c 652e 636f 6d", err: ErrEncoderStream},
+		{name: "insert with unknown static name", encoderStream: "3fbd01 ff64 00", err: ErrEncoderStream},
+		{name: "insert with unknown dynamic name", encoderStream: "3fbd01 8000", err: ErrEncoderStream},
+		{name: "duplicate of unknown entry", encoderStream: "3fbd01 00", err: ErrEncoderStream},
+		{name: "unknown static index", section: "0000 ff24", err: ErrDecompressionFailed},
+		{name: "dynamic reference without required insert count", encoderStream: "3fbd01 c000", section: "0000 80", err: ErrDecompressionFailed},
+		{name: "post-base reference beyond required insert count", encoderStream: "3fbd01 c000", section: "0200 11", err: ErrDecompressionFailed},
+		{name: "negative base", encoderStream: "3fbd01 c000", section: "0281 10", err: ErrDecompressionFailed},
+		{name: "truncated literal", section: "0000 510b 2f", err: ErrDecompressionFailed},
+		{name: "missing base", section: "00", err: ErrDecompressionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewDecoder(maxCapacity, 16)
+			var err error
+			if tt.encoderStream != "" {
+				_, err = decoder.WriteEncoderStream(dehex(t, tt.encoderStream))
+			}
+			if err == nil && tt.section != "" {
+				_, err = decoder.DecodeFieldSection(0, dehex(t, tt.section))
+			}
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package qpack
+
+import "github.com/jakegut/goh2/hpack"
+
+// fieldSection is an encoded field section the decoder hasn't acknowledged.
+type fieldSection struct {
+	ric  int
+	refs []int // absolute indices of referenced entries
+}
+
+// Encoder encodes field sections for one HTTP/3 connection. It produces
+// instructions for our encoder stream and consumes the peer's decoder
+// stream.
+//
+// Entries are inserted into the dynamic table as long as they fit and only
+// evict entries no unacknowledged field section refers to. Referencing an
+// entry the decoder hasn't acknowledged blocks the stream until it arrives,
+// which is only done within SETTINGS_QPACK_BLOCKED_STREAMS.
+type Encoder struct {
+	// DisableHuffman sends every string literal as-is instead of Huffman
+	// coding the ones that get shorter.
+	DisableHuffman bool
+
+	table *dynamicTable
+
+	// maxCapacity and maxBlocked are the peer's
+	// SETTINGS_QPACK_MAX_TABLE_CAPACITY and SETTINGS_QPACK_BLOCKED_STREAMS.
+	maxCapacity int
+	maxBlocked  int
+
+	knownReceived int
+	sections      map[uint64][]*fieldSection
+
+	encoderStream []byte
+	// decoderBuf holds the start of an instruction split across writes.
+	decoderBuf []byte
+}
+
+// NewEncoder returns an encoder for a peer with the given settings. The
+// dynamic table is not used until SetTableCapacity is called.
+func NewEncoder(maxCapacity, maxBlocked int) *Encoder {
+	return &Encoder{
+		table:       newDynamicTable(),
+		maxCapacity: maxCapacity,
+		maxBlocked:  maxBlocked,
+		sections:    map[uint64][]*fieldSection{},
+	}
+}
+
+// EncoderStream returns the instructions to send on the encoder stream.
+// They must be sent before the field sections encoded since the last call.
+func (e *Encoder) EncoderStream() []byte {
+	instructions := e.encoderStream
+	e.encoderStream = nil
+	return instructions
+}
+
+// SetTableCapacity sets the dynamic table capacity, which can't exceed the
+// peer's maximum. Shrinking fails if it would evict referenced entries.
+func (e *Encoder) SetTableCapacity(capacity int) error {
+	if capacity > e.maxCapacity {
+		return ErrEncoderStream
+	}
+	if !e.canEvictTo(capacity) {
+		return ErrEncoderStream
+	}
+	e.table.evictTo(capacity)
+	e.table.capacity = capacity
+	e.encoderStream = hpack.AppendInt(e.encoderStream, 0x20, 5, capacity)
+	return nil
+}
+
+// evictable reports whether the decoder no longer needs the entry at abs.
+func (e *Encoder) evictable(abs int) bool {
+	entry, _ := e.table.entry(abs)
+	return entry.refs == 0 && abs < e.knownReceived
+}
+
+// canEvictTo reports whether evicting down to size only evicts entries
+// that are evictable.
+func (e *Encoder) canEvictTo(size int) bool {
+	current := e.table.size
+	for abs := e.table.dropped; current > size; abs++ {
+		if !e.evictable(abs) {
+			return false
+		}
+		entry, _ := e.table.entry(abs)
+		current -= entry.header.Size()
+	}
+	return true
+}
+
+func (e *Encoder) blockedStreams() int {
+	n := 0
+	for _, sections := range e.sections {
+		for _, section := range sections {
+			if section.ric > e.knownReceived {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+func (e *Encoder) isBlocking(streamID uint64) bool {
+	for _, section := range e.sections[streamID] {
+		if section.ric > e.knownReceived {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeFieldSection encodes the headers of a HEADERS frame on streamID.
+func (e *Encoder) EncodeFieldSection(streamID uint64, headers []hpack.Header) ([]byte, error) {
+	base := e.table.insertCount()
+	section := &fieldSection{}
+	// referencing unacknowledged entries blocks the stream
+	canBlock := e.isBlocking(streamID) || e.blockedStreams() < e.maxBlocked
+
+	usable := func(abs int) bool {
+		return abs < e.knownReceived || canBlock
+	}
+	reference := func(abs int) {
+		entry, _ := e.table.entry(abs)
+		entry.refs++
+		section.refs = append(section.refs, abs)
+		if abs+1 > section.ric {
+			section.ric = abs + 1
+		}
+	}
+
+	var lines []byte
+	for _, header := range headers {
+		field := headerField{header.Name, header.Value}
+
+		// sensitive headers are always sent as literals
+		if !header.Sensitive() {
+			if index, ok := staticFieldIndex[field]; ok {
+				lines = hpack.AppendInt(lines, 0xc0, 6, index)
+				continue
+			}
+
+			abs, ok := e.table.fieldIndex[field]
+			if !ok || !usable(abs) {
+				abs, ok = e.insert(header, canBlock)
+			}
+			if ok {
+				reference(abs)
+				if abs < base {
+					lines = hpack.AppendInt(lines, 0x80, 6, base-1-abs)
+				} else {
+					lines = hpack.AppendInt(lines, 0x10, 4, abs-base)
+				}
+				continue
+			}
+		}
+
+		var neverIndex byte
+		if header.Sensitive() {
+			neverIndex = 0x20
+		}
+		if index, ok := staticNameIndex[header.Name]; ok {
+			lines = hpack.AppendInt(lines, 0x40|neverIndex|0x10, 4, index)
+		} else if abs, ok := e.table.nameIndex[header.Name]; ok && usable(abs) {
+			reference(abs)
+			if abs < base {
+				lines = hpack.AppendInt(lines, 0x40|neverIndex, 4, base-1-abs)
+			} else {
+				lines = hpack.AppendInt(lines, neverIndex>>2, 3, abs-base)
+			}
+		} else {
+			lines = hpack.AppendString(lines, 0x20|neverIndex>>1, 3, header.Name, !e.DisableHuffman)
+		}
+		lines = hpack.AppendString(lines, 0, 7, header.Value, !e.DisableHuffman)
+	}
+
+	// the prefix: Required Insert Count, then Base relative to it
+	dst := hpack.AppendInt(nil, 0, 8, encodeRequiredInsertCount(section.ric, e.maxCapacity))
+	switch {
+	case section.ric == 0:
+		dst = append(dst, 0)
+	case base >= section.ric:
+		dst = hpack.AppendInt(dst, 0, 7, base-section.ric)
+	default:
+		dst = hpack.AppendInt(dst, 0x80, 7, section.ric-base-1)
+	}
+
+	if section.ric > 0 {
+		e.sections[streamID] = append(e.sections[streamID], section)
+	}
+	return append(dst, lines...), nil
+}
+
+// insert adds header to the dynamic table if it fits without evicting
+// entries still in use, returning its absolute index.
+func (e *Encoder) insert(header hpack.Header, canBlock bool) (int, bool) {
+	// the decoder acknowledges the new entry later, so referencing it
+	// blocks
+	if !canBlock || header.Size() > e.table.capacity {
+		return 0, false
+	}
+	if !e.canEvictTo(e.table.capacity - header.Size()) {
+		return 0, false
+	}
+	e.table.evictTo(e.table.capacity - header.Size())
+
+	if index, ok := staticNameIndex[header.Name]; ok {
+		e.encoderStream = hpack.AppendInt(e.encoderStream, 0xc0, 6, index)
+	} else if abs, ok := e.table.nameIndex[header.Name]; ok {
+		e.encoderStream = hpack.AppendInt(e.encoderStream, 0x80, 6, e.table.insertCount()-1-abs)
+	} else {
+		e.encoderStream = hpack.AppendString(e.encoderStream, 0x40, 5, header.Name, !e.DisableHuffman)
+	}
+	e.encoderStream = hpack.AppendString(e.encoderStream, 0, 7, header.Value, !e.DisableHuffman)
+
+	e.table.insert(header)
+	return e.table.insertCount() - 1, true
+}
+
+// WriteDecoderStream processes decoder stream instructions, which may be
+// split at any point. Any error is a connection error.
+func (e *Encoder) WriteDecoderStream(p []byte) error {
+	bs := p
+	if len(e.decoderBuf) > 0 {
+		e.decoderBuf = append(e.decoderBuf, p...)
+		bs = e.decoderBuf
+	}
+
+	for len(bs) > 0 {
+		rest, err := e.decoderInstruction(bs)
+		if err == hpack.ErrTruncated {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		bs = rest
+	}
+
+	// keep the incomplete instruction, which is either the tail of
+	// e.decoderBuf or part of p, which belongs to the caller
+	if len(e.decoderBuf) > 0 {
+		e.decoderBuf = e.decoderBuf[:copy(e.decoderBuf, bs)]
+	} else {
+		e.decoderBuf = append(e.decoderBuf, bs...)
+	}
+	return nil
+}
+
+func (e *Encoder) decoderInstruction(bs []byte) ([]byte, error) {
+	switch first := bs[0]; {
+	case first&0x80 != 0: // section acknowledgment
+		streamID, rest, err := hpack.ReadInt(bs, 7)
+		if err != nil {
+			return nil, streamError(err, ErrDecoderStream)
+		}
+		sections := e.sections[uint64(streamID)]
+		if len(sections) == 0 {
+			return nil, ErrDecoderStream
+		}
+		e.release(sections[0])
+		if sections[0].ric > e.knownReceived {
+			e.knownReceived = sections[0].ric
+		}
+		if len(sections) == 1 {
+			delete(e.sections, uint64(streamID))
+		} else {
+			e.sections[uint64(streamID)] = sections[1:]
+		}
+		return rest, nil
+	case first&0xc0 == 0x40: // stream cancellation
+		streamID, rest, err := hpack.ReadInt(bs, 6)
+		if err != nil {
+			return nil, streamError(err, ErrDecoderStream)
+		}
+		for _, section := range e.sections[uint64(streamID)] {
+			e.release(section)
+		}
+		delete(e.sections, uint64(streamID))
+		return rest, nil
+	default: // insert count increment
+		increment, rest, err := hpack.ReadInt(bs, 6)
+		if err != nil {
+			return nil, streamError(err, ErrDecoderStream)
+		}
+		if increment == 0 || e.knownReceived+increment > e.table.insertCount() {
+			return nil, ErrDecoderStream
+		}
+		e.knownReceived += increment
+		return rest, nil
+	}
+}
+
+func (e *Encoder) release(section *fieldSection) {
+	for _, abs := range section.refs {
+		// referenced entries can't have been evicted
+		entry, _ := e.table.entry(abs)
+		entry.refs--
+	}
+}
@@ -0,0 +1,188 @@
+package qpack
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jakegut/goh2/hpack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEncoderAppendixB reproduces the encoder side of RFC 9204 B.1 and B.2,
+// then feeds it the decoder stream of the remaining examples.
+func TestEncoderAppendixB(t *testing.T) {
+	encoder := NewEncoder(maxCapacity, 16)
+	encoder.DisableHuffman = true
+
+	// B.1 without a dynamic table
+	section, err := encoder.EncodeFieldSection(0, []hpack.Header{indexPath})
+	require.NoError(t, err)
+	assert.Equal(t, dehex(t, "0000 510b 2f69 6e64 6578 2e68 746d 6c"), section)
+	assert.Empty(t, encoder.EncoderStream())
+
+	// B.2
+	require.NoError(t, encoder.SetTableCapacity(220))
+	section, err = encoder.EncodeFieldSection(4, []hpack.Header{authority, samplePath})
+	require.NoError(t, err)
+	assert.Equal(t, dehex(t, "3fbd01"+
+		"c00f 7777 772e 6578 616d 706c 652e 636f 6d"+
+		"c10c 2f73 616d 706c 652f 7061 7468"), encoder.EncoderStream())
+	assert.Equal(t, dehex(t, "0381 10 11"), section)
+	assert.Equal(t, 1, encoder.blockedStreams())
+
+	require.NoError(t, encoder.WriteDecoderStream(dehex(t, "84")))
+	assert.Equal(t, 2, encoder.knownReceived)
+	assert.Equal(t, 0, encoder.blockedStreams())
+	assert.Empty(t, encoder.sections)
+
+	// now acknowledged, the entries are referenced relative to Base
+	section, err = encoder.EncodeFieldSection(8, []hpack.Header{authority, rootPath, samplePath})
+	require.NoError(t, err)
+	assert.Equal(t, dehex(t, "0300 81 c1 80"), section)
+	assert.Empty(t, encoder.EncoderStream())
+
+	// B.4's stream cancellation releases the references
+	require.NoError(t, encoder.WriteDecoderStream(dehex(t, "48")))
+	assert.Empty(t, encoder.sections)
+	for _, entry := range encoder.table.entries {
+		assert.Equal(t, 0, entry.refs)
+	}
+
+	// an increment beyond the inserted entries is an error
+	assert.ErrorIs(t, encoder.WriteDecoderStream(dehex(t, "01")), ErrDecoderStream)
+}
+
+func TestEncoderKeepsReferencedEntries(t *testing.T) {
+	encoder := NewEncoder(maxCapacity, 16)
+	// room for two of these 50 byte entries
+	require.NoError(t, encoder.SetTableCapacity(100))
+	encoder.EncoderStream()
+	header := func(n int) hpack.Header {
+		return hpack.Header{Name: "x-header", Value: fmt.Sprintf("value-%03d", n)}
+	}
+
+	_, err := encoder.EncodeFieldSection(0, []hpack.Header{header(1), header(2)})
+	require.NoError(t, err)
+	assert.Equal(t, 2, encoder.table.insertCount())
+	encoder.EncoderStream()
+
+	// evicting either entry would break the unacknowledged section
+	section, err := encoder.EncodeFieldSection(4, []hpack.Header{header(3)})
+	require.NoError(t, err)
+	assert.Equal(t, 2, encoder.table.insertCount())
+	assert.Empty(t, encoder.EncoderStream())
+	// but the newest entry's name can still be referenced
+	assert.Equal(t, dehex(t, "0300 40"), section[:3])
+
+	require.NoError(t, encoder.WriteDecoderStream(dehex(t, "80")))
+	_, err = encoder.EncodeFieldSection(8, []hpack.Header{header(3)})
+	require.NoError(t, err)
+	assert.Equal(t, 3, encoder.table.insertCount())
+	assert.Equal(t, []hpack.Header{header(2), header(3)}, dynamicEntries(encoder.table))
+
+	// stream 4 still references the older entry's name, so shrinking the
+	// table can't evict it
+	assert.ErrorIs(t, encoder.SetTableCapacity(50), ErrEncoderStream)
+	assert.ErrorIs(t, encoder.SetTableCapacity(maxCapacity+1), ErrEncoderStream)
+}
+
+func TestEncoderBlockedStreamsLimit(t *testing.T) {
+	encoder := NewEncoder(maxCapacity, 1)
+	require.NoError(t, encoder.SetTableCapacity(maxCapacity))
+	encoder.EncoderStream()
+	custom := hpack.Header{Name: "x-custom", Value: "value"}
+
+	section, err := encoder.EncodeFieldSection(4, []hpack.Header{custom})
+	require.NoError(t, err)
+	assert.Equal(t, byte(2), section[0], "references the new entry")
+
+	// stream 4 may block again, but a second stream may not block
+	section, err = encoder.EncodeFieldSection(4, []hpack.Header{custom})
+	require.NoError(t, err)
+	assert.Equal(t, byte(2), section[0])
+	section, err = encoder.EncodeFieldSection(8, []hpack.Header{custom})
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), section[0])
+
+	// until the entry is acknowledged
+	require.NoError(t, encoder.WriteDecoderStream(dehex(t, "01")))
+	section, err = encoder.EncodeFieldSection(8, []hpack.Header{custom})
+	require.NoError(t, err)
+	assert.Equal(t, dehex(t, "0200 80"), section)
+}
+
+func TestEncoderSensitiveHeaders(t *testing.T) {
+	encoder := NewEncoder(maxCapacity, 16)
+	require.NoError(t, encoder.SetTableCapacity(maxCapacity))
+	decoder := NewDecoder(maxCapacity, 16)
+
+	headers := []hpack.Header{
+		hpack.NewSensitiveHeader("authorization", "secret"),
+		hpack.NewSensitiveHeader("x-token", "secret"),
+		hpack.NewSensitiveHeader(":path", "/"),
+	}
+	section, err := encoder.EncodeFieldSection(0, headers)
+	require.NoError(t, err)
+	assert.Equal(t, 0, encoder.table.insertCount())
+
+	_, err = decoder.WriteEncoderStream(encoder.EncoderStream())
+	require.NoError(t, err)
+	decoded, err := decoder.DecodeFieldSection(0, section)
+	require.NoError(t, err)
+	assert.Equal(t, headers, decoded)
+	for _, header := range decoded {
+		assert.True(t, header.Sensitive(), header.Name)
+	}
+}
+
+// TestEncoderDecoder runs requests over several streams, delivering the
+// encoder stream late so that sections block and unblock.
+func TestEncoderDecoder(t *testing.T) {
+	encoder := NewEncoder(1024, 4)
+	require.NoError(t, encoder.SetTableCapacity(512))
+	decoder := NewDecoder(1024, 4)
+
+	request := func(n int) []hpack.Header {
+		return []hpack.Header{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":authority", Value: "www.example.com"},
+			{Name: ":path", Value: fmt.Sprintf("/resource/%d", n%7)},
+			{Name: "user-agent", Value: "goh2-test"},
+			{Name: fmt.Sprintf("x-header-%d", n%5), Value: fmt.Sprintf("value-%d", n%3)},
+		}
+	}
+
+	for round := 0; round < 20; round++ {
+		want := map[uint64][]hpack.Header{}
+		var sections []Section
+		for i := 0; i < 4; i++ {
+			streamID := uint64(4 * (4*round + i))
+			headers := request(4*round + i)
+			section, err := encoder.EncodeFieldSection(streamID, headers)
+			require.NoError(t, err)
+			want[streamID] = headers
+
+			decoded, err := decoder.DecodeFieldSection(streamID, section)
+			if err == ErrBlocked {
+				continue
+			}
+			require.NoError(t, err)
+			sections = append(sections, Section{StreamID: streamID, Headers: decoded})
+		}
+
+		unblocked, err := decoder.WriteEncoderStream(encoder.EncoderStream())
+		require.NoError(t, err)
+		sections = append(sections, unblocked...)
+		require.Len(t, sections, 4, "round %d", round)
+		for _, section := range sections {
+			assert.Equal(t, want[section.StreamID], section.Headers, "stream %d", section.StreamID)
+		}
+
+		require.NoError(t, encoder.WriteDecoderStream(decoder.DecoderStream()))
+		assert.Empty(t, encoder.sections, "round %d", round)
+		assert.Equal(t, encoder.table.insertCount(), encoder.knownReceived)
+		assert.Equal(t, dynamicEntries(encoder.table), dynamicEntries(decoder.table))
+	}
+}
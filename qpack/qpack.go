@@ -0,0 +1,73 @@
+// Package qpack implements QPACK header compression for HTTP/3 (RFC 9204).
+// It shares the Huffman code and the integer and string literal codecs
+// with the hpack package.
+//
+// Unlike HPACK, dynamic table updates travel on their own unidirectional
+// streams: the Encoder produces encoder stream instructions and consumes
+// decoder stream instructions, and the Decoder the other way around. Field
+// sections referencing entries the decoder hasn't received yet are blocked
+// until the entries arrive.
+package qpack
+
+import (
+	"errors"
+
+	"github.com/jakegut/goh2/hpack"
+)
+
+var (
+	ErrDecompressionFailed = errors.New("QPACK_DECOMPRESSION_FAILED")
+	ErrEncoderStream       = errors.New("QPACK_ENCODER_STREAM_ERROR")
+	ErrDecoderStream       = errors.New("QPACK_DECODER_STREAM_ERROR")
+)
+
+// ErrBlocked is returned by Decoder.DecodeFieldSection for a field section
+// that needs dynamic table entries which haven't arrived yet. The section
+// is decoded once they have, see Decoder.WriteEncoderStream.
+var ErrBlocked = errors.New("field section is blocked")
+
+// Section is a decoded field section.
+type Section struct {
+	StreamID uint64
+	Headers  []hpack.Header
+}
+
+// maxEntries is the most entries a table with maxCapacity can hold, which
+// bounds how far apart encoder and decoder insert counts can be.
+func maxEntries(maxCapacity int) int {
+	return maxCapacity / entryOverhead
+}
+
+// encodeRequiredInsertCount is RFC 9204 §4.5.1.1.
+func encodeRequiredInsertCount(ric, maxCapacity int) int {
+	if ric == 0 {
+		return 0
+	}
+	return ric%(2*maxEntries(maxCapacity)) + 1
+}
+
+// decodeRequiredInsertCount reverses encodeRequiredInsertCount given the
+// decoder's current insert count.
+func decodeRequiredInsertCount(encoded, maxCapacity, insertCount int) (int, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+	fullRange := 2 * maxEntries(maxCapacity)
+	if encoded > fullRange {
+		return 0, ErrDecompressionFailed
+	}
+
+	maxValue := insertCount + maxEntries(maxCapacity)
+	maxWrapped := maxValue / fullRange * fullRange
+	ric := maxWrapped + encoded - 1
+	if ric > maxValue {
+		if ric <= fullRange {
+			return 0, ErrDecompressionFailed
+		}
+		ric -= fullRange
+	}
+	if ric == 0 {
+		return 0, ErrDecompressionFailed
+	}
+	return ric, nil
+}
@@ -0,0 +1,47 @@
+package qpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dehex(t *testing.T, s string) []byte {
+	t.Helper()
+	bs, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	require.NoError(t, err)
+	return bs
+}
+
+func TestRequiredInsertCount(t *testing.T) {
+	const maxCapacity = 220 // 6 entries
+	n := maxEntries(maxCapacity)
+
+	// the decoder can be behind the encoder by up to MaxEntries inserts
+	// and ahead of it by fewer than MaxEntries
+	for insertCount := 0; insertCount < 50; insertCount++ {
+		for ric := insertCount - n + 1; ric <= insertCount+n; ric++ {
+			if ric <= 0 {
+				continue
+			}
+			encoded := encodeRequiredInsertCount(ric, maxCapacity)
+			decoded, err := decodeRequiredInsertCount(encoded, maxCapacity, insertCount)
+			require.NoError(t, err, "ric %d insert count %d", ric, insertCount)
+			assert.Equal(t, ric, decoded, "ric %d insert count %d", ric, insertCount)
+		}
+	}
+
+	ric, err := decodeRequiredInsertCount(0, maxCapacity, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, ric)
+
+	// beyond 2*MaxEntries
+	_, err = decodeRequiredInsertCount(13, maxCapacity, 0)
+	assert.ErrorIs(t, err, ErrDecompressionFailed)
+	// would wrap to 0 or below
+	_, err = decodeRequiredInsertCount(8, maxCapacity, 0)
+	assert.ErrorIs(t, err, ErrDecompressionFailed)
+}
@@ -0,0 +1,88 @@
+package qpack
+
+import "github.com/jakegut/goh2/hpack"
+
+// entryOverhead is the per-entry overhead counted towards the table size,
+// the same 32 bytes as HPACK.
+const entryOverhead = 32
+
+type tableEntry struct {
+	header hpack.Header
+	// refs counts the unacknowledged field sections referencing the entry.
+	// Only the encoder tracks them.
+	refs int
+}
+
+// dynamicTable is the QPACK dynamic table. Entries are addressed by their
+// absolute index, the number of entries inserted before them; entries[0]
+// is the oldest entry still in the table.
+type dynamicTable struct {
+	entries  []tableEntry
+	dropped  int
+	size     int
+	capacity int
+
+	fieldIndex map[headerField]int
+	nameIndex  map[string]int
+}
+
+func newDynamicTable() *dynamicTable {
+	return &dynamicTable{
+		fieldIndex: map[headerField]int{},
+		nameIndex:  map[string]int{},
+	}
+}
+
+// insertCount is the total number of entries ever inserted.
+func (t *dynamicTable) insertCount() int {
+	return t.dropped + len(t.entries)
+}
+
+func (t *dynamicTable) entry(abs int) (*tableEntry, bool) {
+	if abs < t.dropped || abs >= t.insertCount() {
+		return nil, false
+	}
+	return &t.entries[abs-t.dropped], true
+}
+
+func (t *dynamicTable) get(abs int) (hpack.Header, bool) {
+	entry, ok := t.entry(abs)
+	if !ok {
+		return hpack.Header{}, false
+	}
+	return entry.header, true
+}
+
+// insert adds header, which must fit without evicting anything.
+func (t *dynamicTable) insert(header hpack.Header) {
+	abs := t.insertCount()
+	t.entries = append(t.entries, tableEntry{header: header})
+	t.size += header.Size()
+	t.fieldIndex[headerField{header.Name, header.Value}] = abs
+	t.nameIndex[header.Name] = abs
+}
+
+func (t *dynamicTable) evict() {
+	header := t.entries[0].header
+	t.entries[0] = tableEntry{}
+	t.entries = t.entries[1:]
+	t.size -= header.Size()
+
+	// a newer entry may have taken over the index
+	abs := t.dropped
+	t.dropped++
+	field := headerField{header.Name, header.Value}
+	if t.fieldIndex[field] == abs {
+		delete(t.fieldIndex, field)
+	}
+	if t.nameIndex[header.Name] == abs {
+		delete(t.nameIndex, header.Name)
+	}
+}
+
+// evictTo evicts the oldest entries until size bytes are left at most.
+func (t *dynamicTable) evictTo(size int) {
+	for t.size > size && len(t.entries) > 0 {
+		t.evict()
+	}
+}